@@ -1,16 +1,37 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
 	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/admin"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/metrics"
 	custommiddleware "github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/quota"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/rls"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/telemetry"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 func main() {
@@ -20,6 +41,24 @@ func main() {
 		log.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	// Export traces and metrics to the OpenTelemetry collector when one is configured
+	if cfg.Telemetry.CollectorEndpoint != "" {
+		shutdownTelemetry, err := telemetry.Setup(ctx, cfg.Telemetry)
+		if err != nil {
+			log.Fatalf("Failed to set up OpenTelemetry: %v", err)
+		}
+		defer func() {
+			shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer shutdownCancel()
+			if err := shutdownTelemetry(shutdownCtx); err != nil {
+				log.Printf("Failed to shut down OpenTelemetry: %v", err)
+			}
+		}()
+	}
+
 	// Initialize storage based on configuration
 	var store storage.Storage
 	store, err = storage.New(cfg.StorageType, cfg.Storage[cfg.StorageType])
@@ -27,31 +66,153 @@ func main() {
 		log.Fatalf("Failed to connect to storage: %v", err)
 	}
 
+	// Expose the decisions, the storage latency and the blocks on /metrics
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	rateLimiterMetrics := metrics.New(registry)
+	memoryStores := make(map[string]*storage.MemoryStorage)
+	if memoryStore, ok := store.(*storage.MemoryStorage); ok {
+		memoryStores[cfg.StorageType] = memoryStore
+	}
+	store = telemetry.InstrumentStorage(rateLimiterMetrics.InstrumentStorage(store, cfg.StorageType), cfg.StorageType)
+
+	// Stop hammering the storage when it fails, limiting locally meanwhile when configured
+	var fallback storage.Storage
+	if cfg.Failure.Fallback {
+		memoryStore := storage.NewMemoryStorage(config.StorageConfig{})
+		memoryStores["fallback"] = memoryStore
+		fallback = telemetry.InstrumentStorage(rateLimiterMetrics.InstrumentStorage(memoryStore, "fallback"), "fallback")
+	}
+	store = storage.NewBreaker(store, cfg.Failure, fallback)
+	rateLimiterMetrics.RegisterBlocks(store)
+	rateLimiterMetrics.RegisterMemory(memoryStores)
+
 	defer store.Close()
 
-	// Initialize rate limiter
-	rateLimiter := limiter.New(store, limiter.Config{
-		IP:    cfg.IP,
-		Token: cfg.Token,
+	// Initialize client IP extraction
+	clientIP, err := custommiddleware.NewClientIPResolver(cfg.ClientIP)
+	if err != nil {
+		log.Fatalf("Failed to configure client IP extraction: %v", err)
+	}
+
+	// Initialize rate limiter, the rate limit service and the quota endpoint check the
+	// requests with the limiter of the middleware
+	rateLimiter := limiter.New(store, limiterConfig(cfg))
+	rateLimiter.SetMetrics(rateLimiterMetrics)
+
+	// Resolve API keys through the token registry when one is configured
+	if cfg.TokenStore.File != "" {
+		tokenStore, err := tokens.NewFileStore(cfg.TokenStore.File)
+		if err != nil {
+			log.Fatalf("Failed to open token registry: %v", err)
+		}
+		rateLimiter.SetTokenStore(tokenStore)
+	}
+
+	// Keep the access lists managed through the admin API in sync across the instances
+	if err := rateLimiter.WatchAccess(ctx, cfg.Access.RefreshInterval); err != nil {
+		log.Printf("Failed to read the access lists: %v", err)
+	}
+
+	// Apply the new rate limits, quotas and access lists whenever the configuration changes or on SIGHUP,
+	// the other settings still require a restart
+	err = config.Watch(ctx, func(cfg *config.Config) {
+		rateLimiter.SetConfig(limiterConfig(cfg))
 	})
+	if err != nil {
+		log.Printf("Configuration hot reload disabled: %v", err)
+	}
+
+	// Serve Envoy's rate limit service protocol when configured, so Envoy can limit
+	// the requests to the services behind it with this rate limiter
+	var grpcServer *grpc.Server
+	if cfg.RLS.Port != "" {
+		lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.RLS.Port))
+		if err != nil {
+			log.Fatalf("Failed to listen for the rate limit service: %v", err)
+		}
+
+		grpcServer = grpc.NewServer(grpc.StatsHandler(otelgrpc.NewServerHandler()))
+		rlsv3.RegisterRateLimitServiceServer(grpcServer, rls.NewServer(rateLimiter, clientIP, cfg.RLS))
+		healthpb.RegisterHealthServer(grpcServer, health.NewServer())
+		go func() {
+			log.Printf("Rate limit service starting on %s", lis.Addr())
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Fatalf("Rate limit service failed: %v", err)
+			}
+		}()
+	}
 
 	// Initialize router
 	r := chi.NewRouter()
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 
-	// Apply rate limiter middleware
-	r.Use(custommiddleware.RateLimiterMiddleware(rateLimiter))
+	r.Group(func(r chi.Router) {
+		// Apply rate limiter middleware
+		r.Use(custommiddleware.RateLimiterMiddleware(rateLimiter, clientIP, rateLimiterMetrics))
 
-	// Define routes
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("Hello World!"))
+		// Define routes
+		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("Hello World!"))
+		})
+
+		// Show the quotas of an API key behind the rate limiter, so the keys can't be probed
+		// without limit and each query is counted as a request of the key
+		r.Get("/quota", quota.NewHandler(rateLimiter).ServeHTTP)
 	})
 
+	// Serve the metrics outside the rate limiter, so scrapes are never limited
+	r.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+
+	// Mount the admin API outside the rate limiter, so operators are never locked out
+	if cfg.Admin.Token != "" {
+		r.Mount("/admin", admin.NewRouter(store, cfg.Admin.Token))
+	} else {
+		log.Printf("Admin API disabled, set ADMIN_TOKEN to enable it")
+	}
+
+	// Trace the requests, continuing the traces of the services calling the rate limiter
+	handler := otelhttp.NewHandler(r, "rate-limiter", otelhttp.WithFilter(func(r *http.Request) bool {
+		return r.URL.Path != "/metrics"
+	}))
+
 	// Start server
-	serverAddr := fmt.Sprintf(":%s", cfg.ServerPort)
-	log.Printf("Server starting on %s", serverAddr)
-	if err := http.ListenAndServe(serverAddr, r); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", cfg.ServerPort),
+		Handler: handler,
+	}
+	go func() {
+		log.Printf("Server starting on %s", srv.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	<-ctx.Done()
+
+	// Finish the requests in flight before the storage and the exporters are closed
+	log.Println("Shutting down server...")
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer shutdownCancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server: %v", err)
+	}
+	if grpcServer != nil {
+		grpcServer.GracefulStop()
+	}
+}
+
+// limiterConfig returns the policies, the access lists and the failure mode of the configuration
+func limiterConfig(cfg *config.Config) limiter.Config {
+	return limiter.Config{
+		IP:          cfg.IP,
+		Token:       cfg.Token,
+		Route:       cfg.Route,
+		RouteCost:   cfg.RouteCost,
+		Plan:        cfg.Plan,
+		FailureMode: cfg.Failure.Mode,
+		Location:    cfg.Quota.Location(),
+		Access:      cfg.Access,
 	}
 }
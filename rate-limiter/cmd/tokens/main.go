@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+	"github.com/spf13/cobra"
+)
+
+var (
+	file    string
+	owner   string
+	plan    string
+	expires time.Duration
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "tokens",
+	Short: "Manages the API keys of the rate limiter token registry",
+	Long: `Manages the API keys of the rate limiter token registry.
+
+The registry file is read from TOKEN_STORE.FILE in the .env file, or
+TOKEN_STORE_FILE in the environment, unless --file is given. The server
+notices the changes without being restarted.`,
+	SilenceUsage: true,
+}
+
+var createCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Creates an API key",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if owner == "" || plan == "" {
+			return errors.New("--owner and --plan are required")
+		}
+		// Viper lowercases the plan names of the configuration
+		plan = strings.ToLower(plan)
+		// The plan is validated only when the configuration is available
+		if cfg, err := config.Load(".", "env"); err == nil {
+			if _, found := cfg.Plan[plan]; !found {
+				return fmt.Errorf("plan %q is not configured, add PLAN.%s.* to the configuration", plan, strings.ToUpper(plan))
+			}
+		}
+
+		var expiresAt time.Time
+		if expires > 0 {
+			expiresAt = time.Now().Add(expires).UTC().Truncate(time.Second)
+		}
+
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		token, key, err := store.Create(owner, plan, expiresAt)
+		if err != nil {
+			return err
+		}
+
+		printKey(token, key)
+		return nil
+	},
+}
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate <id>",
+	Short: "Replaces the API key of a token, keeping its counters",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		token, key, err := store.Rotate(args[0])
+		if err != nil {
+			return err
+		}
+
+		printKey(token, key)
+		return nil
+	},
+}
+
+var revokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revokes the API key of a token",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		token, err := store.Revoke(args[0])
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Token %s of %s revoked\n", token.ID, token.Owner)
+		return nil
+	},
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the tokens",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := openStore()
+		if err != nil {
+			return err
+		}
+		list, err := store.List()
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tOWNER\tPLAN\tSTATUS\tCREATED\tEXPIRES")
+		now := time.Now()
+		for _, token := range list {
+			status := "active"
+			if err := token.Check(now); errors.Is(err, tokens.ErrRevoked) {
+				status = "revoked"
+			} else if errors.Is(err, tokens.ErrExpired) {
+				status = "expired"
+			}
+			expiresAt := "never"
+			if !token.ExpiresAt.IsZero() {
+				expiresAt = token.ExpiresAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", token.ID, token.Owner, token.Plan, status, token.CreatedAt.Format(time.RFC3339), expiresAt)
+		}
+		return w.Flush()
+	},
+}
+
+// openStore opens the registry file of the --file flag or of the configuration
+func openStore() (*tokens.FileStore, error) {
+	if file == "" {
+		cfg, err := config.Load(".", "env")
+		if err != nil {
+			return nil, fmt.Errorf("loading configuration: %w", err)
+		}
+		file = cfg.TokenStore.File
+	}
+	if file == "" {
+		return nil, errors.New("no token registry configured, set TOKEN_STORE_FILE or use --file")
+	}
+	return tokens.NewFileStore(file)
+}
+
+// printKey shows an API key, which is not stored and can't be shown again
+func printKey(token tokens.Token, key string) {
+	fmt.Printf("Token %s of %s on plan %s\n", token.ID, token.Owner, token.Plan)
+	fmt.Printf("API key: %s\n", key)
+	fmt.Println("Store the API key now, it can't be shown again")
+}
+
+func main() {
+	rootCmd.PersistentFlags().StringVar(&file, "file", "", "token registry file (defaults to TOKEN_STORE_FILE)")
+	createCmd.Flags().StringVar(&owner, "owner", "", "who the API key is issued to")
+	createCmd.Flags().StringVar(&plan, "plan", "", "rate limit plan of the API key")
+	createCmd.Flags().DurationVar(&expires, "expires", 0, "how long the API key is valid (e.g. 720h), it never expires when not set")
+
+	rootCmd.AddCommand(createCmd, rotateCmd, revokeCmd, listCmd)
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(1)
+	}
+}
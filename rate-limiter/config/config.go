@@ -1,29 +1,464 @@
 package config
 
 import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
+// Rate limiting algorithms supported by LimiterConfig.Algorithm
+const (
+	// AlgorithmFixedWindow counts requests in fixed windows that start on the first hit
+	AlgorithmFixedWindow = "fixed_window"
+	// AlgorithmSlidingWindowLog keeps the timestamp of every request inside the window
+	AlgorithmSlidingWindowLog = "sliding_window_log"
+	// AlgorithmSlidingWindowCounter weights the previous window count by its overlap with the sliding window
+	AlgorithmSlidingWindowCounter = "sliding_window_counter"
+	// AlgorithmTokenBucket refills a bucket of Burst tokens at RefillRate tokens per second, each request takes one token
+	AlgorithmTokenBucket = "token_bucket"
+	// AlgorithmLeakyBucket fills a bucket holding up to Burst requests that leaks at RefillRate requests per second
+	AlgorithmLeakyBucket = "leaky_bucket"
+)
+
+// DefaultViolationDecay is the quiet period after which the offenses of a key are forgotten
+// when LimiterConfig.ViolationDecay is not set
+const DefaultViolationDecay = 24 * time.Hour
+
+// DefaultConcurrencyLease is how long an in-flight request holds its concurrency slot
+// without renewing it when LimiterConfig.ConcurrencyLease is not set
+const DefaultConcurrencyLease = 30 * time.Second
+
+// Calendar periods supported by the keys of LimiterConfig.Quotas
+const (
+	QuotaPeriodMinute = "minute"
+	QuotaPeriodHour   = "hour"
+	QuotaPeriodDay    = "day"
+	// QuotaPeriodWeek starts on Monday
+	QuotaPeriodWeek  = "week"
+	QuotaPeriodMonth = "month"
+)
+
+// QuotaPeriods lists the calendar periods of the quotas, from the shortest to the longest
+var QuotaPeriods = []string{QuotaPeriodMinute, QuotaPeriodHour, QuotaPeriodDay, QuotaPeriodWeek, QuotaPeriodMonth}
+
+// Access lists kept by the storage
+const (
+	// AccessListAllow holds the IPs, CIDR ranges and tokens exempted from the rate limits
+	AccessListAllow = "allow"
+	// AccessListDeny holds the IPs, CIDR ranges and tokens whose requests are always rejected
+	AccessListDeny = "deny"
+)
+
+// Redis deployments supported by StorageConfig.Mode
+const (
+	// RedisModeSingle connects to a single Redis server given by StorageConfig.URL
+	RedisModeSingle = "single"
+	// RedisModeSentinel connects to the master monitored by the sentinels in StorageConfig.Addrs
+	RedisModeSentinel = "sentinel"
+	// RedisModeCluster connects to the Redis Cluster with the seed nodes in StorageConfig.Addrs
+	RedisModeCluster = "cluster"
+)
+
 type StorageConfig struct {
-	URL  string `mapstructure:"url"`
-	Size int    `mapstructure:"size"`
+	URL             string        `mapstructure:"url"`
+	Size            int           `mapstructure:"size"`
+	CleanupInterval time.Duration `mapstructure:"cleanup_interval"`
+	Shards          int           `mapstructure:"shards"`
+
+	// Mode is the Redis deployment, single (default), sentinel or cluster
+	Mode string `mapstructure:"mode"`
+	// Addrs are the sentinels or the cluster seed nodes, as host:port
+	Addrs []string `mapstructure:"addrs"`
+	// MasterName is the name of the master monitored by the sentinels
+	MasterName string `mapstructure:"master_name"`
+	// Username and Password authenticate on the sentinel master or the cluster nodes,
+	// in single mode they are given in URL
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// SentinelPassword authenticates on the sentinels
+	SentinelPassword string `mapstructure:"sentinel_password"`
+	// DB is the database of the sentinel master, clusters only have database 0
+	DB int `mapstructure:"db"`
+
+	// FlushInterval is how often the cached Redis storage sends its local counts to Redis
+	// and refreshes the counts and blocks from the other instances
+	FlushInterval time.Duration `mapstructure:"flush_interval"`
+
+	// Connection pool settings, zero keeps the go-redis defaults
+	PoolSize        int           `mapstructure:"pool_size"`
+	MinIdleConns    int           `mapstructure:"min_idle_conns"`
+	MaxIdleConns    int           `mapstructure:"max_idle_conns"`
+	ConnMaxIdleTime time.Duration `mapstructure:"conn_max_idle_time"`
+	PoolTimeout     time.Duration `mapstructure:"pool_timeout"`
+	DialTimeout     time.Duration `mapstructure:"dial_timeout"`
+	ReadTimeout     time.Duration `mapstructure:"read_timeout"`
+	WriteTimeout    time.Duration `mapstructure:"write_timeout"`
 }
 
 type LimiterConfig struct {
 	RateLimit     int           `mapstructure:"rate_limit"`
 	RateWindow    time.Duration `mapstructure:"rate_window"`
 	BlockDuration time.Duration `mapstructure:"block_duration"`
+	Algorithm     string        `mapstructure:"algorithm"`
+	RefillRate    float64       `mapstructure:"refill_rate"`
+	Burst         int           `mapstructure:"burst"`
+
+	// Quotas maps calendar periods to how many requests are allowed in each of them,
+	// stacked on the rate limit so a request must pass all of them
+	Quotas map[string]int `mapstructure:"quota"`
+
+	// BlockMultiplier multiplies the block duration on every repeat offense of a key, up
+	// to MaxBlockDuration. With 0 or 1 every block lasts BlockDuration.
+	BlockMultiplier float64 `mapstructure:"block_multiplier"`
+	// MaxBlockDuration caps the progressive block durations, required with BlockMultiplier
+	MaxBlockDuration time.Duration `mapstructure:"max_block_duration"`
+	// ViolationDecay is the quiet period after a block ends after which the offenses of
+	// the key are forgotten, DefaultViolationDecay when zero
+	ViolationDecay time.Duration `mapstructure:"violation_decay"`
+
+	// DryRun evaluates the policy and records its decisions, but never rejects a request
+	DryRun bool `mapstructure:"dry_run"`
+	// Shadow is a policy evaluated and recorded side by side with this one, without ever
+	// rejecting a request, to compare a new limit with the enforced one
+	Shadow *LimiterConfig `mapstructure:"shadow"`
+
+	// MaxConcurrent is how many requests of a key may be in flight at once, unlimited when zero
+	MaxConcurrent int `mapstructure:"max_concurrent"`
+	// ConcurrencyLease is how long an in-flight request holds its slot unless renewed, so the
+	// slots of a crashed instance are freed, DefaultConcurrencyLease when zero
+	ConcurrencyLease time.Duration `mapstructure:"concurrency_lease"`
+	// QueueTimeout is how long a request waits for a free slot before being rejected, zero
+	// rejecting it right away
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+}
+
+// Bucket returns the refill rate in requests per second and the burst size of the bucket
+// algorithms, falling back to RateLimit requests per RateWindow when they are not set
+func (c LimiterConfig) Bucket() (float64, int) {
+	rate, burst := c.RefillRate, c.Burst
+	if rate == 0 && c.RateWindow > 0 {
+		rate = float64(c.RateLimit) / c.RateWindow.Seconds()
+	}
+	if burst == 0 {
+		burst = c.RateLimit
+	}
+	return rate, burst
+}
+
+// Progressive reports whether the block duration grows on every repeat offense
+func (c LimiterConfig) Progressive() bool {
+	return c.BlockMultiplier > 1 && c.BlockDuration > 0
+}
+
+// BlockFor returns how long a key is blocked for its nth offense, the first one being
+// blocked for BlockDuration
+func (c LimiterConfig) BlockFor(violations int) time.Duration {
+	if !c.Progressive() || violations <= 1 {
+		return c.BlockDuration
+	}
+	d := float64(c.BlockDuration) * math.Pow(c.BlockMultiplier, float64(violations-1))
+	if d >= float64(c.MaxBlockDuration) {
+		return c.MaxBlockDuration
+	}
+	return time.Duration(d)
+}
+
+// Decay returns the quiet period after which the offenses of a key are forgotten
+func (c LimiterConfig) Decay() time.Duration {
+	if c.ViolationDecay > 0 {
+		return c.ViolationDecay
+	}
+	return DefaultViolationDecay
+}
+
+// Lease returns how long an in-flight request holds its concurrency slot unless renewed
+func (c LimiterConfig) Lease() time.Duration {
+	if c.ConcurrencyLease > 0 {
+		return c.ConcurrencyLease
+	}
+	return DefaultConcurrencyLease
+}
+
+// Quota returns how many requests are allowed in which period, for the bucket
+// algorithms the period is how long an empty bucket takes to refill
+func (c LimiterConfig) Quota() (int, time.Duration) {
+	switch c.Algorithm {
+	case AlgorithmTokenBucket, AlgorithmLeakyBucket:
+		rate, burst := c.Bucket()
+		return burst, time.Duration(float64(burst) / rate * float64(time.Second))
+	default:
+		return c.RateLimit, c.RateWindow
+	}
+}
+
+// Validate checks that the limiter configuration can be applied
+func (c LimiterConfig) Validate() error {
+	if c.BlockMultiplier < 0 || c.MaxBlockDuration < 0 || c.ViolationDecay < 0 {
+		return errors.New("block multiplier, max block duration and violation decay can't be negative")
+	}
+	if c.BlockMultiplier > 1 && c.MaxBlockDuration < c.BlockDuration {
+		return errors.New("progressive blocks require a max block duration of at least the block duration")
+	}
+	if c.MaxConcurrent < 0 || c.ConcurrencyLease < 0 || c.QueueTimeout < 0 {
+		return errors.New("max concurrent, concurrency lease and queue timeout can't be negative")
+	}
+	if c.Shadow != nil {
+		if c.DryRun {
+			return errors.New("a dry run policy can't have a shadow policy")
+		}
+		if c.Shadow.DryRun || c.Shadow.Shadow != nil {
+			return errors.New("a shadow policy can't be a dry run or have a shadow policy")
+		}
+		if err := c.Shadow.Validate(); err != nil {
+			return fmt.Errorf("shadow: %w", err)
+		}
+	}
+
+	for period, limit := range c.Quotas {
+		if !slices.Contains(QuotaPeriods, period) {
+			return fmt.Errorf("unknown quota period %q", period)
+		}
+		if limit <= 0 {
+			return fmt.Errorf("%s quota must be positive", period)
+		}
+	}
+
+	switch c.Algorithm {
+	case "", AlgorithmFixedWindow, AlgorithmSlidingWindowLog, AlgorithmSlidingWindowCounter:
+		if c.RateLimit <= 0 || c.RateWindow <= 0 {
+			return errors.New("rate limit and rate window must be positive")
+		}
+		return nil
+	case AlgorithmTokenBucket, AlgorithmLeakyBucket:
+		if rate, burst := c.Bucket(); rate <= 0 || burst <= 0 {
+			return fmt.Errorf("%s requires a positive refill rate and burst", c.Algorithm)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown rate limit algorithm %q", c.Algorithm)
+	}
+}
+
+// RouteConfig is a rate limit policy for the requests to a route, limiting them
+// independently of the other routes
+type RouteConfig struct {
+	// Method restricts the policy to an HTTP method (e.g. POST), empty for every method
+	Method string `mapstructure:"method"`
+	// Pattern is the chi route pattern of the route (e.g. /login or /users/{id})
+	Pattern string `mapstructure:"pattern"`
+
+	LimiterConfig `mapstructure:",squash"`
+}
+
+// Validate checks that the route policy can be applied
+func (c RouteConfig) Validate() error {
+	if !strings.HasPrefix(c.Pattern, "/") {
+		return fmt.Errorf("pattern %q must start with /", c.Pattern)
+	}
+	return c.LimiterConfig.Validate()
+}
+
+// RouteCostConfig weighs the requests to a route, which count as Cost requests in the
+// limits and quotas of the policy applied to them
+type RouteCostConfig struct {
+	// Method restricts the cost to an HTTP method (e.g. POST), empty for every method
+	Method string `mapstructure:"method"`
+	// Pattern is the chi route pattern of the route (e.g. /export or /users/{id})
+	Pattern string `mapstructure:"pattern"`
+	// Cost is how many requests a request to the route counts as
+	Cost int `mapstructure:"cost"`
+}
+
+// Validate checks that the route cost can be applied
+func (c RouteCostConfig) Validate() error {
+	if !strings.HasPrefix(c.Pattern, "/") {
+		return fmt.Errorf("pattern %q must start with /", c.Pattern)
+	}
+	if c.Cost < 1 {
+		return errors.New("cost must be at least 1")
+	}
+	return nil
+}
+
+// DefaultForwardedHeader is the header read for the forwarding chain when none is configured
+const DefaultForwardedHeader = "X-Forwarded-For"
+
+// ClientIPConfig describes how the client IP is extracted from requests
+type ClientIPConfig struct {
+	// TrustedProxies lists the IPs and CIDR ranges of the proxies whose forwarding headers are trusted
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	// ForwardedHeader is the header the trusted proxies set with the forwarding chain,
+	// Forwarded, X-Forwarded-For or X-Real-IP, DefaultForwardedHeader when empty
+	ForwardedHeader string `mapstructure:"forwarded_header"`
+	// IPv6Prefix aggregates IPv6 clients by this prefix length (e.g. 64), zero keeps the full address
+	IPv6Prefix int `mapstructure:"ipv6_prefix"`
+}
+
+// TokenStoreConfig configures the registry of API keys
+type TokenStoreConfig struct {
+	// File is the JSON file holding the hashed API keys, the registry is disabled when it is empty
+	File string `mapstructure:"file"`
+}
+
+// AccessConfig lists the IPs, CIDR ranges and tokens exempted from the rate limits or
+// always rejected, besides the ones in the access lists of the storage
+type AccessConfig struct {
+	// AllowIPs and DenyIPs list IPs and CIDR ranges (e.g. 10.0.0.0/8)
+	AllowIPs []string `mapstructure:"allow_ips"`
+	DenyIPs  []string `mapstructure:"deny_ips"`
+	// AllowTokens and DenyTokens list tokens, by their identifier when the token registry is used
+	AllowTokens []string `mapstructure:"allow_tokens"`
+	DenyTokens  []string `mapstructure:"deny_tokens"`
+	// RefreshInterval is how often the access lists of the storage are read again
+	RefreshInterval time.Duration `mapstructure:"refresh_interval"`
 }
 
+// Validate checks that the IPs and CIDR ranges can be parsed
+func (c AccessConfig) Validate() error {
+	for _, entry := range slices.Concat(c.AllowIPs, c.DenyIPs) {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		if _, err := ParsePrefix(entry); err != nil {
+			return err
+		}
+	}
+	if c.RefreshInterval < 0 {
+		return errors.New("refresh interval can't be negative")
+	}
+	return nil
+}
+
+// ParsePrefix parses an IP or a CIDR range, a single IP is a prefix covering only itself
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP %q: %w", s, err)
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid CIDR range %q: %w", s, err)
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+// Failure modes supported by FailureConfig.Mode
+const (
+	// FailureModeClosed rejects the requests with 503 while the storage is unavailable
+	FailureModeClosed = "closed"
+	// FailureModeOpen allows the requests without limiting them while the storage is unavailable
+	FailureModeOpen = "open"
+)
+
+// FailureConfig configures how the rate limiter behaves when the storage fails
+type FailureConfig struct {
+	// Mode is what happens to the requests the storage can't check, closed (default) or open
+	Mode string `mapstructure:"mode"`
+	// Threshold is how many consecutive storage failures open the circuit breaker
+	Threshold int `mapstructure:"threshold"`
+	// Timeout is how long the circuit breaker stays open before the storage is tried again
+	Timeout time.Duration `mapstructure:"timeout"`
+	// Fallback limits the requests with a local in-memory storage while the storage is unavailable
+	Fallback bool `mapstructure:"fallback"`
+}
+
+// Validate checks that the failure configuration can be applied
+func (c FailureConfig) Validate() error {
+	switch c.Mode {
+	case "", FailureModeClosed, FailureModeOpen:
+	default:
+		return fmt.Errorf("unknown failure mode %q", c.Mode)
+	}
+	if c.Threshold < 0 || c.Timeout < 0 {
+		return errors.New("failure threshold and timeout can't be negative")
+	}
+	return nil
+}
+
+// AdminConfig configures the admin API
+type AdminConfig struct {
+	// Token authenticates the admin requests, the admin API is disabled when it is empty
+	Token string `mapstructure:"token"`
+}
+
+// TelemetryConfig configures the OpenTelemetry traces and metrics exported over OTLP gRPC
+type TelemetryConfig struct {
+	// ServiceName identifies the rate limiter in the traces and metrics
+	ServiceName string `mapstructure:"service_name"`
+	// CollectorEndpoint is the OTLP gRPC endpoint of the collector (e.g. otel-collector:4317),
+	// the export is disabled when it is empty
+	CollectorEndpoint string `mapstructure:"collector_endpoint"`
+}
+
+// RLSConfig configures the gRPC service implementing Envoy's rate limit service protocol
+type RLSConfig struct {
+	// Port is the port of the gRPC service, the service is disabled when it is empty
+	Port string `mapstructure:"port"`
+	// TokenKey, PathKey and MethodKey are the keys of the descriptor entries carrying the API key,
+	// the request path and the HTTP method, as set by the request_headers actions of Envoy
+	TokenKey  string `mapstructure:"token_key"`
+	PathKey   string `mapstructure:"path_key"`
+	MethodKey string `mapstructure:"method_key"`
+}
+
+// QuotaConfig configures the calendar periods of the quotas
+type QuotaConfig struct {
+	// TimeZone is the IANA time zone the periods start in (e.g. America/Sao_Paulo), UTC when empty
+	TimeZone string `mapstructure:"time_zone"`
+}
+
+// Location returns the time zone of the periods, UTC when it is empty or unknown
+func (c QuotaConfig) Location() *time.Location {
+	location, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// Validate checks that the time zone is known
+func (c QuotaConfig) Validate() error {
+	_, err := time.LoadLocation(c.TimeZone)
+	return err
+}
+
+// reloadMu serializes the reads of the configuration file, which may be
+// triggered both by the file watcher and by SIGHUP
+var reloadMu sync.Mutex
+
 type Config struct {
-	IP          LimiterConfig            `mapstructure:"ip"`
-	Token       map[string]LimiterConfig `mapstructure:"token"`
-	StorageType string                   `mapstructure:"storage_type"`
-	Storage     map[string]StorageConfig `mapstructure:"storage"`
-	ServerPort  string                   `mapstructure:"server_port"`
+	IP          LimiterConfig              `mapstructure:"ip"`
+	Token       map[string]LimiterConfig   `mapstructure:"token"`
+	Route       map[string]RouteConfig     `mapstructure:"route"`
+	RouteCost   map[string]RouteCostConfig `mapstructure:"route_cost"`
+	Plan        map[string]LimiterConfig   `mapstructure:"plan"`
+	TokenStore  TokenStoreConfig           `mapstructure:"token_store"`
+	Failure     FailureConfig              `mapstructure:"failure"`
+	ClientIP    ClientIPConfig             `mapstructure:"client_ip"`
+	StorageType string                     `mapstructure:"storage_type"`
+	Storage     map[string]StorageConfig   `mapstructure:"storage"`
+	ServerPort  string                     `mapstructure:"server_port"`
+	Admin       AdminConfig                `mapstructure:"admin"`
+	Telemetry   TelemetryConfig            `mapstructure:"otel"`
+	RLS         RLSConfig                  `mapstructure:"rls"`
+	Quota       QuotaConfig                `mapstructure:"quota"`
+	Access      AccessConfig               `mapstructure:"access"`
 }
 
 func Load(path, configType string) (*Config, error) {
@@ -31,18 +466,158 @@ func Load(path, configType string) (*Config, error) {
 	viper.SetConfigType(configType)
 	viper.SetConfigFile(".env")
 
-	if err := viper.ReadInConfig(); err != nil {
-		return nil, err
-	}
-
 	// Enable environment variable support
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	// Viper only reads environment variables of known keys, so these settings
+	// can be given as ADMIN_TOKEN, TOKEN_STORE_FILE, FAILURE_MODE, OTEL_COLLECTOR_ENDPOINT,
+	// RLS_PORT, QUOTA_TIME_ZONE, ACCESS_DENY_IPS or CLIENT_IP_FORWARDED_HEADER without being in the .env file
+	viper.SetDefault("admin.token", "")
+	viper.SetDefault("token_store.file", "")
+	viper.SetDefault("failure.mode", "")
+	viper.SetDefault("failure.threshold", 0)
+	viper.SetDefault("failure.timeout", 0)
+	viper.SetDefault("failure.fallback", false)
+	viper.SetDefault("otel.service_name", "rate-limiter")
+	viper.SetDefault("otel.collector_endpoint", "")
+	viper.SetDefault("rls.port", "")
+	viper.SetDefault("rls.token_key", "api_key")
+	viper.SetDefault("rls.path_key", "path")
+	viper.SetDefault("rls.method_key", "method")
+	viper.SetDefault("quota.time_zone", "")
+	viper.SetDefault("access.allow_ips", []string{})
+	viper.SetDefault("access.deny_ips", []string{})
+	viper.SetDefault("access.allow_tokens", []string{})
+	viper.SetDefault("access.deny_tokens", []string{})
+	viper.SetDefault("access.refresh_interval", 0)
+	viper.SetDefault("client_ip.forwarded_header", DefaultForwardedHeader)
+
+	return Reload()
+}
+
+// Reload reads the configuration file again and validates it, the configuration
+// returned by the previous Load or Reload remains valid when it fails
+func Reload() (*Config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	if err := viper.ReadInConfig(); err != nil {
+		return nil, err
+	}
 
 	var cfg Config
 	if err := viper.Unmarshal(&cfg); err != nil {
 		return nil, err
 	}
 
+	if err := ValidatePolicies(cfg.IP, cfg.Token, cfg.Plan, cfg.Route, cfg.RouteCost); err != nil {
+		return nil, err
+	}
+	if err := cfg.Failure.Validate(); err != nil {
+		return nil, fmt.Errorf("failure: %w", err)
+	}
+	if err := cfg.Quota.Validate(); err != nil {
+		return nil, fmt.Errorf("quota: %w", err)
+	}
+	if err := cfg.Access.Validate(); err != nil {
+		return nil, fmt.Errorf("access: %w", err)
+	}
+
 	return &cfg, nil
 }
+
+// ValidatePolicies checks that the policies of the IPs, tokens, plans and routes and the
+// route costs can be applied, that no two route policies match the same method and
+// pattern, which would leave one of them unused, and that no route cost exceeds the limit
+// of a policy it applies to, which would reject every request to the route
+func ValidatePolicies(ip LimiterConfig, token, plan map[string]LimiterConfig, route map[string]RouteConfig, routeCost map[string]RouteCostConfig) error {
+	if err := ip.Validate(); err != nil {
+		return fmt.Errorf("ip: %w", err)
+	}
+	for name, tokenCfg := range token {
+		if err := tokenCfg.Validate(); err != nil {
+			return fmt.Errorf("token %s: %w", name, err)
+		}
+	}
+	for name, planCfg := range plan {
+		if err := planCfg.Validate(); err != nil {
+			return fmt.Errorf("plan %s: %w", name, err)
+		}
+	}
+	routes := make(map[string]string, len(route))
+	for name, routeCfg := range route {
+		if err := routeCfg.Validate(); err != nil {
+			return fmt.Errorf("route %s: %w", name, err)
+		}
+		match := strings.ToUpper(routeCfg.Method) + " " + routeCfg.Pattern
+		if other, found := routes[match]; found {
+			return fmt.Errorf("routes %s and %s both match %s", other, name, strings.TrimSpace(match))
+		}
+		routes[match] = name
+	}
+	for name, costCfg := range routeCost {
+		if err := costCfg.Validate(); err != nil {
+			return fmt.Errorf("route cost %s: %w", name, err)
+		}
+		if err := validateCostLimits(costCfg, ip, token, plan, route); err != nil {
+			return fmt.Errorf("route cost %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// validateCostLimits checks that a route cost fits the limit, or the burst of the bucket
+// algorithms, the quotas and the shadow policy of the route policies matching its route
+// and, unless they limit every request to it, of the IP, token and plan policies
+func validateCostLimits(costCfg RouteCostConfig, ip LimiterConfig, token, plan map[string]LimiterConfig, route map[string]RouteConfig) error {
+	// fits reports an error when a request of the cost can never be allowed by the policy
+	var fits func(policy string, limiterConfig LimiterConfig) error
+	fits = func(policy string, limiterConfig LimiterConfig) error {
+		if limit, _ := limiterConfig.Quota(); limit > 0 && costCfg.Cost > limit {
+			return fmt.Errorf("cost %d exceeds the limit %d of %s", costCfg.Cost, limit, policy)
+		}
+		for _, period := range QuotaPeriods {
+			if limit, found := limiterConfig.Quotas[period]; found && costCfg.Cost > limit {
+				return fmt.Errorf("cost %d exceeds the %s quota %d of %s", costCfg.Cost, period, limit, policy)
+			}
+		}
+		if limiterConfig.Shadow != nil {
+			return fits("the shadow policy of "+policy, *limiterConfig.Shadow)
+		}
+		return nil
+	}
+
+	covered := false
+	for name, routeCfg := range route {
+		if routeCfg.Pattern != costCfg.Pattern {
+			continue
+		}
+		if routeCfg.Method != "" && costCfg.Method != "" && !strings.EqualFold(routeCfg.Method, costCfg.Method) {
+			continue
+		}
+		if err := fits("route "+name, routeCfg.LimiterConfig); err != nil {
+			return err
+		}
+		if routeCfg.Method == "" || strings.EqualFold(routeCfg.Method, costCfg.Method) {
+			covered = true
+		}
+	}
+	if covered {
+		return nil
+	}
+
+	if err := fits("ip", ip); err != nil {
+		return err
+	}
+	for name, tokenCfg := range token {
+		if err := fits("token "+name, tokenCfg); err != nil {
+			return err
+		}
+	}
+	for name, planCfg := range plan {
+		if err := fits("plan "+name, planCfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
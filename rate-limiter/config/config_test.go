@@ -0,0 +1,388 @@
+package config_test
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+)
+
+func TestLoadRoutes(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Run("Route policies", func(t *testing.T) {
+		env := "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\n" +
+			"ROUTE.LOGIN.METHOD=POST\nROUTE.LOGIN.PATTERN=/login\nROUTE.LOGIN.RATE_LIMIT=5\nROUTE.LOGIN.RATE_WINDOW=1m\nROUTE.LOGIN.BLOCK_DURATION=10m\n"
+		if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+			t.Fatalf("Error writing .env: %v", err)
+		}
+
+		cfg, err := config.Load(".", "env")
+		if err != nil {
+			t.Fatalf("Error loading configuration: %v", err)
+		}
+		login := cfg.Route["login"]
+		if login.Method != "POST" || login.Pattern != "/login" || login.RateLimit != 5 || login.RateWindow != time.Minute || login.BlockDuration != 10*time.Minute {
+			t.Errorf("Unexpected login route policy %+v", login)
+		}
+	})
+
+	t.Run("Duplicated route policies", func(t *testing.T) {
+		env := "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\n" +
+			"ROUTE.A.METHOD=post\nROUTE.A.PATTERN=/login\nROUTE.A.RATE_LIMIT=5\nROUTE.A.RATE_WINDOW=1m\n" +
+			"ROUTE.B.METHOD=POST\nROUTE.B.PATTERN=/login\nROUTE.B.RATE_LIMIT=1\nROUTE.B.RATE_WINDOW=1m\n"
+		if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+			t.Fatalf("Error writing .env: %v", err)
+		}
+
+		if _, err := config.Load(".", "env"); err == nil {
+			t.Errorf("Expected error for two policies on POST /login")
+		}
+	})
+}
+
+func TestLoadQuotas(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Run("Quotas stacked on the rate limit", func(t *testing.T) {
+		env := "QUOTA.TIME_ZONE=America/Sao_Paulo\nIP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\n" +
+			"PLAN.PRO.RATE_LIMIT=100\nPLAN.PRO.RATE_WINDOW=1s\nPLAN.PRO.QUOTA.DAY=50000\nPLAN.PRO.QUOTA.MONTH=1000000\n"
+		if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+			t.Fatalf("Error writing .env: %v", err)
+		}
+
+		cfg, err := config.Load(".", "env")
+		if err != nil {
+			t.Fatalf("Error loading configuration: %v", err)
+		}
+		pro := cfg.Plan["pro"]
+		if pro.RateLimit != 100 || pro.Quotas["day"] != 50000 || pro.Quotas["month"] != 1000000 {
+			t.Errorf("Unexpected pro plan %+v", pro)
+		}
+		if location := cfg.Quota.Location(); location.String() != "America/Sao_Paulo" {
+			t.Errorf("Expected time zone America/Sao_Paulo, got %s", location)
+		}
+	})
+
+	tests := []struct {
+		name string
+		env  string
+	}{
+		{name: "Unknown period", env: "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nPLAN.PRO.RATE_LIMIT=100\nPLAN.PRO.RATE_WINDOW=1s\nPLAN.PRO.QUOTA.YEAR=1000\n"},
+		{name: "Non-positive quota", env: "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nTOKEN.ABC.RATE_LIMIT=100\nTOKEN.ABC.RATE_WINDOW=1s\nTOKEN.ABC.QUOTA.DAY=0\n"},
+		{name: "Unknown time zone", env: "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nQUOTA.TIME_ZONE=Mars/Olympus\n"},
+		{name: "Dry run policy with a shadow policy", env: "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nIP.DRY_RUN=true\nIP.SHADOW.RATE_LIMIT=5\nIP.SHADOW.RATE_WINDOW=1s\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(".env", []byte(tt.env), 0o644); err != nil {
+				t.Fatalf("Error writing .env: %v", err)
+			}
+			if _, err := config.Load(".", "env"); err == nil {
+				t.Errorf("Expected error loading %q", tt.env)
+			}
+		})
+	}
+}
+
+func TestLoadShadow(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	env := "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nIP.SHADOW.RATE_LIMIT=5\nIP.SHADOW.RATE_WINDOW=1s\n" +
+		"ROUTE.LOGIN.PATTERN=/login\nROUTE.LOGIN.RATE_LIMIT=5\nROUTE.LOGIN.RATE_WINDOW=1m\nROUTE.LOGIN.DRY_RUN=true\n"
+	if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+		t.Fatalf("Error writing .env: %v", err)
+	}
+
+	cfg, err := config.Load(".", "env")
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if cfg.IP.RateLimit != 10 || cfg.IP.Shadow == nil || cfg.IP.Shadow.RateLimit != 5 || cfg.IP.Shadow.RateWindow != time.Second {
+		t.Errorf("Expected a shadow policy of 5 requests per second, got %+v", cfg.IP.Shadow)
+	}
+	if login := cfg.Route["login"]; !login.DryRun || login.Shadow != nil {
+		t.Errorf("Expected the login policy in dry run, got %+v", login)
+	}
+}
+
+func TestLoadConcurrency(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	env := "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nIP.MAX_CONCURRENT=5\nIP.QUEUE_TIMEOUT=2s\n" +
+		"PLAN.PRO.RATE_LIMIT=100\nPLAN.PRO.RATE_WINDOW=1s\nPLAN.PRO.MAX_CONCURRENT=50\nPLAN.PRO.CONCURRENCY_LEASE=1m\n"
+	if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+		t.Fatalf("Error writing .env: %v", err)
+	}
+
+	cfg, err := config.Load(".", "env")
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if cfg.IP.MaxConcurrent != 5 || cfg.IP.QueueTimeout != 2*time.Second || cfg.IP.Lease() != config.DefaultConcurrencyLease {
+		t.Errorf("Expected 5 concurrent requests queued for 2s, got %+v", cfg.IP)
+	}
+	if pro := cfg.Plan["pro"]; pro.MaxConcurrent != 50 || pro.QueueTimeout != 0 || pro.Lease() != time.Minute {
+		t.Errorf("Expected 50 concurrent requests with a lease of 1m, got %+v", pro)
+	}
+}
+
+func TestLoadRouteCost(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	env := "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\n" +
+		"ROUTE_COST.EXPORT.METHOD=POST\nROUTE_COST.EXPORT.PATTERN=/export\nROUTE_COST.EXPORT.COST=10\n"
+	if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+		t.Fatalf("Error writing .env: %v", err)
+	}
+
+	cfg, err := config.Load(".", "env")
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if export := cfg.RouteCost["export"]; export.Method != "POST" || export.Pattern != "/export" || export.Cost != 10 {
+		t.Errorf("Expected POST /export to cost 10, got %+v", export)
+	}
+
+	t.Run("Cost required", func(t *testing.T) {
+		if err := (config.RouteCostConfig{Pattern: "/export"}).Validate(); err == nil {
+			t.Errorf("Expected error for a route cost without a cost")
+		}
+	})
+
+	t.Run("Cost within the limits", func(t *testing.T) {
+		low := config.LimiterConfig{RateLimit: 10, RateWindow: time.Second}
+		high := config.LimiterConfig{RateLimit: 100, RateWindow: time.Second}
+		export := map[string]config.RouteCostConfig{"export": {Method: "POST", Pattern: "/export", Cost: 20}}
+		tests := []struct {
+			name  string
+			ip    config.LimiterConfig
+			token map[string]config.LimiterConfig
+			route map[string]config.RouteConfig
+			valid bool
+		}{
+			{name: "Within the IP limit", ip: high, valid: true},
+			{name: "Above the IP limit", ip: low},
+			{
+				name: "Above the burst of a token",
+				ip:   high,
+				token: map[string]config.LimiterConfig{
+					"abc": {RateLimit: 100, RateWindow: time.Second, Algorithm: config.AlgorithmTokenBucket, Burst: 5},
+				},
+			},
+			{
+				name: "Within the route policy of the route",
+				ip:   low,
+				route: map[string]config.RouteConfig{
+					"export": {Pattern: "/export", LimiterConfig: config.LimiterConfig{RateLimit: 20, RateWindow: time.Minute}},
+				},
+				valid: true,
+			},
+			{
+				name: "Above a quota of the IP",
+				ip:   config.LimiterConfig{RateLimit: 100, RateWindow: time.Second, Quotas: map[string]int{"day": 10}},
+			},
+			{
+				name: "Above the shadow policy of the IP",
+				ip:   config.LimiterConfig{RateLimit: 100, RateWindow: time.Second, Shadow: &low},
+			},
+			{
+				name: "Above a quota of the route policy of the route",
+				ip:   high,
+				route: map[string]config.RouteConfig{
+					"export": {Pattern: "/export", LimiterConfig: config.LimiterConfig{RateLimit: 20, RateWindow: time.Minute, Quotas: map[string]int{"month": 10}}},
+				},
+			},
+			{
+				name: "Above the shadow policy of the route policy of the route",
+				ip:   high,
+				route: map[string]config.RouteConfig{
+					"export": {Pattern: "/export", LimiterConfig: config.LimiterConfig{RateLimit: 20, RateWindow: time.Minute, Shadow: &low}},
+				},
+			},
+			{
+				name: "Route policy of another method",
+				ip:   low,
+				route: map[string]config.RouteConfig{
+					"export": {Method: "GET", Pattern: "/export", LimiterConfig: config.LimiterConfig{RateLimit: 20, RateWindow: time.Minute}},
+				},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				err := config.ValidatePolicies(tt.ip, tt.token, nil, tt.route, export)
+				if tt.valid && err != nil {
+					t.Errorf("Expected the cost to fit, got %v", err)
+				}
+				if !tt.valid && err == nil {
+					t.Errorf("Expected error for a cost above the limit")
+				}
+			})
+		}
+	})
+}
+
+func TestLimiterConfigBlockFor(t *testing.T) {
+	progressive := config.LimiterConfig{BlockDuration: time.Minute, BlockMultiplier: 2, MaxBlockDuration: time.Hour}
+
+	tests := []struct {
+		name          string
+		limiterConfig config.LimiterConfig
+		violations    int
+		expected      time.Duration
+	}{
+		{name: "First offense", limiterConfig: progressive, violations: 1, expected: time.Minute},
+		{name: "Repeat offense", limiterConfig: progressive, violations: 3, expected: 4 * time.Minute},
+		{name: "Capped", limiterConfig: progressive, violations: 100, expected: time.Hour},
+		{name: "Fixed blocks", limiterConfig: config.LimiterConfig{BlockDuration: time.Minute}, violations: 5, expected: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d := tt.limiterConfig.BlockFor(tt.violations); d != tt.expected {
+				t.Errorf("Expected %v, got %v", tt.expected, d)
+			}
+		})
+	}
+
+	t.Run("Max block duration required", func(t *testing.T) {
+		if err := (config.LimiterConfig{RateLimit: 10, RateWindow: time.Second, BlockDuration: time.Minute, BlockMultiplier: 2}).Validate(); err == nil {
+			t.Errorf("Expected error for progressive blocks without a max block duration")
+		}
+	})
+}
+
+func TestLimiterConfigValidateLimit(t *testing.T) {
+	algorithms := []string{"", config.AlgorithmFixedWindow, config.AlgorithmSlidingWindowLog, config.AlgorithmSlidingWindowCounter}
+	tests := []struct {
+		name          string
+		limiterConfig config.LimiterConfig
+	}{
+		{name: "Without a rate limit", limiterConfig: config.LimiterConfig{RateWindow: time.Second}},
+		{name: "Without a rate window", limiterConfig: config.LimiterConfig{RateLimit: 10}},
+		{name: "Negative rate limit", limiterConfig: config.LimiterConfig{RateLimit: -1, RateWindow: time.Second}},
+	}
+	for _, algorithm := range algorithms {
+		for _, tt := range tests {
+			t.Run(algorithm+"/"+tt.name, func(t *testing.T) {
+				tt.limiterConfig.Algorithm = algorithm
+				if err := tt.limiterConfig.Validate(); err == nil {
+					t.Errorf("Expected error for %+v", tt.limiterConfig)
+				}
+			})
+		}
+	}
+}
+
+func TestLoadAccess(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	t.Run("Access lists", func(t *testing.T) {
+		env := "IP.RATE_LIMIT=10\nIP.RATE_WINDOW=1s\nACCESS.ALLOW_IPS=192.168.0.0/16,10.0.0.1\nACCESS.DENY_TOKENS=abc\nACCESS.REFRESH_INTERVAL=30s\n"
+		if err := os.WriteFile(".env", []byte(env), 0o644); err != nil {
+			t.Fatalf("Error writing .env: %v", err)
+		}
+
+		cfg, err := config.Load(".", "env")
+		if err != nil {
+			t.Fatalf("Error loading configuration: %v", err)
+		}
+		if len(cfg.Access.AllowIPs) != 2 || cfg.Access.AllowIPs[1] != "10.0.0.1" || len(cfg.Access.DenyTokens) != 1 {
+			t.Errorf("Unexpected access lists %+v", cfg.Access)
+		}
+		if cfg.Access.RefreshInterval != 30*time.Second {
+			t.Errorf("Expected a refresh interval of 30s, got %v", cfg.Access.RefreshInterval)
+		}
+	})
+
+	t.Run("Invalid CIDR range", func(t *testing.T) {
+		if err := os.WriteFile(".env", []byte("ACCESS.DENY_IPS=10.0.0.0/33\n"), 0o644); err != nil {
+			t.Fatalf("Error writing .env: %v", err)
+		}
+		if _, err := config.Load(".", "env"); err == nil {
+			t.Errorf("Expected error for an invalid CIDR range")
+		}
+	})
+}
+
+func TestWatch(t *testing.T) {
+	t.Chdir(t.TempDir())
+
+	writeEnv := func(t *testing.T, content string) {
+		t.Helper()
+		if err := os.WriteFile(".env", []byte(content), 0o644); err != nil {
+			t.Fatalf("Error writing .env: %v", err)
+		}
+	}
+
+	writeEnv(t, "IP.RATE_LIMIT=1\nIP.RATE_WINDOW=1s\nTOKEN.ABC.RATE_LIMIT=5\nTOKEN.ABC.RATE_WINDOW=1s\n")
+	cfg, err := config.Load(".", "env")
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if cfg.Token["abc"].RateLimit != 5 {
+		t.Fatalf("Expected token abc rate limit 5, got %d", cfg.Token["abc"].RateLimit)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	applied := make(chan *config.Config, 10)
+	if err := config.Watch(ctx, func(cfg *config.Config) { applied <- cfg }); err != nil {
+		t.Fatalf("Error watching configuration: %v", err)
+	}
+
+	// waitApplied returns the next applied configuration, or nil when none is applied in time
+	waitApplied := func(timeout time.Duration) *config.Config {
+		select {
+		case cfg := <-applied:
+			return cfg
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+
+	t.Run("File change", func(t *testing.T) {
+		writeEnv(t, "IP.RATE_LIMIT=1\nIP.RATE_WINDOW=1s\nTOKEN.ABC.RATE_LIMIT=50\nTOKEN.ABC.RATE_WINDOW=1s\n")
+
+		cfg := waitApplied(5 * time.Second)
+		if cfg == nil {
+			t.Fatalf("Expected the changed configuration to be applied")
+		}
+		if cfg.Token["abc"].RateLimit != 50 {
+			t.Errorf("Expected token abc rate limit 50, got %d", cfg.Token["abc"].RateLimit)
+		}
+	})
+
+	t.Run("Invalid configuration is ignored", func(t *testing.T) {
+		// Drain the configurations applied by the writes of the previous subtest
+		for waitApplied(200*time.Millisecond) != nil {
+		}
+
+		writeEnv(t, "IP.RATE_LIMIT=1\nIP.RATE_WINDOW=1s\nIP.ALGORITHM=unknown\n")
+		if cfg := waitApplied(500 * time.Millisecond); cfg != nil {
+			t.Errorf("Expected the invalid configuration to be ignored, got %+v", cfg)
+		}
+	})
+
+	t.Run("SIGHUP", func(t *testing.T) {
+		// Restore a valid file, then drain its change events before signaling
+		writeEnv(t, "IP.RATE_LIMIT=7\nIP.RATE_WINDOW=1s\n")
+		for waitApplied(200*time.Millisecond) != nil {
+		}
+
+		if err := syscall.Kill(os.Getpid(), syscall.SIGHUP); err != nil {
+			t.Fatalf("Error sending SIGHUP: %v", err)
+		}
+
+		cfg := waitApplied(5 * time.Second)
+		if cfg == nil {
+			t.Fatalf("Expected the configuration to be reloaded on SIGHUP")
+		}
+		if cfg.IP.RateLimit != 7 {
+			t.Errorf("Expected IP rate limit 7, got %d", cfg.IP.RateLimit)
+		}
+	})
+}
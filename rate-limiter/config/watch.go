@@ -0,0 +1,89 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// reloadDelay is how long the configuration file must stay unchanged before it
+// is reloaded, so a file being written is not read half way through
+const reloadDelay = 100 * time.Millisecond
+
+// Watch reloads the configuration whenever the configuration file changes or the
+// process receives SIGHUP, until ctx is done. Every valid configuration is passed
+// to apply, while an invalid one is logged and ignored so the current one stays
+// in effect. Load must be called before Watch.
+func Watch(ctx context.Context, apply func(*Config)) error {
+	file, err := filepath.Abs(viper.ConfigFileUsed())
+	if err != nil {
+		return fmt.Errorf("resolving configuration file: %w", err)
+	}
+
+	// Watch the directory instead of the file, so editors and orchestrators that
+	// replace the file instead of writing to it are also noticed
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("creating configuration watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(file)); err != nil {
+		watcher.Close()
+		return fmt.Errorf("watching configuration file: %w", err)
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	reload := func(reason string) {
+		cfg, err := Reload()
+		if err != nil {
+			log.Printf("Configuration reload on %s failed, keeping the current configuration: %v", reason, err)
+			return
+		}
+		log.Printf("Configuration reloaded on %s", reason)
+		apply(cfg)
+	}
+
+	// The timer is only armed by the changes of the file
+	settled := time.NewTimer(reloadDelay)
+	settled.Stop()
+
+	go func() {
+		defer watcher.Close()
+		defer signal.Stop(hangup)
+		defer settled.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hangup:
+				reload("SIGHUP")
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == file && event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					settled.Reset(reloadDelay)
+				}
+			case <-settled.C:
+				reload("file change")
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Configuration watcher error: %v", err)
+			}
+		}
+	}()
+
+	return nil
+}
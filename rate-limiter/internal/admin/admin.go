@@ -0,0 +1,309 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/go-chi/chi/v5"
+)
+
+var (
+	ErrMissingKey      = errors.New("exactly one of the ip or token query parameters is required")
+	ErrInvalidDuration = errors.New("duration must be a positive duration such as 30s or 10m")
+	ErrUnknownList     = errors.New("the access list must be allow or deny")
+)
+
+// KeyState is the JSON representation of the state of a key
+type KeyState struct {
+	Key          string         `json:"key"`
+	Counters     map[string]int `json:"counters,omitempty"`
+	Blocked      bool           `json:"blocked"`
+	BlockedUntil *time.Time     `json:"blocked_until,omitempty"`
+	Violations   int            `json:"violations,omitempty"`
+	InFlight     int            `json:"in_flight,omitempty"`
+}
+
+// AccessLists is the JSON representation of the access lists
+type AccessLists struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Handler serves the admin API over the rate limiter storage
+type Handler struct {
+	storage storage.Storage
+}
+
+// NewRouter creates the admin router, every request must carry the token as a bearer token
+//
+//	GET    /keys?blocked=true     lists the keys with counters or blocks
+//	GET    /state?ip=|token=      shows the state of an IP or token
+//	POST   /block?ip=|token=&duration=10m blocks an IP or token
+//	DELETE /block?ip=|token=      unblocks an IP or token
+//	DELETE /counters?ip=|token=   resets the counters of an IP or token
+//	GET    /access                lists the allow and deny lists
+//	POST   /access/{list}?ip=|token= adds an IP, CIDR range or token to the allow or deny list
+//	DELETE /access/{list}?ip=|token= removes an IP, CIDR range or token from the allow or deny list
+//
+// The IP or token refers to the route policy named by the route query parameter when given,
+// except in the access lists, which apply to every route.
+func NewRouter(store storage.Storage, token string) http.Handler {
+	h := &Handler{storage: store}
+
+	r := chi.NewRouter()
+	r.Use(authenticate(token))
+	r.Get("/keys", h.listKeys)
+	r.Get("/state", h.getState)
+	r.Post("/block", h.block)
+	r.Delete("/block", h.unblock)
+	r.Delete("/counters", h.resetCounters)
+	r.Get("/access", h.listAccess)
+	r.Post("/access/{list}", h.addAccess)
+	r.Delete("/access/{list}", h.removeAccess)
+	return r
+}
+
+// authenticate rejects the requests without the admin bearer token
+func authenticate(token string) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bearer, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || token == "" || subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+				writeError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// listKeys lists the keys with counters or blocks, only the blocked ones with blocked=true
+func (h *Handler) listKeys(w http.ResponseWriter, r *http.Request) {
+	states, err := h.storage.List(r.Context())
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	onlyBlocked := r.URL.Query().Get("blocked") == "true"
+	keys := make([]KeyState, 0, len(states))
+	for _, state := range states {
+		if onlyBlocked && state.BlockedFor == 0 {
+			continue
+		}
+		keys = append(keys, newKeyState(state))
+	}
+	slices.SortFunc(keys, func(a, b KeyState) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	writeJSON(w, http.StatusOK, keys)
+}
+
+// getState shows the state of an IP or token
+func (h *Handler) getState(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	h.writeState(w, r, key)
+}
+
+// block blocks an IP or token for the given duration
+func (h *Handler) block(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+	if err != nil || duration <= 0 {
+		writeError(w, http.StatusBadRequest, ErrInvalidDuration)
+		return
+	}
+
+	if err := h.storage.Block(r.Context(), key, duration); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	h.writeState(w, r, key)
+}
+
+// unblock removes the block of an IP or token
+func (h *Handler) unblock(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.storage.Unblock(r.Context(), key); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	h.writeState(w, r, key)
+}
+
+// resetCounters resets the counters of an IP or token, keeping its block
+func (h *Handler) resetCounters(w http.ResponseWriter, r *http.Request) {
+	key, err := keyFromQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.storage.Reset(r.Context(), key); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	h.writeState(w, r, key)
+}
+
+// listAccess lists the allow and deny lists
+func (h *Handler) listAccess(w http.ResponseWriter, r *http.Request) {
+	allow, err := h.storage.AccessList(r.Context(), config.AccessListAllow)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	deny, err := h.storage.AccessList(r.Context(), config.AccessListDeny)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, AccessLists{Allow: allow, Deny: deny})
+}
+
+// addAccess adds an IP, CIDR range or token to an access list
+func (h *Handler) addAccess(w http.ResponseWriter, r *http.Request) {
+	list, entry, err := accessFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.storage.AddAccess(r.Context(), list, entry); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	h.listAccess(w, r)
+}
+
+// removeAccess removes an IP, CIDR range or token from an access list
+func (h *Handler) removeAccess(w http.ResponseWriter, r *http.Request) {
+	list, entry, err := accessFromRequest(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := h.storage.RemoveAccess(r.Context(), list, entry); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	h.listAccess(w, r)
+}
+
+// accessFromRequest returns the access list of the path and its entry for the ip or token
+// query parameter, the IPs and CIDR ranges are normalized
+func accessFromRequest(r *http.Request) (string, string, error) {
+	list := chi.URLParam(r, "list")
+	if list != config.AccessListAllow && list != config.AccessListDeny {
+		return "", "", ErrUnknownList
+	}
+
+	query := r.URL.Query()
+	ip, token := query.Get("ip"), query.Get("token")
+	switch {
+	case ip != "" && token == "":
+		prefix, err := config.ParsePrefix(ip)
+		if err != nil {
+			return "", "", err
+		}
+		if prefix.IsSingleIP() {
+			return list, limiter.IPKey(prefix.Addr().String()), nil
+		}
+		return list, limiter.IPKey(prefix.String()), nil
+	case token != "" && ip == "":
+		return list, limiter.TokenKey(token), nil
+	default:
+		return "", "", ErrMissingKey
+	}
+}
+
+// writeState responds with the current state of a key
+func (h *Handler) writeState(w http.ResponseWriter, r *http.Request, key string) {
+	state, err := h.storage.State(r.Context(), key)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newKeyState(state))
+}
+
+// keyFromQuery returns the storage key of the ip or token query parameter, on the
+// route policy of the route query parameter when there is one
+func keyFromQuery(r *http.Request) (string, error) {
+	query := r.URL.Query()
+	ip, token := query.Get("ip"), query.Get("token")
+
+	var key string
+	switch {
+	case ip != "" && token == "":
+		key = limiter.IPKey(ip)
+	case token != "" && ip == "":
+		key = limiter.TokenKey(token)
+	default:
+		return "", ErrMissingKey
+	}
+
+	if route := query.Get("route"); route != "" {
+		key = limiter.RouteKey(route, key)
+	}
+	return key, nil
+}
+
+// newKeyState converts a storage key state to its JSON representation
+func newKeyState(state storage.KeyState) KeyState {
+	keyState := KeyState{
+		Key:        state.Key,
+		Counters:   state.Counters,
+		Blocked:    state.BlockedFor != 0,
+		Violations: state.Violations,
+		InFlight:   state.InFlight,
+	}
+	if state.BlockedFor > 0 {
+		blockedUntil := time.Now().Add(state.BlockedFor).UTC().Truncate(time.Second)
+		keyState.BlockedUntil = &blockedUntil
+	}
+	return keyState
+}
+
+// writeJSON responds with a JSON body
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError responds with a JSON error
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// writeStorageError responds to a failed storage call with 503, as the storage shared by
+// the instances is unavailable or its circuit breaker is open
+func writeStorageError(w http.ResponseWriter, err error) {
+	writeError(w, http.StatusServiceUnavailable, err)
+}
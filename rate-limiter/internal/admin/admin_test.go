@@ -0,0 +1,194 @@
+package admin_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/admin"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+// unavailableStorage is a storage whose admin operations fail
+type unavailableStorage struct {
+	storage.Storage
+}
+
+func (unavailableStorage) List(ctx context.Context) ([]storage.KeyState, error) {
+	return nil, storage.ErrCircuitOpen
+}
+
+func (unavailableStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
+	return storage.ErrCircuitOpen
+}
+
+func TestAdminRouter(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	defer store.Close()
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:     1,
+			RateWindow:    time.Minute,
+			BlockDuration: time.Minute,
+		},
+	})
+	router := admin.NewRouter(store, "secret")
+
+	// do sends an authenticated admin request and decodes the JSON response into body
+	do := func(t *testing.T, method, target string, body any) int {
+		t.Helper()
+
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+
+		if body != nil {
+			if err := json.NewDecoder(rr.Body).Decode(body); err != nil {
+				t.Fatalf("Error decoding response: %v", err)
+			}
+		}
+		return rr.Code
+	}
+
+	// Get 192.168.4.1 blocked by exceeding the limit
+	for i := 0; i < 2; i++ {
+		if _, err := rl.Allow(t.Context(), "192.168.4.1", ""); err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+	}
+
+	t.Run("Unauthenticated", func(t *testing.T) {
+		for _, authorization := range []string{"", "Bearer wrong", "secret"} {
+			req := httptest.NewRequest("GET", "/keys", nil)
+			req.Header.Set("Authorization", authorization)
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("Expected %d for Authorization %q, got %d", http.StatusUnauthorized, authorization, rr.Code)
+			}
+		}
+	})
+
+	t.Run("List blocked keys", func(t *testing.T) {
+		var keys []admin.KeyState
+		if code := do(t, "GET", "/keys?blocked=true", &keys); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		if len(keys) != 1 || keys[0].Key != "ip:192.168.4.1" || !keys[0].Blocked || keys[0].BlockedUntil == nil {
+			t.Errorf("Expected ip:192.168.4.1 to be listed as blocked, got %+v", keys)
+		}
+	})
+
+	t.Run("State", func(t *testing.T) {
+		var state admin.KeyState
+		if code := do(t, "GET", "/state?ip=192.168.4.1", &state); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		if state.Counters[config.AlgorithmFixedWindow] != 2 || !state.Blocked {
+			t.Errorf("Expected 2 requests and a block, got %+v", state)
+		}
+
+		if code := do(t, "GET", "/state?ip=192.168.4.1&token=abc", nil); code != http.StatusBadRequest {
+			t.Errorf("Expected %d for ip and token together, got %d", http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("Unblock and reset", func(t *testing.T) {
+		var state admin.KeyState
+		if code := do(t, "DELETE", "/block?ip=192.168.4.1", &state); code != http.StatusOK || state.Blocked {
+			t.Fatalf("Expected ip:192.168.4.1 to be unblocked, got %d %+v", code, state)
+		}
+		var reset admin.KeyState
+		if code := do(t, "DELETE", "/counters?ip=192.168.4.1", &reset); code != http.StatusOK || len(reset.Counters) != 0 {
+			t.Fatalf("Expected ip:192.168.4.1 counters to be reset, got %d %+v", code, reset)
+		}
+
+		decision, err := rl.Allow(t.Context(), "192.168.4.1", "")
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if !decision.Allowed {
+			t.Errorf("Request should be allowed after unblock and reset")
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		var state admin.KeyState
+		if code := do(t, "POST", "/block?token=abc&duration=10m", &state); code != http.StatusOK || !state.Blocked {
+			t.Fatalf("Expected token:abc to be blocked, got %d %+v", code, state)
+		}
+		if until := time.Until(*state.BlockedUntil); until < 9*time.Minute || until > 10*time.Minute {
+			t.Errorf("Expected token:abc to be blocked for 10m, got %v", until)
+		}
+
+		decision, err := rl.Allow(t.Context(), "192.168.4.2", "abc")
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if decision.Allowed {
+			t.Errorf("Request with a blocked token should be rejected")
+		}
+
+		if code := do(t, "POST", "/block?route=login&token=abc&duration=10m", &state); code != http.StatusOK || state.Key != "route:login:token:abc" {
+			t.Errorf("Expected token:abc to be blocked on the login route, got %d %+v", code, state)
+		}
+
+		if code := do(t, "POST", "/block?token=abc&duration=-1m", nil); code != http.StatusBadRequest {
+			t.Errorf("Expected %d for a negative duration, got %d", http.StatusBadRequest, code)
+		}
+	})
+
+	t.Run("Access lists", func(t *testing.T) {
+		var lists admin.AccessLists
+		if code := do(t, "POST", "/access/deny?ip=10.1.2.3/16", &lists); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		if code := do(t, "POST", "/access/allow?ip=::ffff:192.168.4.9", &lists); code != http.StatusOK {
+			t.Fatalf("Expected %d, got %d", http.StatusOK, code)
+		}
+		if len(lists.Allow) != 1 || lists.Allow[0] != "ip:192.168.4.9" || len(lists.Deny) != 1 || lists.Deny[0] != "ip:10.1.0.0/16" {
+			t.Errorf("Expected the normalized entries, got %+v", lists)
+		}
+
+		if err := rl.RefreshAccess(t.Context()); err != nil {
+			t.Fatalf("Error refreshing access lists: %v", err)
+		}
+		if _, err := rl.Allow(t.Context(), "10.1.200.7", ""); !errors.Is(err, limiter.ErrDenied) {
+			t.Errorf("Expected 10.1.200.7 to be denied, got %v", err)
+		}
+
+		if code := do(t, "DELETE", "/access/deny?ip=10.1.0.0/16", &lists); code != http.StatusOK || len(lists.Deny) != 0 {
+			t.Errorf("Expected the deny list to be empty, got %d %+v", code, lists)
+		}
+
+		for _, target := range []string{"/access/other?ip=10.0.0.1", "/access/deny?ip=invalid", "/access/deny"} {
+			if code := do(t, "POST", target, nil); code != http.StatusBadRequest {
+				t.Errorf("Expected %d for %s, got %d", http.StatusBadRequest, target, code)
+			}
+		}
+	})
+
+	t.Run("Storage unavailable", func(t *testing.T) {
+		router := admin.NewRouter(unavailableStorage{Storage: store}, "secret")
+		for _, target := range []string{"GET /keys", "POST /block?ip=192.168.4.3&duration=1m"} {
+			method, path, _ := strings.Cut(target, " ")
+			req := httptest.NewRequest(method, path, nil)
+			req.Header.Set("Authorization", "Bearer secret")
+			rr := httptest.NewRecorder()
+			router.ServeHTTP(rr, req)
+			if rr.Code != http.StatusServiceUnavailable {
+				t.Errorf("Expected %d for %s, got %d", http.StatusServiceUnavailable, target, rr.Code)
+			}
+		}
+	})
+}
@@ -0,0 +1,187 @@
+package limiter
+
+import (
+	"context"
+	"log"
+	"net/netip"
+	"strings"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+)
+
+// DefaultAccessRefreshInterval is how often the access lists of the storage are read
+// again when no interval is configured
+const DefaultAccessRefreshInterval = 10 * time.Second
+
+// accessRules are the parsed entries of the allow and deny lists
+type accessRules struct {
+	allowIPs    []netip.Prefix
+	denyIPs     []netip.Prefix
+	allowTokens map[string]struct{}
+	denyTokens  map[string]struct{}
+}
+
+// newAccessRules parses the IPs, CIDR ranges and tokens of the lists, skipping the
+// entries that can't be parsed
+func newAccessRules(allowIPs, denyIPs, allowTokens, denyTokens []string) *accessRules {
+	rules := &accessRules{
+		allowTokens: make(map[string]struct{}, len(allowTokens)),
+		denyTokens:  make(map[string]struct{}, len(denyTokens)),
+	}
+	for _, entry := range allowIPs {
+		if prefix, err := config.ParsePrefix(entry); err == nil {
+			rules.allowIPs = append(rules.allowIPs, prefix)
+		}
+	}
+	for _, entry := range denyIPs {
+		if prefix, err := config.ParsePrefix(entry); err == nil {
+			rules.denyIPs = append(rules.denyIPs, prefix)
+		}
+	}
+	for _, token := range allowTokens {
+		if token = strings.TrimSpace(token); token != "" {
+			rules.allowTokens[token] = struct{}{}
+		}
+	}
+	for _, token := range denyTokens {
+		if token = strings.TrimSpace(token); token != "" {
+			rules.denyTokens[token] = struct{}{}
+		}
+	}
+	return rules
+}
+
+// empty reports whether the lists have no entries
+func (r *accessRules) empty() bool {
+	return r == nil || len(r.allowIPs) == 0 && len(r.denyIPs) == 0 && len(r.allowTokens) == 0 && len(r.denyTokens) == 0
+}
+
+// hasTokens reports whether the lists have tokens
+func (r *accessRules) hasTokens() bool {
+	return r != nil && (len(r.allowTokens) > 0 || len(r.denyTokens) > 0)
+}
+
+// denies reports whether the deny list has the token or a range containing the IP
+func (r *accessRules) denies(ip netip.Prefix, token string) bool {
+	if r == nil {
+		return false
+	}
+	_, found := r.denyTokens[token]
+	return found || containsIP(r.denyIPs, ip)
+}
+
+// allows reports whether the allow list has the token or a range containing the IP
+func (r *accessRules) allows(ip netip.Prefix, token string) bool {
+	if r == nil {
+		return false
+	}
+	_, found := r.allowTokens[token]
+	return found || containsIP(r.allowIPs, ip)
+}
+
+// containsIP reports whether any of the ranges contains the IP, which may be an IPv6
+// prefix when the clients are aggregated and then must be contained as a whole
+func containsIP(prefixes []netip.Prefix, ip netip.Prefix) bool {
+	if !ip.IsValid() {
+		return false
+	}
+	for _, prefix := range prefixes {
+		if prefix.Bits() <= ip.Bits() && prefix.Contains(ip.Addr()) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAccess decides the requests of the IPs and tokens in the access lists of the
+// configuration or of the storage before any counter is touched, reporting false when
+// they belong to none. Tokens are matched by the identifier their counters are kept under.
+func (rl *RateLimiter) checkAccess(ctx context.Context, cfg *Config, ip, token string) (Decision, bool, error) {
+	stored := rl.access.Load()
+	if cfg.access.empty() && stored.empty() {
+		return Decision{}, false, nil
+	}
+
+	policy := "ip"
+	if token != "" {
+		policy = "token"
+		if cfg.access.hasTokens() || stored.hasTokens() {
+			id, _, err := rl.resolveToken(ctx, cfg, token)
+			if err != nil {
+				return Decision{}, true, err
+			}
+			token = id
+		}
+	}
+
+	// Single IPs are parsed as prefixes covering themselves, like the aggregated IPv6 clients
+	prefix, _ := config.ParsePrefix(ip)
+
+	// The deny lists win over the allow lists
+	switch {
+	case cfg.access.denies(prefix, token) || stored.denies(prefix, token):
+		return Decision{}, true, ErrDenied
+	case cfg.access.allows(prefix, token) || stored.allows(prefix, token):
+		return Decision{Allowed: true, Policy: policy, Access: config.AccessListAllow}, true, nil
+	default:
+		return Decision{}, false, nil
+	}
+}
+
+// RefreshAccess reads the access lists of the storage, whose entries are IPKey and
+// TokenKey keys, replacing the ones read before. The entries that can't be parsed
+// are skipped.
+func (rl *RateLimiter) RefreshAccess(ctx context.Context) error {
+	var allowIPs, denyIPs, allowTokens, denyTokens []string
+	read := func(list string, ips, tokens *[]string) error {
+		entries, err := rl.storage.AccessList(ctx, list)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if ip, found := strings.CutPrefix(entry, "ip:"); found {
+				*ips = append(*ips, ip)
+			} else if token, found := strings.CutPrefix(entry, "token:"); found {
+				*tokens = append(*tokens, token)
+			}
+		}
+		return nil
+	}
+	if err := read(config.AccessListAllow, &allowIPs, &allowTokens); err != nil {
+		return err
+	}
+	if err := read(config.AccessListDeny, &denyIPs, &denyTokens); err != nil {
+		return err
+	}
+
+	rl.access.Store(newAccessRules(allowIPs, denyIPs, allowTokens, denyTokens))
+	return nil
+}
+
+// WatchAccess reads the access lists of the storage and reads them again every
+// interval until the context is done, so the changes made by any instance reach
+// all of them. A failed refresh keeps the lists read before, the error of the first
+// read is returned but the lists keep being read.
+func (rl *RateLimiter) WatchAccess(ctx context.Context, interval time.Duration) error {
+	if interval <= 0 {
+		interval = DefaultAccessRefreshInterval
+	}
+	err := rl.RefreshAccess(ctx)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rl.RefreshAccess(ctx); err != nil && ctx.Err() == nil {
+					log.Printf("Failed to refresh the access lists: %v", err)
+				}
+			}
+		}
+	}()
+	return err
+}
@@ -0,0 +1,134 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+func TestRateLimiterAccess(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute},
+		Token: map[string]config.LimiterConfig{
+			"abc": {RateLimit: 1, RateWindow: time.Minute},
+		},
+		Access: config.AccessConfig{
+			AllowIPs:   []string{"192.168.10.0/24", "2001:db8::/32"},
+			DenyIPs:    []string{"192.168.10.66", "10.0.0.0/8"},
+			DenyTokens: []string{"revoked"},
+		},
+	})
+	defer rl.Close()
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		ip      string
+		token   string
+		allowed bool
+		err     error
+	}{
+		{name: "Allowed range", ip: "192.168.10.20", allowed: true},
+		{name: "Denied IP wins over the allowed range", ip: "192.168.10.66", err: limiter.ErrDenied},
+		{name: "Denied range", ip: "10.20.30.40", err: limiter.ErrDenied},
+		{name: "Denied token", ip: "192.168.10.20", token: "revoked", err: limiter.ErrDenied},
+		{name: "Allowed IPv6 prefix", ip: "2001:db8:1::/64", allowed: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Allowed clients are never limited, denied ones always rejected
+			for i := 0; i < 3; i++ {
+				decision, err := rl.Allow(ctx, tt.ip, tt.token)
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Expected error %v, got %v", tt.err, err)
+				}
+				if decision.Allowed != tt.allowed {
+					t.Errorf("Request %d: expected allowed %v, got %+v", i+1, tt.allowed, decision)
+				}
+				if tt.allowed && decision.Access != config.AccessListAllow {
+					t.Errorf("Expected the decision to come from the allow list, got %+v", decision)
+				}
+			}
+		})
+	}
+
+	t.Run("Counters are not touched", func(t *testing.T) {
+		for _, key := range []string{"ip:192.168.10.20", "ip:10.20.30.40", "token:revoked"} {
+			state, err := store.State(ctx, key)
+			if err != nil {
+				t.Fatalf("Error getting state: %v", err)
+			}
+			if len(state.Counters) != 0 {
+				t.Errorf("Expected no counters for %s, got %v", key, state.Counters)
+			}
+		}
+	})
+
+	t.Run("Other clients are limited", func(t *testing.T) {
+		rl.Allow(ctx, "172.16.0.1", "")
+		decision, err := rl.Allow(ctx, "172.16.0.1", "")
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if decision.Allowed {
+			t.Errorf("Request should be limited")
+		}
+	})
+
+	t.Run("Lists of the storage", func(t *testing.T) {
+		if err := store.AddAccess(ctx, config.AccessListDeny, "ip:172.16.0.0/12"); err != nil {
+			t.Fatalf("Error adding to the deny list: %v", err)
+		}
+		if err := store.AddAccess(ctx, config.AccessListAllow, "token:abc"); err != nil {
+			t.Fatalf("Error adding to the allow list: %v", err)
+		}
+
+		// The lists are used once read
+		if _, err := rl.Allow(ctx, "172.16.5.5", ""); err != nil {
+			t.Fatalf("Expected 172.16.5.5 not to be denied before a refresh, got %v", err)
+		}
+		if err := rl.RefreshAccess(ctx); err != nil {
+			t.Fatalf("Error refreshing access lists: %v", err)
+		}
+		if _, err := rl.Allow(ctx, "172.16.5.5", ""); !errors.Is(err, limiter.ErrDenied) {
+			t.Errorf("Expected 172.16.5.5 to be denied, got %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			decision, err := rl.Allow(ctx, "172.31.0.1", "abc")
+			if !errors.Is(err, limiter.ErrDenied) || decision.Allowed {
+				t.Errorf("Expected the denied IP to win over the allowed token, got %+v %v", decision, err)
+			}
+			decision, err = rl.Allow(ctx, "192.168.99.1", "abc")
+			if err != nil || !decision.Allowed {
+				t.Errorf("Expected the allowed token not to be limited, got %+v %v", decision, err)
+			}
+		}
+
+		// Removed entries stop applying on the next refresh
+		if err := store.RemoveAccess(ctx, config.AccessListDeny, "ip:172.16.0.0/12"); err != nil {
+			t.Fatalf("Error removing from the deny list: %v", err)
+		}
+		if err := rl.RefreshAccess(ctx); err != nil {
+			t.Fatalf("Error refreshing access lists: %v", err)
+		}
+		if _, err := rl.Allow(ctx, "172.16.5.5", ""); err != nil {
+			t.Errorf("Expected 172.16.5.5 not to be denied anymore, got %v", err)
+		}
+	})
+
+	t.Run("Reload", func(t *testing.T) {
+		cfg := rl.Config()
+		cfg.Access = config.AccessConfig{}
+		rl.SetConfig(cfg)
+		if _, err := rl.Allow(ctx, "10.20.30.40", ""); err != nil {
+			t.Errorf("Expected 10.20.30.40 not to be denied after reload, got %v", err)
+		}
+	})
+}
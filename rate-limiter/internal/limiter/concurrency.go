@@ -0,0 +1,189 @@
+package limiter
+
+import (
+	"context"
+	"crypto/rand"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// concurrencyPollInterval is how often a queued request tries again to take a slot
+const concurrencyPollInterval = 50 * time.Millisecond
+
+// Lease is the concurrency slot held by an in-flight request. It is renewed in the
+// background until released, so it only expires when the instance holding it stops.
+type Lease struct {
+	storage storage.Storage
+	ctx     context.Context
+	key     string
+	id      string
+
+	stop    chan struct{}
+	stopped chan struct{}
+	lost    chan struct{}
+	once    sync.Once
+}
+
+// AcquireRoute takes a concurrency slot for a request to a route, under the key and the
+// policy AllowRoute limits it by, waiting up to the QueueTimeout of the policy for a slot
+// to be freed. It is meant to be called before AllowRoute, so the requests that get no
+// slot are not counted in the limit and the quotas. The lease must be released once the
+// request is served, it is nil when the policy does not limit concurrency, the allow list
+// exempts the request or the storage failed and the failure mode is open. A request that
+// gets no slot is rejected with a Concurrency decision, and the requests AllowRoute would
+// reject for their access or their API key are rejected with its errors before waiting.
+// The rejections are recorded as denied decisions of the concurrency limit, the requests
+// that get a slot are recorded by AllowRoute.
+func (rl *RateLimiter) AcquireRoute(ctx context.Context, method, pattern, ip, token string) (*Lease, Decision, error) {
+	ctx, span := tracer.Start(ctx, "limiter.Acquire", trace.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("http.route", pattern),
+	))
+	defer span.End()
+
+	cfg := rl.config.Load()
+
+	// The failed checks are recorded as AllowRoute records them, since it is not called for them
+	if decision, decided, err := rl.checkAccess(ctx, cfg, ip, token); decided {
+		if err != nil {
+			rl.observe(ctx, token, DefaultPolicy, decision, err)
+		}
+		return nil, decision, err
+	}
+	name, _, found := cfg.route(method, pattern)
+	if !found {
+		name = DefaultPolicy
+	}
+	policy, route, key, limiterConfig, err := rl.policyFor(ctx, cfg, method, pattern, ip, token)
+	if err != nil {
+		rl.observe(ctx, token, name, Decision{}, err)
+		return nil, Decision{}, err
+	}
+
+	decision := Decision{Policy: policy, Route: route, Key: key, Limit: limiterConfig.MaxConcurrent, Concurrency: true}
+	// Dry run policies never reject a request
+	if limiterConfig.MaxConcurrent <= 0 || limiterConfig.DryRun {
+		decision.Allowed = true
+		return nil, decision, nil
+	}
+
+	id := rand.Text()
+	lease := limiterConfig.Lease()
+	var timeout <-chan time.Time
+	if limiterConfig.QueueTimeout > 0 {
+		timer := time.NewTimer(limiterConfig.QueueTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	for {
+		acquired, err := rl.storage.Acquire(ctx, key, id, limiterConfig.MaxConcurrent, lease)
+		if err != nil {
+			decision, err := rl.storageFailure(ctx, cfg, err, decision)
+			if err != nil {
+				rl.observe(ctx, token, name, decision, err)
+			}
+			return nil, decision, err
+		}
+		if acquired {
+			decision.Allowed = true
+			span.SetAttributes(attribute.String("rate_limiter.decision", OutcomeAllowed))
+			return rl.newLease(ctx, key, id, limiterConfig.MaxConcurrent, lease), decision, nil
+		}
+
+		if timeout == nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, Decision{}, ctx.Err()
+		case <-timeout:
+			decision.Queued = true
+		case <-time.After(concurrencyPollInterval):
+			continue
+		}
+		break
+	}
+
+	decision.BlockedUntil = time.Now()
+	rl.observe(ctx, token, name, decision, nil)
+	return nil, decision, nil
+}
+
+// newLease starts renewing a slot taken for the lease id every half lease
+func (rl *RateLimiter) newLease(ctx context.Context, key, id string, limit int, lease time.Duration) *Lease {
+	l := &Lease{
+		storage: rl.storage,
+		// The slot is released after the request is done, even when it was canceled
+		ctx:     context.WithoutCancel(ctx),
+		key:     key,
+		id:      id,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		lost:    make(chan struct{}),
+	}
+
+	go func() {
+		defer close(l.stopped)
+		ticker := time.NewTicker(max(lease/2, time.Millisecond))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				acquired, err := l.storage.Acquire(l.ctx, key, id, limit, lease)
+				if err != nil {
+					log.Printf("Failed to renew the concurrency slot of %s: %v", key, err)
+					continue
+				}
+				// The slot expired before being renewed and every slot was taken meanwhile
+				if !acquired {
+					log.Printf("Lost the concurrency slot of %s, stopping its request", key)
+					close(l.lost)
+					return
+				}
+			}
+		}
+	}()
+	return l
+}
+
+// Context returns a copy of ctx canceled with ErrLeaseLost when the slot is lost, because
+// it expired before being renewed and other requests took every slot, so the request
+// stops instead of running beyond the concurrency limit. The stop function releases the
+// resources of the context and must be called once the request is served.
+func (l *Lease) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l == nil {
+		return context.WithCancel(ctx)
+	}
+	ctx, cancel := context.WithCancelCause(ctx)
+	go func() {
+		select {
+		case <-l.lost:
+			cancel(ErrLeaseLost)
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() { cancel(nil) }
+}
+
+// Release frees the slot, it may be called on a nil lease and more than once
+func (l *Lease) Release() {
+	if l == nil {
+		return
+	}
+	l.once.Do(func() {
+		// Stop renewing first, so a renewal can't take the slot back
+		close(l.stop)
+		<-l.stopped
+		if err := l.storage.Release(l.ctx, l.key, l.id); err != nil {
+			log.Printf("Failed to release the concurrency slot of %s: %v", l.key, err)
+		}
+	})
+}
@@ -0,0 +1,130 @@
+package limiter_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+func TestRateLimiterConcurrency(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 100, RateWindow: time.Minute, MaxConcurrent: 1, ConcurrencyLease: 40 * time.Millisecond},
+		Token: map[string]config.LimiterConfig{
+			"queued":    {RateLimit: 100, RateWindow: time.Minute, MaxConcurrent: 1, QueueTimeout: 500 * time.Millisecond},
+			"impatient": {RateLimit: 100, RateWindow: time.Minute, MaxConcurrent: 1, QueueTimeout: 50 * time.Millisecond},
+			"unlimited": {RateLimit: 100, RateWindow: time.Minute},
+		},
+	})
+	defer rl.Close()
+	ctx := context.Background()
+
+	// acquire takes a slot for a request to / and fails the test on error
+	acquire := func(ip, token string) (*limiter.Lease, limiter.Decision) {
+		t.Helper()
+		lease, decision, err := rl.AcquireRoute(ctx, "GET", "/", ip, token)
+		if err != nil {
+			t.Fatalf("Error acquiring a slot: %v", err)
+		}
+		return lease, decision
+	}
+
+	t.Run("Rejected right away without a queue", func(t *testing.T) {
+		lease, decision := acquire("192.168.1.1", "")
+		if !decision.Allowed || lease == nil {
+			t.Fatalf("First request should get a slot, got %+v", decision)
+		}
+
+		// The lease is renewed while the request is in flight
+		time.Sleep(100 * time.Millisecond)
+		_, decision = acquire("192.168.1.1", "")
+		if decision.Allowed || !decision.Concurrency || decision.Queued || decision.Limit != 1 || decision.Key != "ip:192.168.1.1" {
+			t.Errorf("Second request should be rejected by the concurrency limit, got %+v", decision)
+		}
+
+		lease.Release()
+		lease.Release()
+		lease, decision = acquire("192.168.1.1", "")
+		if !decision.Allowed {
+			t.Errorf("Request after the release should get a slot, got %+v", decision)
+		}
+		lease.Release()
+	})
+
+	t.Run("Queued until a slot is freed", func(t *testing.T) {
+		lease, _ := acquire("192.168.1.2", "queued")
+		time.AfterFunc(50*time.Millisecond, lease.Release)
+
+		start := time.Now()
+		queued, decision := acquire("192.168.1.2", "queued")
+		if !decision.Allowed || decision.Key != "token:queued" {
+			t.Fatalf("Queued request should get the freed slot, got %+v", decision)
+		}
+		if waited := time.Since(start); waited < 50*time.Millisecond {
+			t.Errorf("Queued request should wait for the release, waited %v", waited)
+		}
+		queued.Release()
+	})
+
+	t.Run("Queue timeout", func(t *testing.T) {
+		lease, _ := acquire("192.168.1.3", "impatient")
+		defer lease.Release()
+
+		_, decision := acquire("192.168.1.3", "impatient")
+		if decision.Allowed || !decision.Queued {
+			t.Errorf("Request should time out in the queue, got %+v", decision)
+		}
+	})
+
+	t.Run("Unlimited concurrency", func(t *testing.T) {
+		lease, decision := acquire("192.168.1.4", "unlimited")
+		if !decision.Allowed || lease != nil {
+			t.Errorf("Request should be allowed without a lease, got %+v", decision)
+		}
+		lease.Release()
+	})
+}
+
+// losingStorage loses every concurrency slot after the first one was taken
+type losingStorage struct {
+	storage.Storage
+	acquired atomic.Bool
+}
+
+func (s *losingStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	if s.acquired.Swap(true) {
+		return false, nil
+	}
+	return s.Storage.Acquire(ctx, key, id, limit, lease)
+}
+
+func TestRateLimiterConcurrencyLostLease(t *testing.T) {
+	rl := limiter.New(&losingStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 100, RateWindow: time.Minute, MaxConcurrent: 1, ConcurrencyLease: 40 * time.Millisecond},
+	})
+	defer rl.Close()
+
+	lease, decision, err := rl.AcquireRoute(context.Background(), "GET", "/", "192.168.2.1", "")
+	if err != nil || !decision.Allowed {
+		t.Fatalf("Expected a slot, got %+v: %v", decision, err)
+	}
+	defer lease.Release()
+
+	// The first renewal finds the slot taken by another request
+	ctx, stop := lease.Context(context.Background())
+	defer stop()
+	select {
+	case <-ctx.Done():
+		if !errors.Is(context.Cause(ctx), limiter.ErrLeaseLost) {
+			t.Errorf("Expected ErrLeaseLost, got %v", context.Cause(ctx))
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected the context to be canceled once the slot was lost")
+	}
+}
@@ -0,0 +1,65 @@
+package limiter
+
+import (
+	"context"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+)
+
+// costKey is the context key of the cost set by WithCost
+type costKey struct{}
+
+// WithCost returns a context in which a check counts the request as cost requests,
+// instead of the cost of its route
+func WithCost(ctx context.Context, cost int) context.Context {
+	return context.WithValue(ctx, costKey{}, cost)
+}
+
+// requestCost returns the cost set by WithCost, or fallback when none was set
+func requestCost(ctx context.Context, fallback int) int {
+	if cost, ok := ctx.Value(costKey{}).(int); ok && cost > 0 {
+		return cost
+	}
+	return fallback
+}
+
+// ChargeRoute counts cost more requests for a request to a route AllowRoute already
+// allowed, under the same key and policy, when the request turns out to cost more than
+// it was checked for. The cost is counted in the limit and the quotas as a request of
+// that cost would be, so the requests that follow may be rejected or the key blocked,
+// but the bucket algorithms only count it when the bucket has room for it. The cost is
+// capped at the limit of the policy, so no request can charge more than a full window
+// or bucket. Dry run and shadow policies are not charged.
+func (rl *RateLimiter) ChargeRoute(ctx context.Context, method, pattern, ip, token string, cost int) error {
+	if cost <= 0 {
+		return nil
+	}
+
+	ctx, span := tracer.Start(ctx, "limiter.Charge")
+	defer span.End()
+
+	cfg := rl.config.Load()
+	policy, route, key, limiterConfig, err := rl.policyFor(ctx, cfg, method, pattern, ip, token)
+	if err != nil || limiterConfig.DryRun {
+		return err
+	}
+	if limit, _ := limiterConfig.Quota(); cost > limit {
+		cost = limit
+	}
+
+	// Tokens still block the IP, as when the request was checked
+	var linked []string
+	if policy == "token" && ip != "" {
+		ipKey := IPKey(ip)
+		if route != "" {
+			ipKey = RouteKey(route, ipKey)
+		}
+		linked = append(linked, ipKey)
+	}
+
+	// Report the storage failures instead of counting the cost as degraded
+	closed := *cfg
+	closed.FailureMode = config.FailureModeClosed
+	_, err = rl.takeLimit(ctx, &closed, policy, key, cost, limiterConfig, linked...)
+	return err
+}
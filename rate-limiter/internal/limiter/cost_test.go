@@ -0,0 +1,107 @@
+package limiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+func TestRateLimiterCost(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute},
+		Token: map[string]config.LimiterConfig{
+			"abc": {RateLimit: 100, RateWindow: time.Minute, Quotas: map[string]int{config.QuotaPeriodDay: 10}},
+		},
+		RouteCost: map[string]config.RouteCostConfig{
+			"export":      {Pattern: "/export", Cost: 2},
+			"export_post": {Method: "POST", Pattern: "/export", Cost: 4},
+		},
+	})
+	defer rl.Close()
+	ctx := context.Background()
+
+	// allow checks a request and fails the test on error
+	allow := func(ctx context.Context, method, pattern, ip, token string) limiter.Decision {
+		t.Helper()
+		decision, err := rl.AllowRoute(ctx, method, pattern, ip, token)
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		return decision
+	}
+
+	t.Run("Route cost", func(t *testing.T) {
+		tests := []struct {
+			method    string
+			pattern   string
+			ip        string
+			cost      int
+			remaining int
+		}{
+			{"GET", "/export", "192.168.1.1", 2, 3},
+			{"POST", "/export", "192.168.1.2", 4, 1},
+			{"GET", "/weather", "192.168.1.3", 1, 4},
+		}
+		for _, tt := range tests {
+			decision := allow(ctx, tt.method, tt.pattern, tt.ip, "")
+			if !decision.Allowed || decision.Cost != tt.cost || decision.Remaining != tt.remaining {
+				t.Errorf("%s %s should cost %d and leave %d remaining, got %+v", tt.method, tt.pattern, tt.cost, tt.remaining, decision)
+			}
+		}
+
+		// The remaining request has no room for another one costing 4
+		if decision := allow(ctx, "POST", "/export", "192.168.1.2", ""); decision.Allowed {
+			t.Errorf("Request costing more than the remaining should be rejected, got %+v", decision)
+		}
+	})
+
+	t.Run("Cost of the context wins over the route cost", func(t *testing.T) {
+		decision := allow(limiter.WithCost(ctx, 5), "GET", "/export", "192.168.1.4", "")
+		if !decision.Allowed || decision.Cost != 5 || decision.Remaining != 0 {
+			t.Errorf("Request should use the whole limit, got %+v", decision)
+		}
+	})
+
+	t.Run("Quotas count the cost", func(t *testing.T) {
+		allow(limiter.WithCost(ctx, 3), "GET", "/weather", "192.168.1.5", "abc")
+		usages, err := rl.Quotas(ctx, "abc")
+		if err != nil {
+			t.Fatalf("Error getting quotas: %v", err)
+		}
+		if len(usages) != 1 || usages[0].Used != 3 {
+			t.Errorf("Expected a cost of 3 counted in the quota, got %+v", usages)
+		}
+	})
+
+	t.Run("Charging a request that cost more", func(t *testing.T) {
+		allow(ctx, "GET", "/weather", "192.168.1.6", "")
+		if err := rl.ChargeRoute(ctx, "GET", "/weather", "192.168.1.6", "", 3); err != nil {
+			t.Fatalf("Error charging: %v", err)
+		}
+		decision := allow(ctx, "GET", "/weather", "192.168.1.6", "")
+		if !decision.Allowed || decision.Remaining != 0 {
+			t.Errorf("Charged cost should be counted in the limit, got %+v", decision)
+		}
+		if decision = allow(ctx, "GET", "/weather", "192.168.1.6", ""); decision.Allowed {
+			t.Errorf("Request should be rejected once the charged cost used the limit, got %+v", decision)
+		}
+	})
+	t.Run("Charged cost is capped at the limit", func(t *testing.T) {
+		allow(ctx, "GET", "/weather", "192.168.1.7", "")
+		if err := rl.ChargeRoute(ctx, "GET", "/weather", "192.168.1.7", "", 1000); err != nil {
+			t.Fatalf("Error charging: %v", err)
+		}
+		state, err := store.State(ctx, limiter.IPKey("192.168.1.7"))
+		if err != nil {
+			t.Fatalf("Error reading key state: %v", err)
+		}
+		if count := state.Counters[config.AlgorithmFixedWindow]; count != 6 {
+			t.Errorf("Expected the request and a charge of the limit counted, got %d", count)
+		}
+	})
+}
@@ -2,9 +2,47 @@ package limiter
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/felipeosantos/goexpert/rate-limiter/config"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the spans and metrics of the rate limiter in OpenTelemetry
+const instrumentationName = "github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+
+// The rate limiter reports through the global OpenTelemetry providers, which do
+// nothing until the application configures them
+var (
+	tracer             = otel.Tracer(instrumentationName)
+	decisionCounter, _ = otel.Meter(instrumentationName).Int64Counter("rate_limiter.decisions",
+		metric.WithDescription("Rate limit checks by key type, policy and decision"))
+	shadowDecisionCounter, _ = otel.Meter(instrumentationName).Int64Counter("rate_limiter.shadow_decisions",
+		metric.WithDescription("Decisions of the dry run and shadow policies by key type, policy and decision"))
+)
+
+var (
+	ErrUnknownAlgorithm = storage.ErrUnknownAlgorithm
+	// ErrInvalidToken is returned for API keys the token registry does not accept
+	ErrInvalidToken = errors.New("invalid API key")
+	// ErrStorageUnavailable is returned when the storage fails and the failure mode is closed
+	ErrStorageUnavailable = errors.New("rate limit storage unavailable")
+	// ErrDenied is returned for the IPs and tokens in a deny list
+	ErrDenied = errors.New("access denied")
+	// ErrLeaseLost is the cause of the cancellation of the context of a request whose
+	// concurrency slot was lost
+	ErrLeaseLost = errors.New("concurrency slot lost")
 )
 
 // Config holds rate limiter configuration
@@ -24,112 +62,575 @@ import (
 type Config struct {
 	IP    config.LimiterConfig
 	Token map[string]config.LimiterConfig
+	// Route maps the route policy names to their configurations
+	Route map[string]config.RouteConfig
+	// RouteCost maps names to the costs of the requests to routes, which otherwise cost 1
+	RouteCost map[string]config.RouteCostConfig
+	// Plan maps the plans of the token registry to their configurations
+	Plan map[string]config.LimiterConfig
+	// FailureMode decides the requests the storage fails to check, config.FailureModeClosed
+	// rejects them with ErrStorageUnavailable and config.FailureModeOpen allows them
+	FailureMode string
+	// Location is the time zone the quota periods start in, UTC when nil
+	Location *time.Location
+	// Access lists the IPs, CIDR ranges and tokens exempted from the limits or always
+	// rejected, besides the access lists of the storage
+	Access config.AccessConfig
+
+	// access holds the parsed Access lists
+	access *accessRules
+}
+
+// Validate checks that the policies and the access lists can be applied, as config.Load
+// does for the configuration they are read from
+func (c Config) Validate() error {
+	if err := config.ValidatePolicies(c.IP, c.Token, c.Plan, c.Route, c.RouteCost); err != nil {
+		return err
+	}
+	if err := (config.FailureConfig{Mode: c.FailureMode}).Validate(); err != nil {
+		return fmt.Errorf("failure: %w", err)
+	}
+	if err := c.Access.Validate(); err != nil {
+		return fmt.Errorf("access: %w", err)
+	}
+	return nil
+}
+
+// location returns the time zone of the quota periods
+func (c *Config) location() *time.Location {
+	if c.Location == nil {
+		return time.UTC
+	}
+	return c.Location
+}
+
+// route returns the route policy matching the method and route pattern,
+// preferring a policy for the method over one for every method
+func (c *Config) route(method, pattern string) (string, config.RouteConfig, bool) {
+	if pattern == "" {
+		return "", config.RouteConfig{}, false
+	}
+
+	var (
+		anyName  string
+		anyRoute config.RouteConfig
+		anyFound bool
+	)
+	for name, route := range c.Route {
+		if route.Pattern != pattern {
+			continue
+		}
+		if strings.EqualFold(route.Method, method) {
+			return name, route, true
+		}
+		if route.Method == "" {
+			anyName, anyRoute, anyFound = name, route, true
+		}
+	}
+	return anyName, anyRoute, anyFound
+}
+
+// cost returns how many requests a request to the method and route pattern counts as,
+// preferring a cost for the method over one for every method
+func (c *Config) cost(method, pattern string) int {
+	if pattern == "" {
+		return 1
+	}
+
+	cost := 1
+	for _, routeCost := range c.RouteCost {
+		if routeCost.Pattern != pattern {
+			continue
+		}
+		if strings.EqualFold(routeCost.Method, method) {
+			return routeCost.Cost
+		}
+		if routeCost.Method == "" {
+			cost = routeCost.Cost
+		}
+	}
+	return cost
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	// Allowed reports whether the request may proceed
+	Allowed bool
+	// Policy is the policy applied to the request, "ip" or "token"
+	Policy string
+	// Route is the name of the route policy applied to the request, empty when none matched
+	Route string
+	// Quota is the calendar period of the quota described by the decision, empty for the rate limit
+	Quota string
+	// Access is config.AccessListAllow when the allow list exempted the request from the
+	// limits, leaving the other fields unset
+	Access string
+	// Key is the key that decided the request, the blocked key when a block rejected it
+	Key string
+	// Limit is how many requests the policy allows in Window
+	Limit int
+	// Window is the period of the policy
+	Window time.Duration
+	// Remaining is how many requests are still allowed
+	Remaining int
+	// ResetAt is when the limit is fully restored
+	ResetAt time.Time
+	// BlockedUntil is when a rejected request may be retried, the block expiry when the key is blocked
+	BlockedUntil time.Time
+	// Degraded reports that the storage failed and the request was allowed without being counted
+	Degraded bool
+	// DryRun reports that the policy is in dry run, so the request was allowed and only
+	// Shadow describes the policy
+	DryRun bool
+	// Shadow is the decision of the dry run or shadow policy evaluated for the request,
+	// nil when there is none or the storage failed to check it
+	Shadow *Decision
+	// Concurrency reports that the decision is about the concurrency limit of the policy,
+	// Limit being how many requests may be in flight at once
+	Concurrency bool
+	// Queued reports that the request waited for a concurrency slot until the queue timeout
+	Queued bool
+	// Cost is how many requests the request counted as in the limit and the quotas
+	Cost int
+}
+
+// TokenStore looks up the API keys of the token registry
+type TokenStore interface {
+	// Lookup returns the token of an API key, failing with tokens.ErrNotFound,
+	// tokens.ErrExpired or tokens.ErrRevoked when the key can't be used
+	Lookup(ctx context.Context, key string) (tokens.Token, error)
+}
+
+// Outcomes of a rate limit check recorded by Metrics
+const (
+	// OutcomeAllowed is a request allowed by the limits
+	OutcomeAllowed = "allowed"
+	// OutcomeDenied is a request rejected by a limit or a block
+	OutcomeDenied = "denied"
+	// OutcomeErrored is a request the limiter could not check, because the API key is
+	// invalid or the storage failed, even when the failure mode allowed it
+	OutcomeErrored = "errored"
+)
+
+// Limits deciding a rate limit check recorded by Metrics
+const (
+	// LimitRate is the rate limit of a policy, along with its quotas, blocks and access lists
+	LimitRate = "rate"
+	// LimitConcurrency is the concurrency limit of a policy
+	LimitConcurrency = "concurrency"
+)
+
+// DefaultPolicy is the policy of the requests no route policy matched
+const DefaultPolicy = "default"
+
+// Metrics records the outcome of the rate limit checks
+type Metrics interface {
+	// ObserveDecision records a check of an IP or token, keyType "ip" or "token", under
+	// a route policy or DefaultPolicy, by one of the Limit constants, with one of the
+	// Outcome constants
+	ObserveDecision(keyType, policy, limit, outcome string)
+	// ObserveShadowDecision records the decision of a dry run or shadow policy the same
+	// way, OutcomeDenied for the requests it would have rejected
+	ObserveShadowDecision(keyType, policy, outcome string)
 }
 
 // RateLimiter manages rate limiting logic
 type RateLimiter struct {
 	storage storage.Storage
-	config  Config
+	config  atomic.Pointer[Config]
+	tokens  TokenStore
+	metrics Metrics
+	// access holds the access lists read from the storage
+	access atomic.Pointer[accessRules]
 }
 
 // New creates a new rate limiter with the provided storage and configuration
 func New(storage storage.Storage, config Config) *RateLimiter {
-	return &RateLimiter{
+	rl := &RateLimiter{
 		storage: storage,
-		config:  config,
 	}
+	rl.SetConfig(config)
+	return rl
+}
+
+// Config returns the configuration in effect
+func (rl *RateLimiter) Config() Config {
+	return *rl.config.Load()
+}
+
+// SetConfig replaces the configuration atomically, requests being checked keep
+// the configuration they started with and the following ones use the new one
+func (rl *RateLimiter) SetConfig(config Config) {
+	config.access = newAccessRules(config.Access.AllowIPs, config.Access.DenyIPs, config.Access.AllowTokens, config.Access.DenyTokens)
+	rl.config.Store(&config)
+}
+
+// SetTokenStore makes the limiter resolve API keys through the token registry,
+// limiting each key by its plan and rejecting the keys the registry does not
+// accept with ErrInvalidToken. It must be called before the limiter is used.
+func (rl *RateLimiter) SetTokenStore(store TokenStore) {
+	rl.tokens = store
+}
+
+// SetMetrics makes the limiter record the outcome of every check. It must be called
+// before the limiter is used.
+func (rl *RateLimiter) SetMetrics(metrics Metrics) {
+	rl.metrics = metrics
 }
 
 // Allow checks if a request is allowed based on IP and token
-func (rl *RateLimiter) Allow(ctx context.Context, ip string, token string) (bool, error) {
-	// First check if IP or token is blocked
-	ipBlocked, err := rl.storage.IsBlocked(ctx, "ip:"+ip)
-	if err != nil {
-		return false, err
+func (rl *RateLimiter) Allow(ctx context.Context, ip string, token string) (Decision, error) {
+	ctx, span := tracer.Start(ctx, "limiter.Allow")
+	defer span.End()
+
+	// Use the same configuration for the whole check, even if it is replaced meanwhile
+	cfg := rl.config.Load()
+
+	if decision, decided, err := rl.checkAccess(ctx, cfg, ip, token); decided {
+		rl.observe(ctx, token, DefaultPolicy, decision, err)
+		return decision, err
+	}
+	return rl.allow(ctx, cfg, requestCost(ctx, 1), ip, token)
+}
+
+// allow checks the IP or token limit of a request no route policy applies to
+func (rl *RateLimiter) allow(ctx context.Context, cfg *Config, cost int, ip string, token string) (Decision, error) {
+	var (
+		decision Decision
+		err      error
+	)
+	if token != "" {
+		// If token is provided, check token limit
+		decision, err = rl.checkTokenLimit(ctx, cfg, cost, token, ip)
+	} else {
+		// If no token, check IP limit
+		decision, err = rl.checkIPLimit(ctx, cfg, cost, ip)
+	}
+	rl.observe(ctx, token, DefaultPolicy, decision, err)
+	return decision, err
+}
+
+// AllowRoute checks if a request to a route is allowed based on IP and token. When a
+// route policy matches the method and the chi route pattern, the request is limited
+// by it with counters and blocks of its own, otherwise it is checked as by Allow. The
+// request costs the cost of the context, the route cost or 1, in this order.
+func (rl *RateLimiter) AllowRoute(ctx context.Context, method, pattern, ip, token string) (Decision, error) {
+	ctx, span := tracer.Start(ctx, "limiter.Allow", trace.WithAttributes(
+		attribute.String("http.request.method", method),
+		attribute.String("http.route", pattern),
+	))
+	defer span.End()
+
+	cfg := rl.config.Load()
+
+	// The access lists apply to every route
+	if decision, decided, err := rl.checkAccess(ctx, cfg, ip, token); decided {
+		rl.observe(ctx, token, DefaultPolicy, decision, err)
+		return decision, err
 	}
 
-	if ipBlocked {
-		return false, nil
+	cost := requestCost(ctx, cfg.cost(method, pattern))
+	name, route, found := cfg.route(method, pattern)
+	if !found {
+		return rl.allow(ctx, cfg, cost, ip, token)
 	}
 
-	// If token is provided, check if it's blocked
+	// Tokens share the route policy, but still block the IP on the route when exceeded
+	ipKey := RouteKey(name, IPKey(ip))
+	var (
+		decision Decision
+		err      error
+	)
 	if token != "" {
-		tokenBlocked, err := rl.storage.IsBlocked(ctx, "token:"+token)
-		if err != nil {
-			return false, err
+		var id string
+		if id, _, err = rl.resolveToken(ctx, cfg, token); err == nil {
+			var linked []string
+			if ip != "" {
+				linked = append(linked, ipKey)
+			}
+			decision, err = rl.take(ctx, cfg, "token", RouteKey(name, TokenKey(id)), cost, route.LimiterConfig, linked...)
 		}
+	} else {
+		decision, err = rl.take(ctx, cfg, "ip", ipKey, cost, route.LimiterConfig)
+	}
+	rl.observe(ctx, token, name, decision, err)
+	if err != nil {
+		return Decision{}, err
+	}
 
-		if tokenBlocked {
-			return false, nil
-		}
+	decision.Route = name
+	if decision.Shadow != nil {
+		decision.Shadow.Route = name
+	}
+	return decision, nil
+}
 
-		// If token provided and not blocked, check token limit
-		return rl.checkTokenLimit(ctx, token, ip)
+// observe records the outcome of a check in the metrics and in the span of the check
+func (rl *RateLimiter) observe(ctx context.Context, token, policy string, decision Decision, err error) {
+	keyType := "ip"
+	if token != "" {
+		keyType = "token"
+	}
+	limit := LimitRate
+	if decision.Concurrency {
+		limit = LimitConcurrency
+	}
+	outcome := OutcomeDenied
+	switch {
+	case errors.Is(err, ErrDenied):
+	case err != nil || decision.Degraded:
+		outcome = OutcomeErrored
+	case decision.Allowed:
+		outcome = OutcomeAllowed
 	}
 
-	// If no token, check IP limit
-	return rl.checkIPLimit(ctx, ip)
-}
+	if rl.metrics != nil {
+		rl.metrics.ObserveDecision(keyType, policy, limit, outcome)
+	}
 
-// checkIPLimit checks if the IP has exceeded its limit
-func (rl *RateLimiter) checkIPLimit(ctx context.Context, ip string) (bool, error) {
-	ipKey := "ip:" + ip
-	count, err := rl.storage.Increment(ctx, ipKey, rl.config.IP.RateWindow)
+	attributes := []attribute.KeyValue{
+		attribute.String("rate_limiter.key_type", keyType),
+		attribute.String("rate_limiter.policy", policy),
+		attribute.String("rate_limiter.limit", limit),
+		attribute.String("rate_limiter.decision", outcome),
+	}
+	decisionCounter.Add(ctx, 1, metric.WithAttributes(attributes...))
+
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attributes...)
+	if decision.Degraded {
+		span.SetAttributes(attribute.Bool("rate_limiter.degraded", true))
+	}
+	if decision.Shadow != nil {
+		rl.observeShadow(ctx, keyType, policy, *decision.Shadow)
+	}
 	if err != nil {
-		return false, err
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
 	}
+}
 
-	// If IP exceeds rate limit, block it
-	if count > rl.config.IP.RateLimit {
-		err = rl.storage.Block(ctx, ipKey, rl.config.IP.BlockDuration)
-		if err != nil {
-			return false, err
-		}
-		return false, nil
+// observeShadow records the decision of a dry run or shadow policy in the metrics, in the
+// span of the check and, when it would have rejected the request, in the log
+func (rl *RateLimiter) observeShadow(ctx context.Context, keyType, policy string, shadow Decision) {
+	outcome := OutcomeAllowed
+	if !shadow.Allowed {
+		outcome = OutcomeDenied
+		log.Printf("Shadow rate limit would reject %s under the %s policy", strings.TrimPrefix(shadow.Key, ShadowKey("")), policy)
 	}
 
-	return true, nil
+	if rl.metrics != nil {
+		rl.metrics.ObserveShadowDecision(keyType, policy, outcome)
+	}
+	shadowDecisionCounter.Add(ctx, 1, metric.WithAttributes(
+		attribute.String("rate_limiter.key_type", keyType),
+		attribute.String("rate_limiter.policy", policy),
+		attribute.String("rate_limiter.decision", outcome),
+	))
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("rate_limiter.shadow.decision", outcome))
 }
 
-// checkTokenLimit checks if the token has exceeded its limit
-func (rl *RateLimiter) checkTokenLimit(ctx context.Context, token, ip string) (bool, error) {
-	tokenKey := "token:" + token
+// checkIPLimit checks if the IP is blocked or has exceeded its limit, blocking it in the latter case
+func (rl *RateLimiter) checkIPLimit(ctx context.Context, cfg *Config, cost int, ip string) (Decision, error) {
+	return rl.take(ctx, cfg, "ip", IPKey(ip), cost, cfg.IP)
+}
 
-	// Check if this token has specific configurations
-	tokenConfig, hasCustomConfig := rl.config.Token[token]
+// checkTokenLimit checks if the token or the IP is blocked or the token has exceeded its limit,
+// blocking both token and IP in the latter case. Without an IP only the token is checked.
+func (rl *RateLimiter) checkTokenLimit(ctx context.Context, cfg *Config, cost int, token, ip string) (Decision, error) {
+	id, limiterConfig, err := rl.resolveToken(ctx, cfg, token)
+	if err != nil {
+		return Decision{}, err
+	}
 
-	// Determine which rate limit to use
-	rateLimit := rl.config.IP.RateLimit
-	rateWindow := rl.config.IP.RateWindow
-	blockDuration := rl.config.IP.BlockDuration
+	if ip == "" {
+		return rl.take(ctx, cfg, "token", TokenKey(id), cost, limiterConfig)
+	}
+	return rl.take(ctx, cfg, "token", TokenKey(id), cost, limiterConfig, IPKey(ip))
+}
 
-	if hasCustomConfig {
-		rateLimit = tokenConfig.RateLimit
-		rateWindow = tokenConfig.RateWindow
-		blockDuration = tokenConfig.BlockDuration
+// resolveToken returns the identifier the counters of a token are kept under and
+// the configuration that limits it. Without a token registry the token is its own
+// identifier and is limited by its TOKEN configuration, otherwise by the plan of
+// its key. Both fall back to the IP configuration.
+func (rl *RateLimiter) resolveToken(ctx context.Context, cfg *Config, token string) (string, config.LimiterConfig, error) {
+	if rl.tokens == nil {
+		if tokenConfig, hasCustomConfig := cfg.Token[token]; hasCustomConfig {
+			return token, tokenConfig, nil
+		}
+		return token, cfg.IP, nil
 	}
 
-	count, err := rl.storage.Increment(ctx, tokenKey, rateWindow)
+	registered, err := rl.tokens.Lookup(ctx, token)
+	if errors.Is(err, tokens.ErrNotFound) || errors.Is(err, tokens.ErrExpired) || errors.Is(err, tokens.ErrRevoked) {
+		return "", config.LimiterConfig{}, fmt.Errorf("%w: %w", ErrInvalidToken, err)
+	}
 	if err != nil {
-		return false, err
+		return "", config.LimiterConfig{}, err
 	}
 
-	// If token exceeds rate limit, block both token and IP
-	if count > rateLimit {
-		err = rl.storage.Block(ctx, tokenKey, blockDuration)
-		if err != nil {
-			return false, err
+	if planConfig, hasPlan := cfg.Plan[registered.Plan]; hasPlan {
+		return registered.ID, planConfig, nil
+	}
+	return registered.ID, cfg.IP, nil
+}
+
+// KeyFor returns the key the requests to a route are counted under, the Key of the
+// decisions AllowRoute returns for them when they are not in an access list
+func (rl *RateLimiter) KeyFor(ctx context.Context, method, pattern, ip, token string) (string, error) {
+	_, _, key, _, err := rl.policyFor(ctx, rl.config.Load(), method, pattern, ip, token)
+	return key, err
+}
+
+// policyFor returns the policy, the route policy name, the key and the configuration a
+// request is limited by, the same AllowRoute applies to it
+func (rl *RateLimiter) policyFor(ctx context.Context, cfg *Config, method, pattern, ip, token string) (string, string, string, config.LimiterConfig, error) {
+	name, route, found := cfg.route(method, pattern)
+	if token == "" {
+		if found {
+			return "ip", name, RouteKey(name, IPKey(ip)), route.LimiterConfig, nil
 		}
+		return "ip", "", IPKey(ip), cfg.IP, nil
+	}
 
-		err = rl.storage.Block(ctx, "ip:"+ip, blockDuration)
-		if err != nil {
-			return false, err
+	id, limiterConfig, err := rl.resolveToken(ctx, cfg, token)
+	if err != nil {
+		return "", "", "", config.LimiterConfig{}, err
+	}
+	if found {
+		return "token", name, RouteKey(name, TokenKey(id)), route.LimiterConfig, nil
+	}
+	return "token", "", TokenKey(id), limiterConfig, nil
+}
+
+// take registers the request for key with the policy, evaluating its shadow policy
+// along with it. A dry run policy is only evaluated as a shadow policy.
+func (rl *RateLimiter) take(ctx context.Context, cfg *Config, policy, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Decision, error) {
+	if limiterConfig.DryRun {
+		limiterConfig.DryRun = false
+		shadow := rl.takeShadow(ctx, cfg, policy, key, cost, limiterConfig, linked)
+		return Decision{Allowed: true, Policy: policy, Key: key, DryRun: true, Shadow: shadow, Cost: cost}, nil
+	}
+
+	decision, err := rl.takeLimit(ctx, cfg, policy, key, cost, limiterConfig, linked...)
+	if err == nil && limiterConfig.Shadow != nil {
+		decision.Shadow = rl.takeShadow(ctx, cfg, policy, key, cost, *limiterConfig.Shadow, linked)
+	}
+	return decision, err
+}
+
+// takeShadow evaluates a shadow policy with counters and blocks of its own, so it never
+// affects the enforced policies. Storage failures are logged and leave it unevaluated.
+func (rl *RateLimiter) takeShadow(ctx context.Context, cfg *Config, policy, key string, cost int, limiterConfig config.LimiterConfig, linked []string) *Decision {
+	shadowLinked := make([]string, len(linked))
+	for i, linkedKey := range linked {
+		shadowLinked[i] = ShadowKey(linkedKey)
+	}
+
+	// Report the storage failures instead of allowing the request as degraded
+	closed := *cfg
+	closed.FailureMode = config.FailureModeClosed
+	decision, err := rl.takeLimit(ctx, &closed, policy, ShadowKey(key), cost, limiterConfig, shadowLinked...)
+	if err != nil {
+		if ctx.Err() == nil {
+			log.Printf("Failed to evaluate the shadow policy of %s: %v", key, err)
 		}
+		return nil
+	}
+	return &decision
+}
+
+// takeLimit registers the request for key in the storage and turns its result into a decision
+func (rl *RateLimiter) takeLimit(ctx context.Context, cfg *Config, policy, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Decision, error) {
+	now := time.Now()
+	limit, window := limiterConfig.Quota()
 
-		return false, nil
+	result, err := rl.storage.Take(ctx, key, cost, limiterConfig, linked...)
+	if err != nil {
+		return rl.storageFailure(ctx, cfg, err, Decision{Policy: policy, Key: key, Limit: limit, Window: window, Cost: cost})
 	}
 
-	return true, nil
+	decision := Decision{
+		Allowed:   result.Allowed,
+		Policy:    policy,
+		Key:       key,
+		Limit:     limit,
+		Window:    window,
+		Remaining: result.Remaining,
+		ResetAt:   now.Add(result.ResetAfter),
+		Cost:      cost,
+	}
+	if result.BlockedKey != "" {
+		decision.Key = result.BlockedKey
+	}
+	if !result.Allowed {
+		decision.BlockedUntil = now.Add(result.RetryAfter)
+	}
+
+	// Requests rejected by the rate limit are not counted in the quotas
+	if result.Allowed && len(limiterConfig.Quotas) > 0 {
+		return rl.takeQuotas(ctx, cfg, key, cost, limiterConfig.Quotas, decision)
+	}
+	return decision, nil
+}
+
+// storageFailure decides a request the storage failed to check, allowing it with the
+// degraded decision when the failure mode is open
+func (rl *RateLimiter) storageFailure(ctx context.Context, cfg *Config, err error, degraded Decision) (Decision, error) {
+	// Invalid configurations and abandoned requests are not storage outages
+	if errors.Is(err, ErrUnknownAlgorithm) || ctx.Err() != nil {
+		return Decision{}, err
+	}
+	if cfg.FailureMode == config.FailureModeOpen {
+		degraded.Allowed = true
+		degraded.Degraded = true
+		return degraded, nil
+	}
+	return Decision{}, fmt.Errorf("%w: %w", ErrStorageUnavailable, err)
+}
+
+// IPKey returns the storage key of an IP
+func IPKey(ip string) string {
+	return "ip:" + ip
+}
+
+// TokenKey returns the storage key of a token
+func TokenKey(token string) string {
+	return "token:" + token
+}
+
+// RouteKey returns the storage key of an IP or token key on a route policy
+func RouteKey(route, key string) string {
+	return "route:" + route + ":" + key
+}
+
+// ShadowKey returns the storage key of a key evaluated by a dry run or shadow policy
+func ShadowKey(key string) string {
+	return "shadow:" + key
+}
+
+// QuotaKey returns the storage key counting the requests of a key in the calendar
+// period starting at start
+func QuotaKey(key, period string, start time.Time) string {
+	return key + ":quota:" + period + ":" + start.Format("2006-01-02T15:04")
+}
+
+// ParseKey returns the policy and the key type, "ip" or "token", of a storage key built
+// by IPKey, TokenKey or RouteKey, the policy is DefaultPolicy for the keys outside the
+// route policies. It reports false for keys the limiter does not build.
+func ParseKey(key string) (string, string, bool) {
+	policy := DefaultPolicy
+	if rest, found := strings.CutPrefix(key, "route:"); found {
+		if policy, key, found = strings.Cut(rest, ":"); !found {
+			return "", "", false
+		}
+	}
+
+	keyType, _, found := strings.Cut(key, ":")
+	if !found || (keyType != "ip" && keyType != "token") {
+		return "", "", false
+	}
+	return policy, keyType, true
 }
 
 // Close closes the underlying storage
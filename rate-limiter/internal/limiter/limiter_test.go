@@ -2,17 +2,20 @@ package limiter_test
 
 import (
 	"context"
+	"errors"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/felipeosantos/goexpert/rate-limiter/config"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
 )
 
 func TestRateLimiter(t *testing.T) {
 	// Create a memory storage for testing
-	store := storage.NewMemoryStorage()
+	store := storage.NewMemoryStorage(config.StorageConfig{})
 
 	// Import config package for TokenConfig
 	customTokenConfigs := map[string]config.LimiterConfig{
@@ -49,21 +52,21 @@ func TestRateLimiter(t *testing.T) {
 
 		// First three requests should be allowed
 		for i := 0; i < 3; i++ {
-			allowed, err := rl.Allow(context.Background(), ip, "")
+			decision, err := rl.Allow(context.Background(), ip, "")
 			if err != nil {
 				t.Fatalf("Error checking rate limit: %v", err)
 			}
-			if !allowed {
+			if !decision.Allowed {
 				t.Errorf("Request %d should be allowed", i+1)
 			}
 		}
 
 		// Fourth request should be blocked
-		allowed, err := rl.Allow(context.Background(), ip, "")
+		decision, err := rl.Allow(context.Background(), ip, "")
 		if err != nil {
 			t.Fatalf("Error checking rate limit: %v", err)
 		}
-		if allowed {
+		if decision.Allowed {
 			t.Errorf("Request should be blocked after exceeding limit")
 		}
 	})
@@ -75,21 +78,21 @@ func TestRateLimiter(t *testing.T) {
 
 		// First three requests should be allowed
 		for i := 0; i < 3; i++ {
-			allowed, err := rl.Allow(context.Background(), ip, token)
+			decision, err := rl.Allow(context.Background(), ip, token)
 			if err != nil {
 				t.Fatalf("Error checking rate limit: %v", err)
 			}
-			if !allowed {
+			if !decision.Allowed {
 				t.Errorf("Request %d should be allowed", i+1)
 			}
 		}
 
 		// Fourth request should be blocked
-		allowed, err := rl.Allow(context.Background(), ip, token)
+		decision, err := rl.Allow(context.Background(), ip, token)
 		if err != nil {
 			t.Fatalf("Error checking rate limit: %v", err)
 		}
-		if allowed {
+		if decision.Allowed {
 			t.Errorf("Request should be blocked after exceeding token limit")
 		}
 	})
@@ -106,11 +109,11 @@ func TestRateLimiter(t *testing.T) {
 
 		// Now use the token - should still have full token limit
 		for i := 0; i < 10; i++ {
-			allowed, err := rl.Allow(context.Background(), ip, token)
+			decision, err := rl.Allow(context.Background(), ip, token)
 			if err != nil {
 				t.Fatalf("Error checking rate limit: %v", err)
 			}
-			if !allowed {
+			if !decision.Allowed {
 				t.Errorf("Request %d with token should be allowed despite IP usage", i+1)
 			}
 		}
@@ -125,21 +128,21 @@ func TestRateLimiter(t *testing.T) {
 
 			// First 10 requests should be allowed (custom limit)
 			for i := 0; i < 10; i++ {
-				allowed, err := rl.Allow(context.Background(), ip, token)
+				decision, err := rl.Allow(context.Background(), ip, token)
 				if err != nil {
 					t.Fatalf("Error checking rate limit: %v", err)
 				}
-				if !allowed {
+				if !decision.Allowed {
 					t.Errorf("Request %d should be allowed for premium token", i+1)
 				}
 			}
 
 			// 11th request should be blocked
-			allowed, err := rl.Allow(context.Background(), ip, token)
+			decision, err := rl.Allow(context.Background(), ip, token)
 			if err != nil {
 				t.Fatalf("Error checking rate limit: %v", err)
 			}
-			if allowed {
+			if decision.Allowed {
 				t.Errorf("Request should be blocked after exceeding custom token limit")
 			}
 		})
@@ -151,23 +154,324 @@ func TestRateLimiter(t *testing.T) {
 
 			// First 3 requests should be allowed (custom limit)
 			for i := 0; i < 3; i++ {
-				allowed, err := rl.Allow(context.Background(), ip, token)
+				decision, err := rl.Allow(context.Background(), ip, token)
 				if err != nil {
 					t.Fatalf("Error checking rate limit: %v", err)
 				}
-				if !allowed {
+				if !decision.Allowed {
 					t.Errorf("Request %d should be allowed for basic token", i+1)
 				}
 			}
 
 			// 4th request should be blocked
-			allowed, err := rl.Allow(context.Background(), ip, token)
+			decision, err := rl.Allow(context.Background(), ip, token)
 			if err != nil {
 				t.Fatalf("Error checking rate limit: %v", err)
 			}
-			if allowed {
+			if decision.Allowed {
 				t.Errorf("Request should be blocked after exceeding custom token limit")
 			}
 		})
 	})
 }
+
+func TestRateLimiterAlgorithms(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:     2,
+			RateWindow:    time.Second,
+			BlockDuration: time.Minute,
+			Algorithm:     config.AlgorithmSlidingWindowCounter,
+		},
+		Token: map[string]config.LimiterConfig{
+			"log-token": {
+				RateLimit:     2,
+				RateWindow:    time.Second,
+				BlockDuration: time.Minute,
+				Algorithm:     config.AlgorithmSlidingWindowLog,
+			},
+			"token-bucket-token": {
+				RefillRate:    1,
+				Burst:         2,
+				BlockDuration: time.Minute,
+				Algorithm:     config.AlgorithmTokenBucket,
+			},
+			"leaky-bucket-token": {
+				RateLimit:     2,
+				RateWindow:    time.Minute,
+				BlockDuration: time.Minute,
+				Algorithm:     config.AlgorithmLeakyBucket,
+			},
+			"unknown-token": {
+				RateLimit:     2,
+				RateWindow:    time.Second,
+				BlockDuration: time.Minute,
+				Algorithm:     "unknown",
+			},
+		},
+	})
+
+	tests := []struct {
+		name  string
+		ip    string
+		token string
+	}{
+		{name: "Sliding window counter for IP", ip: "192.168.2.1"},
+		{name: "Sliding window log for token", ip: "192.168.2.2", token: "log-token"},
+		{name: "Token bucket for token", ip: "192.168.2.4", token: "token-bucket-token"},
+		{name: "Leaky bucket for token", ip: "192.168.2.5", token: "leaky-bucket-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 2; i++ {
+				decision, err := rl.Allow(context.Background(), tt.ip, tt.token)
+				if err != nil {
+					t.Fatalf("Error checking rate limit: %v", err)
+				}
+				if !decision.Allowed {
+					t.Errorf("Request %d should be allowed", i+1)
+				}
+			}
+
+			decision, err := rl.Allow(context.Background(), tt.ip, tt.token)
+			if err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+			if decision.Allowed {
+				t.Errorf("Request should be blocked after exceeding limit")
+			}
+		})
+	}
+
+	t.Run("Unknown algorithm", func(t *testing.T) {
+		_, err := rl.Allow(context.Background(), "192.168.2.3", "unknown-token")
+		if err != limiter.ErrUnknownAlgorithm {
+			t.Errorf("Expected %v, got %v", limiter.ErrUnknownAlgorithm, err)
+		}
+	})
+}
+
+func TestRateLimiterDecision(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:     5,
+			RateWindow:    time.Second,
+			BlockDuration: time.Minute,
+		},
+		Token: map[string]config.LimiterConfig{
+			"abc": {
+				RateLimit:     1,
+				RateWindow:    10 * time.Second,
+				BlockDuration: 30 * time.Second,
+			},
+		},
+	})
+
+	ip := "192.168.3.1"
+
+	decision, err := rl.Allow(context.Background(), ip, "abc")
+	if err != nil {
+		t.Fatalf("Error checking rate limit: %v", err)
+	}
+	if decision.Policy != "token" || decision.Key != "token:abc" {
+		t.Errorf("Expected token policy on token:abc, got %s on %s", decision.Policy, decision.Key)
+	}
+	if decision.Limit != 1 || decision.Window != 10*time.Second || decision.Remaining != 0 {
+		t.Errorf("Expected limit 1 per 10s with 0 remaining, got %d per %v with %d remaining", decision.Limit, decision.Window, decision.Remaining)
+	}
+	if !decision.BlockedUntil.IsZero() {
+		t.Errorf("Allowed request should not be blocked, got %v", decision.BlockedUntil)
+	}
+
+	// Exceeding the token limit blocks the token and the IP
+	decision, err = rl.Allow(context.Background(), ip, "abc")
+	if err != nil {
+		t.Fatalf("Error checking rate limit: %v", err)
+	}
+	if decision.Allowed || decision.Key != "token:abc" {
+		t.Errorf("Expected token:abc to be blocked, got allowed %v on %s", decision.Allowed, decision.Key)
+	}
+	if until := time.Until(decision.BlockedUntil); until <= 29*time.Second || until > 30*time.Second {
+		t.Errorf("Expected token:abc to be blocked for 30s, got %v", until)
+	}
+
+	// The IP request is rejected by the IP block
+	decision, err = rl.Allow(context.Background(), ip, "")
+	if err != nil {
+		t.Fatalf("Error checking rate limit: %v", err)
+	}
+	if decision.Allowed || decision.Policy != "ip" || decision.Key != "ip:"+ip {
+		t.Errorf("Expected ip:%s to be blocked, got allowed %v on %s", ip, decision.Allowed, decision.Key)
+	}
+}
+
+func TestRateLimiterSetConfig(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:  1,
+			RateWindow: time.Minute,
+		},
+	})
+
+	allow := func(t *testing.T, token string) limiter.Decision {
+		t.Helper()
+		decision, err := rl.Allow(context.Background(), "192.168.5.1", token)
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		return decision
+	}
+
+	if decision := allow(t, "abc"); !decision.Allowed || decision.Limit != 1 {
+		t.Fatalf("Expected token abc to use the IP limit of 1, got %+v", decision)
+	}
+
+	// The new token policy applies to the following requests without recreating the limiter
+	rl.SetConfig(limiter.Config{
+		IP: rl.Config().IP,
+		Token: map[string]config.LimiterConfig{
+			"abc": {RateLimit: 3, RateWindow: time.Minute},
+		},
+	})
+
+	if decision := allow(t, "abc"); !decision.Allowed || decision.Limit != 3 || decision.Remaining != 1 {
+		t.Errorf("Expected token abc to use the new limit of 3 with 1 remaining, got %+v", decision)
+	}
+	if decision := allow(t, ""); !decision.Allowed || decision.Limit != 1 || decision.Remaining != 0 {
+		t.Errorf("Expected the IP limit of 1 to be kept, got %+v", decision)
+	}
+}
+
+func TestRateLimiterTokenStore(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+
+	registry, err := tokens.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("Error opening token registry: %v", err)
+	}
+	pro, proKey, err := registry.Create("acme", "pro", time.Time{})
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	_, freeKey, err := registry.Create("globex", "free", time.Time{})
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:  1,
+			RateWindow: time.Minute,
+		},
+		Plan: map[string]config.LimiterConfig{
+			"pro": {RateLimit: 10, RateWindow: time.Minute},
+		},
+	})
+	rl.SetTokenStore(registry)
+
+	t.Run("Plan", func(t *testing.T) {
+		decision, err := rl.Allow(context.Background(), "192.168.7.1", proKey)
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if !decision.Allowed || decision.Limit != 10 || decision.Key != "token:"+pro.ID {
+			t.Errorf("Expected the pro plan limit of 10 on token:%s, got %+v", pro.ID, decision)
+		}
+	})
+
+	t.Run("Plan without configuration uses the IP limit", func(t *testing.T) {
+		decision, err := rl.Allow(context.Background(), "192.168.7.1", freeKey)
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if !decision.Allowed || decision.Limit != 1 {
+			t.Errorf("Expected the IP limit of 1, got %+v", decision)
+		}
+	})
+
+	t.Run("Unknown key", func(t *testing.T) {
+		_, err := rl.Allow(context.Background(), "192.168.7.1", "rl_unknown")
+		if !errors.Is(err, limiter.ErrInvalidToken) || !errors.Is(err, tokens.ErrNotFound) {
+			t.Errorf("Expected ErrInvalidToken for an unknown key, got %v", err)
+		}
+	})
+
+	t.Run("Revoked key", func(t *testing.T) {
+		if _, err := registry.Revoke(pro.ID); err != nil {
+			t.Fatalf("Error revoking token: %v", err)
+		}
+		_, err := rl.Allow(context.Background(), "192.168.7.1", proKey)
+		if !errors.Is(err, limiter.ErrInvalidToken) || !errors.Is(err, tokens.ErrRevoked) {
+			t.Errorf("Expected ErrInvalidToken for a revoked key, got %v", err)
+		}
+	})
+}
+
+// unavailableStorage is a storage whose Take always fails, as when Redis is down
+type unavailableStorage struct {
+	storage.Storage
+}
+
+func (unavailableStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	return storage.Result{}, errors.New("connection refused")
+}
+
+func TestRateLimiterFailureMode(t *testing.T) {
+	store := unavailableStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+	ipConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute}
+
+	t.Run("Fail closed", func(t *testing.T) {
+		rl := limiter.New(store, limiter.Config{IP: ipConfig, FailureMode: config.FailureModeClosed})
+
+		_, err := rl.Allow(context.Background(), "192.168.9.1", "")
+		if !errors.Is(err, limiter.ErrStorageUnavailable) {
+			t.Errorf("Expected ErrStorageUnavailable, got %v", err)
+		}
+	})
+
+	t.Run("Fail open", func(t *testing.T) {
+		rl := limiter.New(store, limiter.Config{IP: ipConfig, FailureMode: config.FailureModeOpen})
+
+		for i := 0; i < 3; i++ {
+			decision, err := rl.Allow(context.Background(), "192.168.9.1", "")
+			if err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+			if !decision.Allowed || !decision.Degraded {
+				t.Errorf("Request %d should be allowed as degraded, got %+v", i+1, decision)
+			}
+		}
+	})
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key     string
+		policy  string
+		keyType string
+		ok      bool
+	}{
+		{key: limiter.IPKey("192.168.1.1"), policy: limiter.DefaultPolicy, keyType: "ip", ok: true},
+		{key: limiter.TokenKey("abc"), policy: limiter.DefaultPolicy, keyType: "token", ok: true},
+		{key: limiter.RouteKey("login", limiter.IPKey("2001:db8::1")), policy: "login", keyType: "ip", ok: true},
+		{key: limiter.RouteKey("login", limiter.TokenKey("abc")), policy: "login", keyType: "token", ok: true},
+		{key: "route:login"},
+		{key: "session:abc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			policy, keyType, ok := limiter.ParseKey(tt.key)
+			if policy != tt.policy || keyType != tt.keyType || ok != tt.ok {
+				t.Errorf("Expected %q %q %v, got %q %q %v", tt.policy, tt.keyType, tt.ok, policy, keyType, ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package limiter
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+)
+
+// QuotaUsage is the state of a quota of a token in the current calendar period
+type QuotaUsage struct {
+	// Period is the calendar period of the quota, one of config.QuotaPeriods
+	Period string
+	// Limit is how many requests the quota allows in the period
+	Limit int
+	// Used is how many requests were counted in the period, up to Limit
+	Used int
+	// Remaining is how many requests are still allowed in the period
+	Remaining int
+	// ResetAt is when the period ends and the quota is restored
+	ResetAt time.Time
+}
+
+// takeQuotas counts the cost of an allowed request in the quotas stacked on its rate limit,
+// from the shortest period to the longest, and rejects it as soon as one of them is exhausted,
+// refunding the cost to the quotas it was counted in, so a rejected request uses none of them.
+// Otherwise the decision describes the limit with the fewest requests remaining.
+func (rl *RateLimiter) takeQuotas(ctx context.Context, cfg *Config, key string, cost int, quotas map[string]int, decision Decision) (Decision, error) {
+	now := time.Now()
+	var charged []string
+	for _, period := range config.QuotaPeriods {
+		limit, found := quotas[period]
+		if !found {
+			continue
+		}
+
+		start, end := periodBounds(period, now, cfg.location())
+		quotaKey := QuotaKey(key, period, start)
+		count, err := rl.storage.IncrementBy(ctx, quotaKey, cost, end.Sub(now))
+		if err != nil {
+			rl.refundQuotas(ctx, charged, cost)
+			return rl.storageFailure(ctx, cfg, err, Decision{Policy: decision.Policy, Key: key, Limit: decision.Limit, Window: decision.Window, Cost: cost})
+		}
+		charged = append(charged, quotaKey)
+
+		if count > limit {
+			rl.refundQuotas(ctx, charged, cost)
+			return Decision{
+				Policy:       decision.Policy,
+				Quota:        period,
+				Key:          quotaKey,
+				Limit:        limit,
+				Window:       end.Sub(start),
+				ResetAt:      end,
+				BlockedUntil: end,
+				Cost:         cost,
+			}, nil
+		}
+		if remaining := limit - count; remaining < decision.Remaining {
+			decision.Quota = period
+			decision.Limit = limit
+			decision.Window = end.Sub(start)
+			decision.Remaining = remaining
+			decision.ResetAt = end
+		}
+	}
+	return decision, nil
+}
+
+// refundQuotas takes the cost of a rejected request back from the quotas it was counted in,
+// logging the failures since the request is rejected either way
+func (rl *RateLimiter) refundQuotas(ctx context.Context, quotaKeys []string, cost int) {
+	ctx = context.WithoutCancel(ctx)
+	for _, quotaKey := range quotaKeys {
+		// The counters of the period already expire with it, and their keys are not reused
+		// by the next period, so the expiration only matters if the period ended meanwhile
+		if _, err := rl.storage.IncrementBy(ctx, quotaKey, -cost, time.Minute); err != nil {
+			log.Printf("Failed to refund the quota %s: %v", quotaKey, err)
+		}
+	}
+}
+
+// Quotas returns the usage of the quotas of a token outside the route policies, without
+// counting a request. It fails with ErrInvalidToken for the API keys the token registry
+// does not accept.
+func (rl *RateLimiter) Quotas(ctx context.Context, token string) ([]QuotaUsage, error) {
+	cfg := rl.config.Load()
+
+	id, limiterConfig, err := rl.resolveToken(ctx, cfg, token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	usages := make([]QuotaUsage, 0, len(limiterConfig.Quotas))
+	for _, period := range config.QuotaPeriods {
+		limit, found := limiterConfig.Quotas[period]
+		if !found {
+			continue
+		}
+
+		start, end := periodBounds(period, now, cfg.location())
+		count, err := rl.storage.Get(ctx, QuotaKey(TokenKey(id), period, start))
+		if err != nil {
+			return nil, err
+		}
+
+		used := min(count, limit)
+		usages = append(usages, QuotaUsage{
+			Period:    period,
+			Limit:     limit,
+			Used:      used,
+			Remaining: limit - used,
+			ResetAt:   end,
+		})
+	}
+	return usages, nil
+}
+
+// periodBounds returns when the calendar period containing now starts and ends in the time zone
+func periodBounds(period string, now time.Time, location *time.Location) (time.Time, time.Time) {
+	now = now.In(location)
+	year, month, day := now.Date()
+
+	switch period {
+	case config.QuotaPeriodMinute:
+		start := time.Date(year, month, day, now.Hour(), now.Minute(), 0, 0, location)
+		return start, start.Add(time.Minute)
+	case config.QuotaPeriodHour:
+		start := time.Date(year, month, day, now.Hour(), 0, 0, 0, location)
+		return start, start.Add(time.Hour)
+	case config.QuotaPeriodWeek:
+		// Weeks start on Monday
+		start := time.Date(year, month, day-(int(now.Weekday())+6)%7, 0, 0, 0, 0, location)
+		return start, start.AddDate(0, 0, 7)
+	case config.QuotaPeriodMonth:
+		start := time.Date(year, month, 1, 0, 0, 0, 0, location)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		start := time.Date(year, month, day, 0, 0, 0, 0, location)
+		return start, start.AddDate(0, 0, 1)
+	}
+}
@@ -0,0 +1,153 @@
+package limiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+func TestRateLimiterQuotas(t *testing.T) {
+	location, err := time.LoadLocation("America/Sao_Paulo")
+	if err != nil {
+		t.Fatalf("Error loading time zone: %v", err)
+	}
+
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 100, RateWindow: time.Minute},
+		Token: map[string]config.LimiterConfig{
+			"abc": {
+				RateLimit:  100,
+				RateWindow: time.Minute,
+				Quotas:     map[string]int{config.QuotaPeriodDay: 3, config.QuotaPeriodMonth: 5},
+			},
+			"burst": {
+				RateLimit:     1,
+				RateWindow:    time.Minute,
+				BlockDuration: time.Minute,
+				Quotas:        map[string]int{config.QuotaPeriodDay: 10},
+			},
+			"monthly": {
+				RateLimit:  100,
+				RateWindow: time.Minute,
+				Quotas:     map[string]int{config.QuotaPeriodDay: 10, config.QuotaPeriodMonth: 2},
+			},
+			"weekly": {
+				RateLimit:  100,
+				RateWindow: time.Minute,
+				Quotas:     map[string]int{config.QuotaPeriodWeek: 10},
+			},
+		},
+		Location: location,
+	})
+	defer rl.Close()
+
+	now := time.Now().In(location)
+	tomorrow := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, location)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, location)
+	ctx := context.Background()
+
+	t.Run("All stacked limits must pass", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			decision, err := rl.Allow(ctx, "192.168.1.1", "abc")
+			if err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+			if !decision.Allowed {
+				t.Fatalf("Request %d should be allowed", i+1)
+			}
+
+			// The day quota has the fewest requests remaining
+			if decision.Quota != config.QuotaPeriodDay || decision.Limit != 3 || decision.Remaining != 2-i {
+				t.Errorf("Request %d: expected the day quota with %d remaining, got %+v", i+1, 2-i, decision)
+			}
+		}
+
+		decision, err := rl.Allow(ctx, "192.168.1.1", "abc")
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if decision.Allowed || decision.Quota != config.QuotaPeriodDay {
+			t.Fatalf("Request should be rejected by the day quota, got %+v", decision)
+		}
+		if !decision.BlockedUntil.Equal(tomorrow) || !decision.ResetAt.Equal(tomorrow) {
+			t.Errorf("Expected the quota to reset at %v, got %v", tomorrow, decision.BlockedUntil)
+		}
+	})
+
+	t.Run("Remaining quota of a token", func(t *testing.T) {
+		usages, err := rl.Quotas(ctx, "abc")
+		if err != nil {
+			t.Fatalf("Error getting quotas: %v", err)
+		}
+
+		// The rejected request is not counted in the month quota
+		expected := []limiter.QuotaUsage{
+			{Period: config.QuotaPeriodDay, Limit: 3, Used: 3, Remaining: 0, ResetAt: tomorrow},
+			{Period: config.QuotaPeriodMonth, Limit: 5, Used: 3, Remaining: 2, ResetAt: nextMonth},
+		}
+		if len(usages) != len(expected) {
+			t.Fatalf("Expected %d quotas, got %+v", len(expected), usages)
+		}
+		for i, usage := range usages {
+			if usage.Period != expected[i].Period || usage.Limit != expected[i].Limit || usage.Used != expected[i].Used ||
+				usage.Remaining != expected[i].Remaining || !usage.ResetAt.Equal(expected[i].ResetAt) {
+				t.Errorf("Expected %+v, got %+v", expected[i], usage)
+			}
+		}
+	})
+
+	t.Run("Requests rejected by the rate limit are not counted", func(t *testing.T) {
+		rl.Allow(ctx, "192.168.1.2", "burst")
+		decision, err := rl.Allow(ctx, "192.168.1.2", "burst")
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if decision.Allowed || decision.Quota != "" {
+			t.Errorf("Request should be rejected by the rate limit, got %+v", decision)
+		}
+
+		usages, err := rl.Quotas(ctx, "burst")
+		if err != nil {
+			t.Fatalf("Error getting quotas: %v", err)
+		}
+		if len(usages) != 1 || usages[0].Used != 1 {
+			t.Errorf("Expected 1 request counted in the quota, got %+v", usages)
+		}
+	})
+
+	t.Run("Requests rejected by a longer quota are not counted in the shorter ones", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			decision, err := rl.Allow(ctx, "192.168.1.3", "monthly")
+			if err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+			if rejected := i >= 2; decision.Allowed == rejected {
+				t.Fatalf("Request %d: expected allowed %v, got %+v", i+1, !rejected, decision)
+			}
+		}
+
+		usages, err := rl.Quotas(ctx, "monthly")
+		if err != nil {
+			t.Fatalf("Error getting quotas: %v", err)
+		}
+		if len(usages) != 2 || usages[0].Used != 2 || usages[1].Used != 2 {
+			t.Errorf("Expected 2 requests counted in the day and month quotas, got %+v", usages)
+		}
+	})
+
+	t.Run("Weeks start on Monday", func(t *testing.T) {
+		usages, err := rl.Quotas(ctx, "weekly")
+		if err != nil {
+			t.Fatalf("Error getting quotas: %v", err)
+		}
+		resetAt := usages[0].ResetAt.In(location)
+		if resetAt.Weekday() != time.Monday || resetAt.Hour() != 0 || resetAt.Sub(now) > 7*24*time.Hour {
+			t.Errorf("Expected the week to end on the next Monday, got %v", resetAt)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package limiter_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+// shadowMetrics counts the shadow decisions by outcome
+type shadowMetrics map[string]int
+
+func (shadowMetrics) ObserveDecision(keyType, policy, limit, outcome string) {}
+
+func (m shadowMetrics) ObserveShadowDecision(keyType, policy, outcome string) {
+	m[outcome]++
+}
+
+func TestRateLimiterShadow(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute, DryRun: true},
+		Token: map[string]config.LimiterConfig{
+			"abc": {
+				RateLimit:  3,
+				RateWindow: time.Minute,
+				Shadow:     &config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute},
+			},
+		},
+	})
+	defer rl.Close()
+	metrics := shadowMetrics{}
+	rl.SetMetrics(metrics)
+	ctx := context.Background()
+
+	t.Run("Dry run", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			decision, err := rl.Allow(ctx, "192.168.1.1", "")
+			if err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+			if !decision.Allowed || !decision.DryRun || decision.Shadow == nil {
+				t.Fatalf("Request %d should be allowed with a shadow decision, got %+v", i+1, decision)
+			}
+			if decision.Shadow.Allowed != (i == 0) {
+				t.Errorf("Request %d: expected the dry run policy to allow only the first request, got %+v", i+1, decision.Shadow)
+			}
+		}
+
+		// The dry run policy keeps its counters and blocks apart
+		state, err := store.State(ctx, "ip:192.168.1.1")
+		if err != nil {
+			t.Fatalf("Error getting state: %v", err)
+		}
+		if len(state.Counters) != 0 || state.BlockedFor != 0 {
+			t.Errorf("Expected no counters nor block for the enforced key, got %+v", state)
+		}
+		if blocked, _ := store.IsBlocked(ctx, limiter.ShadowKey("ip:192.168.1.1")); !blocked {
+			t.Errorf("Expected the shadow key to be blocked")
+		}
+	})
+
+	t.Run("Shadow policy side by side", func(t *testing.T) {
+		for i := 0; i < 4; i++ {
+			decision, err := rl.Allow(ctx, "192.168.1.2", "abc")
+			if err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+			if decision.Allowed != (i < 3) {
+				t.Errorf("Request %d: expected the enforced policy to allow 3 requests, got %+v", i+1, decision)
+			}
+			if decision.DryRun || decision.Shadow == nil || decision.Shadow.Allowed != (i == 0) {
+				t.Errorf("Request %d: expected the shadow policy to allow only the first request, got %+v", i+1, decision.Shadow)
+			}
+		}
+
+		// The shadow block of the IP does not reach the enforced policies
+		decision, err := rl.Allow(ctx, "192.168.1.2", "")
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if !decision.Allowed {
+			t.Errorf("Expected the IP not to be blocked by the shadow policy, got %+v", decision)
+		}
+	})
+
+	t.Run("Metrics", func(t *testing.T) {
+		// The last request was denied by the dry run policy, since the shadow policy of
+		// the token blocked the shadow key of the IP
+		if metrics[limiter.OutcomeAllowed] != 2 || metrics[limiter.OutcomeDenied] != 6 {
+			t.Errorf("Expected 2 allowed and 6 denied shadow decisions, got %v", metrics)
+		}
+	})
+}
@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// blocksTimeout bounds how long a scrape waits for the storage to list the blocks
+	blocksTimeout = 5 * time.Second
+	// blocksCacheTTL is how long the blocks listed for a scrape are reported to the
+	// scrapes that follow, so the blocks are not listed on every one of them
+	blocksCacheTTL = 30 * time.Second
+)
+
+// Metrics holds the Prometheus collectors of the rate limiter. It records the
+// decisions of limiter.RateLimiter and the responses of the rate limiter middleware,
+// and instruments the storage.
+type Metrics struct {
+	registerer      prometheus.Registerer
+	decisions       *prometheus.CounterVec
+	shadowDecisions *prometheus.CounterVec
+	responses       *prometheus.CounterVec
+	storageDuration *prometheus.HistogramVec
+	storageErrors   *prometheus.CounterVec
+}
+
+// New creates the rate limiter collectors and registers them
+func New(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		registerer: registerer,
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limiter_decisions_total",
+			Help: "Rate limit checks by key type, policy, limit (rate or concurrency) and decision (allowed, denied or errored).",
+		}, []string{"key_type", "policy", "limit", "decision"}),
+		shadowDecisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limiter_shadow_decisions_total",
+			Help: "Decisions of the dry run and shadow policies by key type, policy and decision (allowed or denied).",
+		}, []string{"key_type", "policy", "decision"}),
+		responses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limiter_http_responses_total",
+			Help: "Requests handled by the rate limiter middleware by key type and status code, 200 when passed on.",
+		}, []string{"key_type", "code"}),
+		storageDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "rate_limiter_storage_duration_seconds",
+			Help:    "Latency of the storage calls by backend and operation.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 2, 15),
+		}, []string{"backend", "operation"}),
+		storageErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "rate_limiter_storage_errors_total",
+			Help: "Failed storage calls by backend and operation.",
+		}, []string{"backend", "operation"}),
+	}
+	registerer.MustRegister(m.decisions, m.shadowDecisions, m.responses, m.storageDuration, m.storageErrors)
+	return m
+}
+
+// ObserveDecision records a rate limit check, implementing limiter.Metrics
+func (m *Metrics) ObserveDecision(keyType, policy, limit, outcome string) {
+	m.decisions.WithLabelValues(keyType, policy, limit, outcome).Inc()
+}
+
+// ObserveShadowDecision records a decision of a dry run or shadow policy, implementing limiter.Metrics
+func (m *Metrics) ObserveShadowDecision(keyType, policy, outcome string) {
+	m.shadowDecisions.WithLabelValues(keyType, policy, outcome).Inc()
+}
+
+// ObserveResponse records a response of the rate limiter middleware, implementing middleware.Metrics
+func (m *Metrics) ObserveResponse(keyType string, code int) {
+	m.responses.WithLabelValues(keyType, strconv.Itoa(code)).Inc()
+}
+
+// RegisterBlocks registers the rate_limiter_active_blocks gauge, which counts the
+// blocked keys of the storage by key type and policy. The storage lists its blocks at
+// most once per blocksCacheTTL, the scrapes in between report the last count.
+func (m *Metrics) RegisterBlocks(store storage.Storage) {
+	m.registerer.MustRegister(&blocksCollector{
+		storage: store,
+		desc: prometheus.NewDesc(
+			"rate_limiter_active_blocks",
+			"Blocked IPs and tokens by key type and policy.",
+			[]string{"key_type", "policy"}, nil,
+		),
+	})
+}
+
+// blocksCollector counts the blocked keys of a storage when scraped
+type blocksCollector struct {
+	storage storage.Storage
+	desc    *prometheus.Desc
+
+	// mu makes the concurrent scrapes wait for a single listing of the storage
+	mu       sync.Mutex
+	blocks   map[blockLabels]int
+	listedAt time.Time
+}
+
+// blockLabels are the labels of the rate_limiter_active_blocks gauge
+type blockLabels struct{ keyType, policy string }
+
+// Describe implements prometheus.Collector
+func (c *blocksCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector, leaving the gauge out when the storage fails
+func (c *blocksCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.blocks == nil || time.Since(c.listedAt) >= blocksCacheTTL {
+		blocks, err := c.list()
+		if err != nil {
+			log.Printf("Error listing blocks for metrics: %v", err)
+			return
+		}
+		c.blocks, c.listedAt = blocks, time.Now()
+	}
+	for l, count := range c.blocks {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count), l.keyType, l.policy)
+	}
+}
+
+// list counts the blocked keys of the storage by key type and policy
+func (c *blocksCollector) list() (map[blockLabels]int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), blocksTimeout)
+	defer cancel()
+
+	blocked, err := c.storage.Blocks(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[blockLabels]int)
+	for key := range blocked {
+		if policy, keyType, ok := limiter.ParseKey(key); ok {
+			blocks[blockLabels{keyType, policy}]++
+		}
+	}
+	return blocks, nil
+}
+
+// RegisterMemory registers the entries, evictions and expirations of the memory
+// storages by backend, such as the STORAGE_TYPE memory storage or the fallback
+func (m *Metrics) RegisterMemory(stores map[string]*storage.MemoryStorage) {
+	m.registerer.MustRegister(&memoryCollector{
+		stores: stores,
+		entries: prometheus.NewDesc(
+			"rate_limiter_memory_entries",
+			"Keys held by the memory storage by backend.",
+			[]string{"backend"}, nil,
+		),
+		evictions: prometheus.NewDesc(
+			"rate_limiter_memory_evictions_total",
+			"Keys evicted from the memory storage to respect its size by backend.",
+			[]string{"backend"}, nil,
+		),
+		expirations: prometheus.NewDesc(
+			"rate_limiter_memory_expirations_total",
+			"Keys removed from the memory storage because all their state expired by backend.",
+			[]string{"backend"}, nil,
+		),
+	})
+}
+
+// memoryCollector reports the stats of memory storages when scraped
+type memoryCollector struct {
+	stores      map[string]*storage.MemoryStorage
+	entries     *prometheus.Desc
+	evictions   *prometheus.Desc
+	expirations *prometheus.Desc
+}
+
+// Describe implements prometheus.Collector
+func (c *memoryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.entries
+	ch <- c.evictions
+	ch <- c.expirations
+}
+
+// Collect implements prometheus.Collector
+func (c *memoryCollector) Collect(ch chan<- prometheus.Metric) {
+	for backend, store := range c.stores {
+		stats := store.Stats()
+		ch <- prometheus.MustNewConstMetric(c.entries, prometheus.GaugeValue, float64(stats.Entries), backend)
+		ch <- prometheus.MustNewConstMetric(c.evictions, prometheus.CounterValue, float64(stats.Evictions), backend)
+		ch <- prometheus.MustNewConstMetric(c.expirations, prometheus.CounterValue, float64(stats.Expirations), backend)
+	}
+}
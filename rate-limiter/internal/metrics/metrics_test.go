@@ -0,0 +1,189 @@
+package metrics_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/metrics"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// failingStorage is a storage whose Take always fails
+type failingStorage struct {
+	storage.Storage
+}
+
+func (s failingStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	return storage.Result{}, errors.New("connection refused")
+}
+
+func TestMetrics(t *testing.T) {
+	limiterConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute}
+
+	t.Run("Counts the decisions by key type, policy and limit", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		m := metrics.New(registry)
+
+		rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+			IP: limiterConfig,
+			Route: map[string]config.RouteConfig{
+				"login":  {Pattern: "/login", LimiterConfig: limiterConfig},
+				"upload": {Pattern: "/upload", LimiterConfig: config.LimiterConfig{RateLimit: 10, RateWindow: time.Minute, MaxConcurrent: 1}},
+			},
+		})
+		defer rl.Close()
+		rl.SetMetrics(m)
+
+		ctx := context.Background()
+		rl.Allow(ctx, "192.168.1.1", "")
+		rl.Allow(ctx, "192.168.1.1", "")
+		rl.Allow(ctx, "192.168.1.2", "abc")
+		rl.AllowRoute(ctx, http.MethodPost, "/login", "192.168.1.3", "")
+
+		// The second upload in flight gets no slot
+		lease, _, err := rl.AcquireRoute(ctx, http.MethodPost, "/upload", "192.168.1.4", "")
+		if err != nil {
+			t.Fatalf("Error acquiring slot: %v", err)
+		}
+		defer lease.Release()
+		if _, decision, _ := rl.AcquireRoute(ctx, http.MethodPost, "/upload", "192.168.1.4", ""); decision.Allowed {
+			t.Fatalf("Expected the second upload to get no slot")
+		}
+
+		expected := `
+# HELP rate_limiter_decisions_total Rate limit checks by key type, policy, limit (rate or concurrency) and decision (allowed, denied or errored).
+# TYPE rate_limiter_decisions_total counter
+rate_limiter_decisions_total{decision="allowed",key_type="ip",limit="rate",policy="default"} 1
+rate_limiter_decisions_total{decision="allowed",key_type="ip",limit="rate",policy="login"} 1
+rate_limiter_decisions_total{decision="allowed",key_type="token",limit="rate",policy="default"} 1
+rate_limiter_decisions_total{decision="denied",key_type="ip",limit="concurrency",policy="upload"} 1
+rate_limiter_decisions_total{decision="denied",key_type="ip",limit="rate",policy="default"} 1
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "rate_limiter_decisions_total"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Counts the middleware responses", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		m := metrics.New(registry)
+
+		rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{IP: limiterConfig})
+		defer rl.Close()
+		clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+		if err != nil {
+			t.Fatalf("Error creating client IP resolver: %v", err)
+		}
+		handler := middleware.RateLimiterMiddleware(rl, clientIP, m)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		for range 3 {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.168.1.1:1234"
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+
+		expected := `
+# HELP rate_limiter_http_responses_total Requests handled by the rate limiter middleware by key type and status code, 200 when passed on.
+# TYPE rate_limiter_http_responses_total counter
+rate_limiter_http_responses_total{code="200",key_type="ip"} 1
+rate_limiter_http_responses_total{code="429",key_type="ip"} 2
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "rate_limiter_http_responses_total"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Records the storage latency and failures", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		m := metrics.New(registry)
+
+		ctx := context.Background()
+		memory := m.InstrumentStorage(storage.NewMemoryStorage(config.StorageConfig{}), "memory")
+		defer memory.Close()
+		memory.Take(ctx, "ip:192.168.1.1", 1, limiterConfig)
+		memory.Get(ctx, "ip:192.168.1.1")
+
+		failing := m.InstrumentStorage(failingStorage{}, "redis")
+		failing.Take(ctx, "ip:192.168.1.1", 1, limiterConfig)
+
+		if count := testutil.CollectAndCount(registry, "rate_limiter_storage_duration_seconds"); count != 3 {
+			t.Errorf("Expected latency of 3 backend operations, got %d", count)
+		}
+		expected := `
+# HELP rate_limiter_storage_errors_total Failed storage calls by backend and operation.
+# TYPE rate_limiter_storage_errors_total counter
+rate_limiter_storage_errors_total{backend="redis",operation="take"} 1
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "rate_limiter_storage_errors_total"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Counts the active blocks", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		m := metrics.New(registry)
+
+		ctx := context.Background()
+		store := storage.NewMemoryStorage(config.StorageConfig{})
+		defer store.Close()
+		m.RegisterBlocks(store)
+
+		store.Block(ctx, limiter.IPKey("192.168.1.1"), time.Minute)
+		store.Block(ctx, limiter.IPKey("192.168.1.2"), time.Minute)
+		store.Block(ctx, limiter.RouteKey("login", limiter.TokenKey("abc")), time.Minute)
+		store.Take(ctx, limiter.IPKey("192.168.1.3"), 1, limiterConfig)
+
+		expected := `
+# HELP rate_limiter_active_blocks Blocked IPs and tokens by key type and policy.
+# TYPE rate_limiter_active_blocks gauge
+rate_limiter_active_blocks{key_type="ip",policy="default"} 2
+rate_limiter_active_blocks{key_type="token",policy="login"} 1
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "rate_limiter_active_blocks"); err != nil {
+			t.Error(err)
+		}
+
+		// The scrapes that follow report the same count without listing the storage again
+		store.Block(ctx, limiter.IPKey("192.168.1.4"), time.Minute)
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "rate_limiter_active_blocks"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Reports the memory storage stats", func(t *testing.T) {
+		registry := prometheus.NewRegistry()
+		m := metrics.New(registry)
+
+		store := storage.NewMemoryStorage(config.StorageConfig{Size: 1})
+		defer store.Close()
+		m.RegisterMemory(map[string]*storage.MemoryStorage{"memory": store})
+
+		ctx := context.Background()
+		store.Take(ctx, limiter.IPKey("192.168.1.1"), 1, limiterConfig)
+		store.Take(ctx, limiter.IPKey("192.168.1.2"), 1, limiterConfig)
+
+		expected := `
+# HELP rate_limiter_memory_entries Keys held by the memory storage by backend.
+# TYPE rate_limiter_memory_entries gauge
+rate_limiter_memory_entries{backend="memory"} 1
+# HELP rate_limiter_memory_evictions_total Keys evicted from the memory storage to respect its size by backend.
+# TYPE rate_limiter_memory_evictions_total counter
+rate_limiter_memory_evictions_total{backend="memory"} 1
+`
+		if err := testutil.GatherAndCompare(registry, strings.NewReader(expected), "rate_limiter_memory_entries", "rate_limiter_memory_evictions_total"); err != nil {
+			t.Error(err)
+		}
+	})
+}
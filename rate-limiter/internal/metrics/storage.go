@@ -0,0 +1,163 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+// instrumentedStorage records the latency and the failures of every call to a storage
+type instrumentedStorage struct {
+	storage storage.Storage
+	backend string
+	metrics *Metrics
+}
+
+// InstrumentStorage wraps a storage, recording the latency and the failures of its calls
+// under the backend label
+func (m *Metrics) InstrumentStorage(store storage.Storage, backend string) storage.Storage {
+	return &instrumentedStorage{storage: store, backend: backend, metrics: m}
+}
+
+// observe records a call that started at start
+func (s *instrumentedStorage) observe(operation string, start time.Time, err error) {
+	s.metrics.storageDuration.WithLabelValues(s.backend, operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.storageErrors.WithLabelValues(s.backend, operation).Inc()
+	}
+}
+
+// Get returns the current count for a key
+func (s *instrumentedStorage) Get(ctx context.Context, key string) (int, error) {
+	start := time.Now()
+	count, err := s.storage.Get(ctx, key)
+	s.observe("get", start, err)
+	return count, err
+}
+
+// Increment increments the counter for a key and returns the new value
+func (s *instrumentedStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+	start := time.Now()
+	count, err := s.storage.Increment(ctx, key, expiration)
+	s.observe("increment", start, err)
+	return count, err
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (s *instrumentedStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+	start := time.Now()
+	count, err := s.storage.IncrementBy(ctx, key, n, expiration)
+	s.observe("increment_by", start, err)
+	return count, err
+}
+
+// Take checks the blocks, registers the request and blocks the keys when the limit is exceeded
+func (s *instrumentedStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	start := time.Now()
+	result, err := s.storage.Take(ctx, key, cost, limiterConfig, linked...)
+	s.observe("take", start, err)
+	return result, err
+}
+
+// Acquire takes a concurrency slot of a key for the lease, or renews the lease
+func (s *instrumentedStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	start := time.Now()
+	acquired, err := s.storage.Acquire(ctx, key, id, limit, lease)
+	s.observe("acquire", start, err)
+	return acquired, err
+}
+
+// Release frees the concurrency slot held by a lease
+func (s *instrumentedStorage) Release(ctx context.Context, key, id string) error {
+	start := time.Now()
+	err := s.storage.Release(ctx, key, id)
+	s.observe("release", start, err)
+	return err
+}
+
+// Reset resets the counter for a key
+func (s *instrumentedStorage) Reset(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.storage.Reset(ctx, key)
+	s.observe("reset", start, err)
+	return err
+}
+
+// IsBlocked checks if a key is in the blocklist
+func (s *instrumentedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	start := time.Now()
+	blocked, err := s.storage.IsBlocked(ctx, key)
+	s.observe("is_blocked", start, err)
+	return blocked, err
+}
+
+// Block adds a key to the blocklist with the given expiration
+func (s *instrumentedStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
+	start := time.Now()
+	err := s.storage.Block(ctx, key, expiration)
+	s.observe("block", start, err)
+	return err
+}
+
+// Unblock removes a key from the blocklist
+func (s *instrumentedStorage) Unblock(ctx context.Context, key string) error {
+	start := time.Now()
+	err := s.storage.Unblock(ctx, key)
+	s.observe("unblock", start, err)
+	return err
+}
+
+// State returns the counters and the block of a key
+func (s *instrumentedStorage) State(ctx context.Context, key string) (storage.KeyState, error) {
+	start := time.Now()
+	state, err := s.storage.State(ctx, key)
+	s.observe("state", start, err)
+	return state, err
+}
+
+// List returns the state of every key with counters or blocks
+func (s *instrumentedStorage) List(ctx context.Context) ([]storage.KeyState, error) {
+	start := time.Now()
+	states, err := s.storage.List(ctx)
+	s.observe("list", start, err)
+	return states, err
+}
+
+// Blocks returns how long each blocked key stays blocked
+func (s *instrumentedStorage) Blocks(ctx context.Context) (map[string]time.Duration, error) {
+	start := time.Now()
+	blocks, err := s.storage.Blocks(ctx)
+	s.observe("blocks", start, err)
+	return blocks, err
+}
+
+// AccessList returns the sorted entries of an access list
+func (s *instrumentedStorage) AccessList(ctx context.Context, list string) ([]string, error) {
+	start := time.Now()
+	entries, err := s.storage.AccessList(ctx, list)
+	s.observe("access_list", start, err)
+	return entries, err
+}
+
+// AddAccess adds an entry to an access list
+func (s *instrumentedStorage) AddAccess(ctx context.Context, list, entry string) error {
+	start := time.Now()
+	err := s.storage.AddAccess(ctx, list, entry)
+	s.observe("add_access", start, err)
+	return err
+}
+
+// RemoveAccess removes an entry from an access list
+func (s *instrumentedStorage) RemoveAccess(ctx context.Context, list, entry string) error {
+	start := time.Now()
+	err := s.storage.RemoveAccess(ctx, list, entry)
+	s.observe("remove_access", start, err)
+	return err
+}
+
+// Close closes the storage
+func (s *instrumentedStorage) Close() error {
+	return s.storage.Close()
+}
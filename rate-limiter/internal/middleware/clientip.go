@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+)
+
+// ClientIPResolver extracts the client IP from requests, trusting the forwarding
+// headers only when they were set by one of the trusted proxies
+type ClientIPResolver struct {
+	trustedProxies  []netip.Prefix
+	forwardedHeader string
+	ipv6Prefix      int
+}
+
+// NewClientIPResolver creates a client IP resolver from the configuration
+func NewClientIPResolver(cfg config.ClientIPConfig) (*ClientIPResolver, error) {
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length %d", cfg.IPv6Prefix)
+	}
+
+	forwardedHeader := http.CanonicalHeaderKey(strings.TrimSpace(cfg.ForwardedHeader))
+	switch forwardedHeader {
+	case "":
+		forwardedHeader = config.DefaultForwardedHeader
+	case "Forwarded", "X-Forwarded-For", "X-Real-Ip":
+	default:
+		return nil, fmt.Errorf("invalid forwarded header %q", cfg.ForwardedHeader)
+	}
+
+	resolver := &ClientIPResolver{forwardedHeader: forwardedHeader, ipv6Prefix: cfg.IPv6Prefix}
+	for _, proxy := range cfg.TrustedProxies {
+		if strings.TrimSpace(proxy) == "" {
+			continue
+		}
+
+		prefix, err := config.ParsePrefix(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy: %w", err)
+		}
+		resolver.trustedProxies = append(resolver.trustedProxies, prefix)
+	}
+
+	return resolver, nil
+}
+
+// ClientIP returns the IP of the client that sent the request
+//
+// The address of the peer is used unless it is a trusted proxy. In that case the
+// forwarding chain of the header set by the trusted proxies is walked from right
+// to left, skipping trusted proxies, and the first untrusted address is the client.
+// Anything to the left of it was set by the client and is ignored, and so are the
+// other forwarding headers, which the proxies pass through from the client.
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	remote, ok := parseHost(r.RemoteAddr)
+	if !ok {
+		// If the remote address can't be parsed, just use the original RemoteAddr
+		return r.RemoteAddr
+	}
+
+	client := remote
+	if c.trusted(remote) {
+		chain := c.forwardedChain(r)
+		for i := len(chain) - 1; i >= 0; i-- {
+			addr, ok := parseHost(chain[i])
+			if !ok {
+				// The hop that added an invalid entry is the last one we can vouch for
+				break
+			}
+			client = addr
+			if !c.trusted(addr) {
+				break
+			}
+		}
+	}
+
+	return c.normalize(client)
+}
+
+// Normalize formats a client address obtained elsewhere than from a request, such as
+// the remote address Envoy sends to the rate limit service, the same way as ClientIP
+func (c *ClientIPResolver) Normalize(host string) string {
+	addr, ok := parseHost(host)
+	if !ok {
+		return host
+	}
+	return c.normalize(addr)
+}
+
+// trusted reports whether an address belongs to a trusted proxy
+func (c *ClientIPResolver) trusted(addr netip.Addr) bool {
+	for _, prefix := range c.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize formats an address, aggregating IPv6 addresses to the configured prefix
+func (c *ClientIPResolver) normalize(addr netip.Addr) string {
+	if addr.Is6() && c.ipv6Prefix > 0 {
+		prefix, _ := addr.Prefix(c.ipv6Prefix)
+		return prefix.String()
+	}
+	return addr.String()
+}
+
+// forwardedChain returns the addresses of the forwarding chain from the client to the last
+// proxy, read from the header set by the trusted proxies
+func (c *ClientIPResolver) forwardedChain(r *http.Request) []string {
+	values := r.Header.Values(c.forwardedHeader)
+	if len(values) == 0 {
+		return nil
+	}
+
+	switch c.forwardedHeader {
+	case "Forwarded":
+		return parseForwarded(strings.Join(values, ","))
+	case "X-Real-Ip":
+		return []string{strings.TrimSpace(values[len(values)-1])}
+	}
+
+	var chain []string
+	for _, hop := range strings.Split(strings.Join(values, ","), ",") {
+		chain = append(chain, strings.TrimSpace(hop))
+	}
+	return chain
+}
+
+// parseForwarded returns the for= parameters of a RFC 7239 Forwarded header,
+// keeping a hop without one so the chain positions are preserved
+func parseForwarded(header string) []string {
+	var chain []string
+	for _, element := range strings.Split(header, ",") {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, found := strings.Cut(strings.TrimSpace(pair), "=")
+			if found && strings.EqualFold(name, "for") {
+				hop = strings.Trim(value, `"`)
+			}
+		}
+		chain = append(chain, hop)
+	}
+	return chain
+}
+
+// parseHost parses an address with an optional port, such as 192.0.2.1,
+// 192.0.2.1:8080, 2001:db8::1 or [2001:db8::1]:8080
+func parseHost(host string) (netip.Addr, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
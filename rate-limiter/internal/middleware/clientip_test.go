@@ -0,0 +1,177 @@
+package middleware_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+)
+
+func TestClientIPResolver(t *testing.T) {
+	resolver, err := middleware.NewClientIPResolver(config.ClientIPConfig{
+		TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1", "2001:db8:ffff::/48"},
+		IPv6Prefix:     64,
+	})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	// The proxies of these cases set Forwarded
+	forwarded, err := middleware.NewClientIPResolver(config.ClientIPConfig{
+		TrustedProxies:  []string{"10.0.0.0/8"},
+		ForwardedHeader: "Forwarded",
+		IPv6Prefix:      64,
+	})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+	// The proxies of these cases set X-Real-IP
+	realIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{
+		TrustedProxies:  []string{"10.0.0.0/8"},
+		ForwardedHeader: "x-real-ip",
+	})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		resolver   *middleware.ClientIPResolver
+		remoteAddr string
+		headers    map[string]string
+		expected   string
+	}{
+		{
+			name:       "Direct client",
+			remoteAddr: "203.0.113.7:51234",
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "Forwarding headers from untrusted peer are ignored",
+			remoteAddr: "203.0.113.7:51234",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1", "X-Real-IP": "198.51.100.2"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "X-Forwarded-For from trusted proxy",
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "Spoofed X-Forwarded-For entries are skipped from the right",
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"X-Forwarded-For": "1.2.3.4, 5.6.7.8, 198.51.100.1, 192.168.1.1"},
+			expected:   "198.51.100.1",
+		},
+		{
+			name:       "Chain of trusted proxies uses the leftmost address",
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"X-Forwarded-For": "10.1.1.1, 192.168.1.1"},
+			expected:   "10.1.1.1",
+		},
+		{
+			name:       "Invalid entry stops the walk at the last valid hop",
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.1, garbage, 10.2.2.2"},
+			expected:   "10.2.2.2",
+		},
+		{
+			name:       "Spoofed Forwarded is ignored when the proxy sets X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string]string{"Forwarded": "for=198.51.100.1", "X-Forwarded-For": "203.0.113.7"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "Spoofed X-Real-IP is ignored when the proxy sets X-Forwarded-For",
+			remoteAddr: "10.0.0.1:443",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.2"},
+			expected:   "10.0.0.1",
+		},
+		{
+			name:       "X-Real-IP from trusted proxy",
+			resolver:   realIP,
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"X-Real-IP": "198.51.100.9", "X-Forwarded-For": "198.51.100.1"},
+			expected:   "198.51.100.9",
+		},
+		{
+			name:       "Forwarded from trusted proxy",
+			resolver:   forwarded,
+			remoteAddr: "10.0.0.5:443",
+			headers: map[string]string{
+				"Forwarded":       `for=1.2.3.4, for="198.51.100.3:4711";proto=https, for=10.3.3.3;by=10.0.0.5`,
+				"X-Forwarded-For": "198.51.100.1",
+			},
+			expected: "198.51.100.3",
+		},
+		{
+			name:       "Spoofed X-Forwarded-For is ignored when the proxy sets Forwarded",
+			resolver:   forwarded,
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"Forwarded": "for=203.0.113.7", "X-Forwarded-For": "198.51.100.1"},
+			expected:   "203.0.113.7",
+		},
+		{
+			name:       "Forwarded with IPv6 is aggregated to the prefix",
+			resolver:   forwarded,
+			remoteAddr: "10.0.0.5:443",
+			headers:    map[string]string{"Forwarded": `for="[2001:db8:cafe::17]:4711"`},
+			expected:   "2001:db8:cafe::/64",
+		},
+		{
+			name:       "IPv6 peer is aggregated to the prefix",
+			remoteAddr: "[2001:db8:1:2:3:4:5:6]:8080",
+			expected:   "2001:db8:1:2::/64",
+		},
+		{
+			name:       "Trusted IPv6 proxy",
+			remoteAddr: "[2001:db8:ffff::1]:8080",
+			headers:    map[string]string{"X-Forwarded-For": "198.51.100.4"},
+			expected:   "198.51.100.4",
+		},
+		{
+			name:       "IPv4-mapped IPv6 is unmapped",
+			remoteAddr: "[::ffff:203.0.113.8]:8080",
+			expected:   "203.0.113.8",
+		},
+		{
+			name:       "Remote address without port",
+			remoteAddr: "203.0.113.9",
+			expected:   "203.0.113.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+
+			resolver := resolver
+			if tt.resolver != nil {
+				resolver = tt.resolver
+			}
+			if got := resolver.ClientIP(req); got != tt.expected {
+				t.Errorf("Expected client IP %q, got %q", tt.expected, got)
+			}
+		})
+	}
+
+	t.Run("Invalid trusted proxy", func(t *testing.T) {
+		_, err := middleware.NewClientIPResolver(config.ClientIPConfig{TrustedProxies: []string{"10.0.0.0/33"}})
+		if err == nil {
+			t.Errorf("Expected error for invalid trusted proxy")
+		}
+	})
+
+	t.Run("Invalid forwarded header", func(t *testing.T) {
+		_, err := middleware.NewClientIPResolver(config.ClientIPConfig{ForwardedHeader: "X-Client-IP"})
+		if err == nil {
+			t.Errorf("Expected error for invalid forwarded header")
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// CostHeader is the response header a handler may report the cost of a request in,
+// when it costs more than its route and can't call SetCost. The middleware removes it
+// before the response is written, so it never reaches the client.
+const CostHeader = "X-RateLimit-Cost"
+
+// costKey is the context key of the cost a handler reports with SetCost
+type costKey struct{}
+
+// SetCost reports the cost of the request being served, counted by the middleware when
+// the handler starts writing the response, so it must be called before. It does nothing
+// outside of a request checked by the middleware.
+func SetCost(ctx context.Context, cost int) {
+	if reported, ok := ctx.Value(costKey{}).(*atomic.Int64); ok {
+		reported.Store(int64(cost))
+	}
+}
+
+// reportedCost returns the cost reported by the handler with SetCost or, when it did not
+// call it, in the CostHeader response header, zero when it reported none
+func reportedCost(reported *atomic.Int64, header http.Header) int {
+	if cost := int(reported.Load()); cost > 0 {
+		return cost
+	}
+	cost, err := strconv.Atoi(header.Get(CostHeader))
+	if err != nil {
+		return 0
+	}
+	return cost
+}
+
+// costWriter counts the cost reported by the handler before the response is written,
+// or once the handler returns when it writes nothing
+type costWriter struct {
+	http.ResponseWriter
+	charge func()
+	once   sync.Once
+}
+
+func (w *costWriter) WriteHeader(code int) {
+	w.once.Do(w.charge)
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *costWriter) Write(b []byte) (int, error) {
+	w.once.Do(w.charge)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *costWriter) Flush() {
+	w.once.Do(w.charge)
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the features of the wrapped writer
+func (w *costWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
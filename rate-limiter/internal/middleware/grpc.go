@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// UnaryServerInterceptor creates a gRPC interceptor for rate limiting unary calls
+//
+// The client IP is the peer address, or the address in the forwarding metadata
+// when the peer is a trusted proxy, and the API key is read from the api_key
+// metadata. The full method name (e.g. /weather.Weather/Get) is the route pattern,
+// so a route policy for the POST method and that pattern limits the method.
+// Rejected calls fail with codes.ResourceExhausted and the retry delay in a
+// RetryInfo detail, and the rate limit headers are sent as response metadata. The
+// IPs and tokens in a deny list fail with codes.PermissionDenied. The concurrency
+// limits of the policies are only applied by the HTTP middleware.
+func UnaryServerInterceptor(rateLimiter *limiter.RateLimiter, clientIP *ClientIPResolver) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		setHeader := func(md metadata.MD) error { return grpc.SetHeader(ctx, md) }
+		if err := checkCall(ctx, rateLimiter, clientIP, info.FullMethod, setHeader); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor creates a gRPC interceptor for rate limiting streams, which
+// are checked once when opened, the same way as the unary calls
+func StreamServerInterceptor(rateLimiter *limiter.RateLimiter, clientIP *ClientIPResolver) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkCall(ss.Context(), rateLimiter, clientIP, info.FullMethod, ss.SetHeader); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkCall checks a call against the rate limiter, sending the rate limit headers
+// through setHeader, and returns the status error the call is rejected with
+func checkCall(ctx context.Context, rateLimiter *limiter.RateLimiter, clientIP *ClientIPResolver, fullMethod string, setHeader func(metadata.MD) error) error {
+	r := grpcRequest(ctx)
+	ip := clientIP.ClientIP(r)
+	token := r.Header.Get(APIKeyHeader)
+
+	// gRPC calls are HTTP/2 POST requests to the full method name
+	decision, err := rateLimiter.AllowRoute(ctx, http.MethodPost, fullMethod, ip, token)
+	if errors.Is(err, limiter.ErrInvalidToken) {
+		return status.Error(codes.Unauthenticated, InvalidAPIKeyMessage)
+	}
+	if errors.Is(err, limiter.ErrDenied) {
+		return status.Error(codes.PermissionDenied, AccessDeniedMessage)
+	}
+	if errors.Is(err, limiter.ErrStorageUnavailable) {
+		return status.Error(codes.Unavailable, "Service Unavailable")
+	}
+	if err != nil {
+		return status.Error(codes.Internal, "Internal Server Error")
+	}
+
+	// Degraded, allow list and dry run decisions were not counted, so there is no limit state to describe
+	header := make(http.Header)
+	if !decision.Degraded && decision.Access == "" && !decision.DryRun {
+		SetRateLimitHeaders(header, decision)
+	}
+	if decision.Shadow != nil {
+		SetShadowHeader(header, *decision.Shadow)
+	}
+
+	if !decision.Allowed {
+		header.Set("Retry-After", RetryAfter(decision))
+		setHeader(headerMetadata(header))
+
+		st, err := status.New(codes.ResourceExhausted, RateLimitExceededMessage).WithDetails(
+			&errdetails.RetryInfo{RetryDelay: durationpb.New(retryDelay(decision))},
+		)
+		if err != nil {
+			return status.Error(codes.ResourceExhausted, RateLimitExceededMessage)
+		}
+		return st.Err()
+	}
+
+	if len(header) > 0 {
+		setHeader(headerMetadata(header))
+	}
+	return nil
+}
+
+// grpcRequest describes a gRPC call as the HTTP/2 request carrying it, so the client
+// IP and the API key are read from the peer and the metadata as from an HTTP request
+func grpcRequest(ctx context.Context) *http.Request {
+	r := &http.Request{Header: make(http.Header)}
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		r.RemoteAddr = p.Addr.String()
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for key, values := range md {
+		for _, value := range values {
+			r.Header.Add(key, value)
+		}
+	}
+	return r
+}
+
+// headerMetadata converts HTTP headers to gRPC metadata, whose keys are lowercase
+func headerMetadata(header http.Header) metadata.MD {
+	md := make(metadata.MD, len(header))
+	for name, values := range header {
+		md.Append(name, values...)
+	}
+	return md
+}
@@ -0,0 +1,209 @@
+package middleware_test
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// proxyListener accepts the in-memory connections as if they came from a proxy
+type proxyListener struct {
+	*bufconn.Listener
+}
+
+func (l proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	return proxyConn{conn}, err
+}
+
+type proxyConn struct {
+	net.Conn
+}
+
+func (proxyConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 50000}
+}
+
+// newHealthClient serves the gRPC health service behind the rate limiter interceptors
+// and returns a client of it, the calls reach the server through a trusted proxy
+func newHealthClient(t *testing.T, rl *limiter.RateLimiter) healthpb.HealthClient {
+	t.Helper()
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(middleware.UnaryServerInterceptor(rl, clientIP)),
+		grpc.StreamInterceptor(middleware.StreamServerInterceptor(rl, clientIP)),
+	)
+	healthpb.RegisterHealthServer(server, health.NewServer())
+	go server.Serve(proxyListener{lis})
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Error connecting to the gRPC server: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return healthpb.NewHealthClient(conn)
+}
+
+// callContext returns the context of a call forwarded for the client IP, with the API key when set
+func callContext(ip, token string) context.Context {
+	md := metadata.Pairs("x-forwarded-for", ip)
+	if token != "" {
+		md.Append("api_key", token)
+	}
+	return metadata.NewOutgoingContext(context.Background(), md)
+}
+
+// check calls the unary method of the health service, returning the response metadata
+func check(client healthpb.HealthClient, ip, token string) (metadata.MD, error) {
+	var header metadata.MD
+	_, err := client.Check(callContext(ip, token), &healthpb.HealthCheckRequest{}, grpc.Header(&header))
+	return header, err
+}
+
+func TestGRPCInterceptors(t *testing.T) {
+	rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 2, RateWindow: time.Second, BlockDuration: time.Minute},
+		Token: map[string]config.LimiterConfig{
+			"abc": {RateLimit: 3, RateWindow: time.Second, BlockDuration: time.Minute},
+		},
+		Route: map[string]config.RouteConfig{
+			"watch": {Method: "POST", Pattern: "/grpc.health.v1.Health/Watch", LimiterConfig: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute}},
+		},
+	})
+	defer rl.Close()
+	client := newHealthClient(t, rl)
+
+	t.Run("IP rate limiting", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			header, err := check(client, "192.168.1.100", "")
+			if err != nil {
+				t.Fatalf("Call %d should be allowed, got: %v", i+1, err)
+			}
+			if got := header.Get("x-ratelimit-remaining"); len(got) != 1 || got[0] != []string{"1", "0"}[i] {
+				t.Errorf("Call %d: unexpected remaining metadata %v", i+1, got)
+			}
+		}
+
+		header, err := check(client, "192.168.1.100", "")
+		st := status.Convert(err)
+		if st.Code() != codes.ResourceExhausted {
+			t.Fatalf("Call should be rejected with ResourceExhausted, got: %v", err)
+		}
+		if st.Message() != middleware.RateLimitExceededMessage {
+			t.Errorf("Unexpected message: %s", st.Message())
+		}
+
+		var retryInfo *errdetails.RetryInfo
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok {
+				retryInfo = info
+			}
+		}
+		if retryInfo == nil {
+			t.Fatalf("Expected retry info in the status details, got %v", st.Details())
+		}
+		if delay := retryInfo.GetRetryDelay().AsDuration(); delay < 59*time.Second || delay > time.Minute {
+			t.Errorf("Expected a retry delay of the block duration, got %v", delay)
+		}
+		if got := header.Get("retry-after"); len(got) != 1 || got[0] != "60" {
+			t.Errorf("Expected retry-after metadata of 60, got %v", got)
+		}
+	})
+
+	t.Run("Token rate limiting", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if _, err := check(client, "192.168.1.101", "abc"); err != nil {
+				t.Fatalf("Call %d should be allowed, got: %v", i+1, err)
+			}
+		}
+		if _, err := check(client, "192.168.1.101", "abc"); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("Call should be rejected with ResourceExhausted, got: %v", err)
+		}
+	})
+
+	t.Run("Stream rate limiting by method", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(callContext("192.168.1.102", ""))
+		defer cancel()
+
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatalf("Error opening stream: %v", err)
+		}
+		if _, err := stream.Recv(); err != nil {
+			t.Fatalf("First stream should be allowed, got: %v", err)
+		}
+
+		stream, err = client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		if err != nil {
+			t.Fatalf("Error opening stream: %v", err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+			t.Errorf("Second stream should be rejected with ResourceExhausted, got: %v", err)
+		}
+
+		// The route policy only applies to its method
+		if _, err := check(client, "192.168.1.102", ""); err != nil {
+			t.Errorf("Other methods should be allowed, got: %v", err)
+		}
+	})
+}
+
+func TestGRPCInterceptorsErrors(t *testing.T) {
+	ipConfig := config.LimiterConfig{RateLimit: 2, RateWindow: time.Second}
+
+	t.Run("Invalid API key", func(t *testing.T) {
+		rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{IP: ipConfig})
+		defer rl.Close()
+		registry, err := tokens.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+		if err != nil {
+			t.Fatalf("Error opening token registry: %v", err)
+		}
+		rl.SetTokenStore(registry)
+		client := newHealthClient(t, rl)
+
+		_, err = check(client, "192.168.1.100", "rl_unknown")
+		if st := status.Convert(err); st.Code() != codes.Unauthenticated || st.Message() != middleware.InvalidAPIKeyMessage {
+			t.Errorf("Expected Unauthenticated with %q, got: %v", middleware.InvalidAPIKeyMessage, err)
+		}
+	})
+
+	t.Run("Storage unavailable", func(t *testing.T) {
+		store := unavailableStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+		rl := limiter.New(store, limiter.Config{IP: ipConfig})
+		defer rl.Close()
+		client := newHealthClient(t, rl)
+
+		if _, err := check(client, "192.168.1.100", ""); status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable, got: %v", err)
+		}
+	})
+}
@@ -1,62 +1,274 @@
 package middleware
 
 import (
-	"net"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/go-chi/chi/v5"
 )
 
 const (
 	// APIKeyHeader is the header name for the API key
 	APIKeyHeader = "API_KEY"
 
+	// ShadowHeader is the header reporting whether the dry run or shadow policy of the
+	// request would have allowed or denied it
+	ShadowHeader = "X-RateLimit-Shadow"
+
+	// InvalidAPIKeyMessage is the message shown when the API key is unknown, expired or revoked
+	InvalidAPIKeyMessage = "invalid API key"
+
+	// AccessDeniedMessage is the message shown when the IP or the token is in a deny list
+	AccessDeniedMessage = "access denied"
+
 	// RateLimitExceededMessage is the message shown when rate limit is exceeded
 	RateLimitExceededMessage = "you have reached the maximum number of requests or actions allowed within a certain time frame"
+
+	// ConcurrencyLimitExceededMessage is the message shown when the concurrency limit is exceeded
+	ConcurrencyLimitExceededMessage = "you have reached the maximum number of requests allowed in flight at once"
 )
 
-// RateLimiterMiddleware creates a middleware for rate limiting
-func RateLimiterMiddleware(limiter *limiter.RateLimiter) func(next http.Handler) http.Handler {
+// Metrics records the responses of the rate limiter middleware
+type Metrics interface {
+	// ObserveResponse records the status code the middleware answered a request of an IP
+	// or token with, keyType "ip" or "token", http.StatusOK when it was passed on
+	ObserveResponse(keyType string, code int)
+}
+
+// Options customizes how the middleware reads the client of a request and answers
+// the requests it does not pass on, the zero value behaves as RateLimiterMiddleware
+// with the client IP in the remote address
+type Options struct {
+	// KeyFunc returns the IP and the token a request is limited by, the token limiting
+	// it instead of the IP when not empty
+	KeyFunc func(r *http.Request) (ip, token string)
+	// DeniedHandler answers the requests rejected by a limit, after the rate limit headers are
+	// set, or by the concurrency limit, with a limiter.Decision.Concurrency decision
+	DeniedHandler func(w http.ResponseWriter, r *http.Request, decision limiter.Decision)
+	// ErrorHandler answers the requests the limiter failed to check or denied access to
+	ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+	// Metrics records the status codes the default handlers answer with, it may be nil
+	Metrics Metrics
+}
+
+// RateLimiterMiddleware creates a middleware for rate limiting, metrics may be nil
+func RateLimiterMiddleware(rateLimiter *limiter.RateLimiter, clientIP *ClientIPResolver, metrics Metrics) func(next http.Handler) http.Handler {
+	return New(rateLimiter, Options{
+		KeyFunc: func(r *http.Request) (string, string) {
+			return clientIP.ClientIP(r), r.Header.Get(APIKeyHeader)
+		},
+		Metrics: metrics,
+	})
+}
+
+// New creates a middleware for rate limiting with the given options
+func New(rateLimiter *limiter.RateLimiter, opts Options) func(next http.Handler) http.Handler {
+	if opts.KeyFunc == nil {
+		// Without trusted proxies the client IP is the remote address
+		clientIP := &ClientIPResolver{}
+		opts.KeyFunc = func(r *http.Request) (string, string) {
+			return clientIP.ClientIP(r), r.Header.Get(APIKeyHeader)
+		}
+	}
+	if opts.DeniedHandler == nil {
+		opts.DeniedHandler = WriteRateLimited
+	}
+	if opts.ErrorHandler == nil {
+		opts.ErrorHandler = WriteError
+	}
+
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get IP address
-			ip := getIPAddress(r)
+			// Get the IP address and the token
+			ip, token := opts.KeyFunc(r)
 
-			// Get token from header
-			token := r.Header.Get(APIKeyHeader)
+			code := http.StatusOK
+			if opts.Metrics != nil {
+				keyType := "ip"
+				if token != "" {
+					keyType = "token"
+				}
+				defer func() { opts.Metrics.ObserveResponse(keyType, code) }()
+			}
 
-			// Check if request is allowed
-			allowed, err := limiter.Allow(r.Context(), ip, token)
+			// Hold a concurrency slot while the request is served, taken before the request is
+			// counted so the requests that get none don't use up the limit and the quotas
+			pattern := routePattern(r)
+			lease, concurrency, err := rateLimiter.AcquireRoute(r.Context(), r.Method, pattern, ip, token)
 			if err != nil {
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				code, _ = ErrorStatus(err)
+				opts.ErrorHandler(w, r, err)
+				return
+			}
+			if !concurrency.Allowed {
+				code = DeniedStatus(concurrency)
+				opts.DeniedHandler(w, r, concurrency)
 				return
 			}
+			defer lease.Release()
+			if lease != nil {
+				// Stop the request when its slot is lost, so it doesn't run beyond the concurrency limit
+				ctx, stop := lease.Context(r.Context())
+				defer stop()
+				r = r.WithContext(ctx)
+			}
 
-			if !allowed {
-				w.WriteHeader(http.StatusTooManyRequests) // 429 Too Many Requests
-				w.Write([]byte(RateLimitExceededMessage))
+			// Check if request is allowed, applying the policy of its route when there is one
+			decision, err := rateLimiter.AllowRoute(r.Context(), r.Method, pattern, ip, token)
+			if err != nil {
+				code, _ = ErrorStatus(err)
+				opts.ErrorHandler(w, r, err)
 				return
 			}
 
-			// Pass to the next handler
-			next.ServeHTTP(w, r)
+			// Degraded, allow list and dry run decisions were not counted, so there is no limit state to describe
+			if !decision.Degraded && decision.Access == "" && !decision.DryRun {
+				SetRateLimitHeaders(w.Header(), decision)
+			}
+			if decision.Shadow != nil {
+				SetShadowHeader(w.Header(), *decision.Shadow)
+			}
+
+			if !decision.Allowed {
+				code = DeniedStatus(decision)
+				opts.DeniedHandler(w, r, decision)
+				return
+			}
+
+			// Pass to the next handler, charging the cost it reports beyond the cost already counted
+			// before the response is written, so the requests that follow it see the charge
+			reported := new(atomic.Int64)
+			cw := &costWriter{ResponseWriter: w}
+			cw.charge = func() {
+				cost := reportedCost(reported, w.Header())
+				w.Header().Del(CostHeader)
+
+				// Decisions that were not counted are not charged for the cost reported by the handler
+				if decision.Access != "" || decision.Degraded || decision.DryRun {
+					return
+				}
+				if extra := cost - decision.Cost; extra > 0 {
+					ctx := context.WithoutCancel(r.Context())
+					if err := rateLimiter.ChargeRoute(ctx, r.Method, pattern, ip, token, extra); err != nil {
+						log.Printf("Failed to charge the cost of a request: %v", err)
+					}
+				}
+			}
+			next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), costKey{}, reported)))
+			cw.once.Do(cw.charge)
 		})
 	}
 }
 
-// getIPAddress returns the client's IP address from the request
-func getIPAddress(r *http.Request) string {
-	// Check for X-Forwarded-For header first (when behind a proxy)
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		return xff
+// WriteRateLimited answers a request rejected by a limit with the status code of
+// DeniedStatus and the Retry-After header
+func WriteRateLimited(w http.ResponseWriter, r *http.Request, decision limiter.Decision) {
+	message := RateLimitExceededMessage
+	if decision.Concurrency {
+		message = ConcurrencyLimitExceededMessage
 	}
+	w.Header().Set("Retry-After", RetryAfter(decision))
+	w.WriteHeader(DeniedStatus(decision))
+	w.Write([]byte(message))
+}
+
+// DeniedStatus returns the status code a rejected request is answered with, 503 Service
+// Unavailable when it timed out waiting for a concurrency slot and 429 Too Many Requests
+// otherwise
+func DeniedStatus(decision limiter.Decision) int {
+	if decision.Queued {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusTooManyRequests
+}
+
+// WriteError answers a request the limiter failed to check or denied access to with
+// the status code and the message of ErrorStatus
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	code, message := ErrorStatus(err)
+	http.Error(w, message, code)
+}
+
+// ErrorStatus returns the status code and the message a limiter error is answered with
+func ErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, limiter.ErrInvalidToken):
+		return http.StatusUnauthorized, InvalidAPIKeyMessage
+	case errors.Is(err, limiter.ErrDenied):
+		return http.StatusForbidden, AccessDeniedMessage
+	case errors.Is(err, limiter.ErrStorageUnavailable):
+		return http.StatusServiceUnavailable, "Service Unavailable"
+	default:
+		return http.StatusInternalServerError, "Internal Server Error"
+	}
+}
+
+// routePattern returns the chi pattern of the route that will serve the request,
+// empty when the request is not routed by chi or no route matches it
+func routePattern(r *http.Request) string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return ""
+	}
+
+	// Find updates the context it is given, so the request context is left untouched
+	return rctx.Routes.Find(chi.NewRouteContext(), r.Method, r.URL.Path)
+}
 
-	// If not behind a proxy, use RemoteAddr but strip the port
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		// If there's an error splitting (perhaps because there's no port),
-		// just use the original RemoteAddr
-		return r.RemoteAddr
+// policyName returns the name of the policy applied to the request, qualified by
+// the route policy and the quota period when there are ones
+func policyName(decision limiter.Decision) string {
+	name := decision.Policy
+	if decision.Route != "" {
+		name = decision.Route + "." + name
 	}
-	return ip
+	if decision.Quota != "" {
+		name += "." + decision.Quota
+	}
+	return name
+}
+
+// SetRateLimitHeaders describes the limit applied to the request, both in the widespread
+// X-RateLimit-* headers and in the IETF RateLimit and RateLimit-Policy headers
+func SetRateLimitHeaders(header http.Header, decision limiter.Decision) {
+	resetAfter := ceilSeconds(time.Until(decision.ResetAt))
+
+	header.Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+	header.Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+	header.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Unix()+int64(resetAfter), 10))
+	header.Set("RateLimit-Policy", fmt.Sprintf("%q;q=%d;w=%d", policyName(decision), decision.Limit, ceilSeconds(decision.Window)))
+	header.Set("RateLimit", fmt.Sprintf("%q;r=%d;t=%d", policyName(decision), decision.Remaining, resetAfter))
+}
+
+// SetShadowHeader reports the decision of a dry run or shadow policy, limiter.OutcomeAllowed
+// or limiter.OutcomeDenied
+func SetShadowHeader(header http.Header, shadow limiter.Decision) {
+	outcome := limiter.OutcomeAllowed
+	if !shadow.Allowed {
+		outcome = limiter.OutcomeDenied
+	}
+	header.Set(ShadowHeader, outcome)
+}
+
+// RetryAfter returns the Retry-After header value of a rejected request, in whole seconds
+func RetryAfter(decision limiter.Decision) string {
+	return strconv.Itoa(int(retryDelay(decision) / time.Second))
+}
+
+// retryDelay returns how long a rejected client should wait, in whole seconds and at least one
+func retryDelay(decision limiter.Decision) time.Duration {
+	return time.Duration(max(1, ceilSeconds(time.Until(decision.BlockedUntil)))) * time.Second
+}
+
+// ceilSeconds rounds a duration up to whole seconds, never returning less than zero
+func ceilSeconds(d time.Duration) int {
+	return max(0, int(math.Ceil(d.Seconds())))
 }
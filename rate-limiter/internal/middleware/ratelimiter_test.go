@@ -1,8 +1,11 @@
 package middleware_test
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -10,11 +13,13 @@ import (
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
 	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+	"github.com/go-chi/chi/v5"
 )
 
 func TestRateLimiterMiddleware(t *testing.T) {
 	// Create a memory storage for testing
-	store := storage.NewMemoryStorage()
+	store := storage.NewMemoryStorage(config.StorageConfig{})
 
 	// Create a rate limiter with a small window and limits
 	rl := limiter.New(store, limiter.Config{
@@ -30,8 +35,13 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		w.WriteHeader(http.StatusOK)
 	})
 
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
 	// Apply middleware
-	middlewareHandler := middleware.RateLimiterMiddleware(rl)(handler)
+	middlewareHandler := middleware.RateLimiterMiddleware(rl, clientIP, nil)(handler)
 
 	// Test IP rate limiting
 	t.Run("IP rate limiting", func(t *testing.T) {
@@ -94,6 +104,49 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		}
 	})
 
+	// Test rate limit headers
+	t.Run("Rate limit headers", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.1.103"
+		rr := httptest.NewRecorder()
+
+		middlewareHandler.ServeHTTP(rr, req)
+
+		expected := map[string]string{
+			"X-RateLimit-Limit":     "2",
+			"X-RateLimit-Remaining": "1",
+			"RateLimit-Policy":      `"ip";q=2;w=1`,
+			"RateLimit":             `"ip";r=1;t=1`,
+		}
+		for header, value := range expected {
+			if got := rr.Header().Get(header); got != value {
+				t.Errorf("Expected %s %q, got %q", header, value, got)
+			}
+		}
+		if rr.Header().Get("X-RateLimit-Reset") == "" {
+			t.Errorf("Expected X-RateLimit-Reset header")
+		}
+		if rr.Header().Get("Retry-After") != "" {
+			t.Errorf("Allowed request should not have Retry-After header")
+		}
+
+		// Exceed the limit to get blocked for a minute
+		for i := 0; i < 2; i++ {
+			rr = httptest.NewRecorder()
+			middlewareHandler.ServeHTTP(rr, req)
+		}
+
+		if rr.Code != http.StatusTooManyRequests {
+			t.Fatalf("Request should be blocked, got: %d", rr.Code)
+		}
+		if got := rr.Header().Get("Retry-After"); got != "60" {
+			t.Errorf("Expected Retry-After %q, got %q", "60", got)
+		}
+		if got := rr.Header().Get("X-RateLimit-Remaining"); got != "0" {
+			t.Errorf("Expected X-RateLimit-Remaining %q, got %q", "0", got)
+		}
+	})
+
 	// Test different IPs don't affect each other
 	t.Run("Different IPs", func(t *testing.T) {
 		// This IP should not be affected by previous tests
@@ -108,3 +161,475 @@ func TestRateLimiterMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestRateLimiterMiddlewareRoutes(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:  5,
+			RateWindow: time.Minute,
+		},
+		Route: map[string]config.RouteConfig{
+			"login": {
+				Method:        "POST",
+				Pattern:       "/login",
+				LimiterConfig: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute},
+			},
+			"user": {
+				Pattern:       "/users/{id}",
+				LimiterConfig: config.LimiterConfig{RateLimit: 2, RateWindow: time.Minute},
+			},
+		},
+	})
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.RateLimiterMiddleware(rl, clientIP, nil))
+	ok := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}
+	r.Get("/", ok)
+	r.Get("/login", ok)
+	r.Post("/login", ok)
+	r.Get("/users/{id}", ok)
+
+	// send returns the response to a request from ip
+	send := func(method, target, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.RemoteAddr = ip
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Route and method policy", func(t *testing.T) {
+		ip := "192.168.6.1"
+
+		rr := send("POST", "/login", ip)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("First login should be allowed, got: %d", rr.Code)
+		}
+		if policy := rr.Header().Get("RateLimit-Policy"); policy != `"login.ip";q=1;w=60` {
+			t.Errorf("Expected the login policy, got %q", policy)
+		}
+
+		if rr := send("POST", "/login", ip); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("Second login should be blocked, got: %d", rr.Code)
+		}
+
+		// The login block does not affect the other routes and methods
+		for _, target := range []string{"/", "/login"} {
+			rr := send("GET", target, ip)
+			if rr.Code != http.StatusOK {
+				t.Errorf("GET %s should be allowed, got: %d", target, rr.Code)
+			}
+			if policy := rr.Header().Get("RateLimit-Policy"); policy != `"ip";q=5;w=60` {
+				t.Errorf("Expected the default policy on GET %s, got %q", target, policy)
+			}
+		}
+	})
+
+	t.Run("Pattern with parameters", func(t *testing.T) {
+		ip := "192.168.6.2"
+
+		// Every user shares the limit of the route pattern
+		for i, target := range []string{"/users/1", "/users/2"} {
+			if rr := send("GET", target, ip); rr.Code != http.StatusOK {
+				t.Errorf("Request %d should be allowed, got: %d", i+1, rr.Code)
+			}
+		}
+		if rr := send("GET", "/users/3", ip); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("Third request should be rejected, got: %d", rr.Code)
+		}
+	})
+}
+
+func TestRateLimiterMiddlewareTokenStore(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+
+	registry, err := tokens.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("Error opening token registry: %v", err)
+	}
+	_, key, err := registry.Create("acme", "pro", time.Time{})
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	_, expiredKey, err := registry.Create("acme", "pro", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{
+			RateLimit:  1,
+			RateWindow: time.Minute,
+		},
+		Plan: map[string]config.LimiterConfig{
+			"pro": {RateLimit: 10, RateWindow: time.Minute},
+		},
+	})
+	rl.SetTokenStore(registry)
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+	middlewareHandler := middleware.RateLimiterMiddleware(rl, clientIP, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		expected int
+	}{
+		{name: "Registered key", apiKey: key, expected: http.StatusOK},
+		{name: "Unknown key", apiKey: "rl_unknown", expected: http.StatusUnauthorized},
+		{name: "Expired key", apiKey: expiredKey, expected: http.StatusUnauthorized},
+		{name: "Without key", expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.168.8.1"
+			if tt.apiKey != "" {
+				req.Header.Set("API_KEY", tt.apiKey)
+			}
+			rr := httptest.NewRecorder()
+
+			middlewareHandler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expected {
+				t.Errorf("Expected %d, got: %d", tt.expected, rr.Code)
+			}
+		})
+	}
+}
+
+func TestRateLimiterMiddlewareShadow(t *testing.T) {
+	rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, DryRun: true},
+	})
+	defer rl.Close()
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+	handler := middleware.RateLimiterMiddleware(rl, clientIP, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i, expected := range []string{limiter.OutcomeAllowed, limiter.OutcomeDenied} {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.30.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("Request %d: expected 200, got: %d", i+1, rr.Code)
+		}
+		if shadow := rr.Header().Get(middleware.ShadowHeader); shadow != expected {
+			t.Errorf("Request %d: expected %s %q, got %q", i+1, middleware.ShadowHeader, expected, shadow)
+		}
+		if limit := rr.Header().Get("X-RateLimit-Limit"); limit != "" {
+			t.Errorf("Expected no rate limit headers for a dry run policy, got X-RateLimit-Limit %q", limit)
+		}
+	}
+}
+
+func TestRateLimiterMiddlewareConcurrency(t *testing.T) {
+	rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 100, RateWindow: time.Minute, MaxConcurrent: 1},
+		Token: map[string]config.LimiterConfig{
+			"queued": {RateLimit: 100, RateWindow: time.Minute, MaxConcurrent: 1, QueueTimeout: 50 * time.Millisecond},
+			"scarce": {RateLimit: 2, RateWindow: time.Minute, MaxConcurrent: 1, QueueTimeout: 50 * time.Millisecond},
+		},
+	})
+	defer rl.Close()
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+	entered, release := make(chan struct{}), make(chan struct{})
+	handler := middleware.RateLimiterMiddleware(rl, clientIP, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// serve sends a request, the token being the API key when not empty
+	serve := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.168.40.1:1234"
+		if token != "" {
+			req.Header.Set(middleware.APIKeyHeader, token)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		expected int
+	}{
+		{name: "Rejected right away", expected: http.StatusTooManyRequests},
+		{name: "Queue timeout", token: "queued", expected: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The first request holds the only slot until released
+			done := make(chan *httptest.ResponseRecorder)
+			go func() { done <- serve(tt.token) }()
+			<-entered
+
+			rr := serve(tt.token)
+			if rr.Code != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, rr.Code)
+			}
+			if rr.Body.String() != middleware.ConcurrencyLimitExceededMessage {
+				t.Errorf("Expected concurrency limit message, got: %s", rr.Body.String())
+			}
+			if rr.Header().Get("Retry-After") != "1" {
+				t.Errorf("Expected Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+			}
+
+			release <- struct{}{}
+			if first := <-done; first.Code != http.StatusOK {
+				t.Errorf("Expected 200 for the first request, got %d", first.Code)
+			}
+
+			// The slot is released once the request is served
+			go func() { done <- serve(tt.token) }()
+			<-entered
+			release <- struct{}{}
+			if rr := <-done; rr.Code != http.StatusOK {
+				t.Errorf("Expected 200 after the release, got %d", rr.Code)
+			}
+		})
+	}
+
+	t.Run("Requests without a slot are not counted", func(t *testing.T) {
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- serve("scarce") }()
+		<-entered
+
+		// Timing out in the queue leaves the rate limit of 2 untouched
+		if rr := serve("scarce"); rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected 503, got %d", rr.Code)
+		}
+		release <- struct{}{}
+		<-done
+
+		go func() { done <- serve("scarce") }()
+		var rr *httptest.ResponseRecorder
+		select {
+		case <-entered:
+			release <- struct{}{}
+			rr = <-done
+		case rr = <-done:
+		}
+		if rr.Code != http.StatusOK || rr.Header().Get("X-RateLimit-Remaining") != "0" {
+			t.Errorf("Expected the second request served to be the last one allowed, got %d %v", rr.Code, rr.Header())
+		}
+	})
+}
+
+func TestRateLimiterMiddlewareCost(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{})
+	rl := limiter.New(store, limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute},
+		RouteCost: map[string]config.RouteCostConfig{
+			"export": {Pattern: "/export", Cost: 2},
+		},
+	})
+	defer rl.Close()
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.RateLimiterMiddleware(rl, clientIP, nil))
+	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Get("/export", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Get("/search", func(w http.ResponseWriter, r *http.Request) {
+		middleware.SetCost(r.Context(), 3)
+		w.WriteHeader(http.StatusOK)
+	})
+	r.Get("/report", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.CostHeader, "4")
+		w.WriteHeader(http.StatusOK)
+	})
+	// counted is what the limit holds for the IP of /stream once its response is written
+	var counted int
+	r.Get("/stream", func(w http.ResponseWriter, r *http.Request) {
+		middleware.SetCost(r.Context(), 3)
+		w.Write([]byte("first chunk"))
+		state, err := store.State(r.Context(), limiter.IPKey("192.168.50.4"))
+		if err != nil {
+			t.Errorf("Error reading key state: %v", err)
+		}
+		counted = state.Counters[config.AlgorithmFixedWindow]
+	})
+
+	// send returns the response to a request from ip
+	send := func(target, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.RemoteAddr = ip
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		return rr
+	}
+
+	tests := []struct {
+		name   string
+		target string
+		ip     string
+		// remaining is what is left for a request to / after the one to the target
+		remaining string
+	}{
+		{name: "Route cost", target: "/export", ip: "192.168.50.1", remaining: "2"},
+		{name: "Cost set by the handler", target: "/search", ip: "192.168.50.2", remaining: "1"},
+		{name: "Cost header", target: "/report", ip: "192.168.50.3", remaining: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rr := send(tt.target, tt.ip); rr.Code != http.StatusOK {
+				t.Fatalf("Request to %s should be allowed, got: %d", tt.target, rr.Code)
+			}
+			rr := send("/", tt.ip)
+			if rr.Code != http.StatusOK {
+				t.Fatalf("Request to / should be allowed, got: %d", rr.Code)
+			}
+			if remaining := rr.Header().Get("X-RateLimit-Remaining"); remaining != tt.remaining {
+				t.Errorf("Expected %s remaining, got %s", tt.remaining, remaining)
+			}
+		})
+	}
+
+	t.Run("Cost header is not sent", func(t *testing.T) {
+		if rr := send("/report", "192.168.50.5"); rr.Header().Get(middleware.CostHeader) != "" {
+			t.Errorf("Expected the cost header to be removed, got %v", rr.Header())
+		}
+	})
+
+	t.Run("Charged before the response is written", func(t *testing.T) {
+		send("/stream", "192.168.50.4")
+		if counted != 3 {
+			t.Errorf("Expected the cost counted before the response was written, got %d", counted)
+		}
+	})
+}
+
+func TestRateLimiterMiddlewareAccess(t *testing.T) {
+	rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute},
+		Access: config.AccessConfig{
+			AllowIPs: []string{"192.168.20.0/24"},
+			DenyIPs:  []string{"10.0.0.0/8"},
+		},
+	})
+	defer rl.Close()
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+	handler := middleware.RateLimiterMiddleware(rl, clientIP, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name     string
+		ip       string
+		expected int
+	}{
+		{name: "Denied", ip: "10.1.1.1", expected: http.StatusForbidden},
+		{name: "Allowed", ip: "192.168.20.5", expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 3; i++ {
+				req := httptest.NewRequest("GET", "/", nil)
+				req.RemoteAddr = tt.ip + ":1234"
+				rr := httptest.NewRecorder()
+				handler.ServeHTTP(rr, req)
+
+				if rr.Code != tt.expected {
+					t.Errorf("Request %d: expected %d, got: %d", i+1, tt.expected, rr.Code)
+				}
+				if limit := rr.Header().Get("X-RateLimit-Limit"); limit != "" {
+					t.Errorf("Expected no rate limit headers, got X-RateLimit-Limit %q", limit)
+				}
+			}
+		})
+	}
+}
+
+// unavailableStorage is a storage whose Take always fails, as when Redis is down
+type unavailableStorage struct {
+	storage.Storage
+}
+
+func (unavailableStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	return storage.Result{}, errors.New("connection refused")
+}
+
+func TestRateLimiterMiddlewareFailureMode(t *testing.T) {
+	store := unavailableStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		mode     string
+		expected int
+	}{
+		{name: "Fail closed", mode: config.FailureModeClosed, expected: http.StatusServiceUnavailable},
+		{name: "Fail open", mode: config.FailureModeOpen, expected: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl := limiter.New(store, limiter.Config{
+				IP:          config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute},
+				FailureMode: tt.mode,
+			})
+			handler := middleware.RateLimiterMiddleware(rl, clientIP, nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "192.168.9.1"
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.expected {
+				t.Errorf("Expected %d, got: %d", tt.expected, rr.Code)
+			}
+			if limit := rr.Header().Get("X-RateLimit-Limit"); limit != "" {
+				t.Errorf("Expected no rate limit headers without storage, got X-RateLimit-Limit %q", limit)
+			}
+		})
+	}
+}
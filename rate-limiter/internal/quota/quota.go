@@ -0,0 +1,75 @@
+package quota
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+)
+
+var ErrMissingAPIKey = errors.New("the API_KEY header is required")
+
+// Quota is the JSON representation of the usage of a quota
+type Quota struct {
+	Period    string    `json:"period"`
+	Limit     int       `json:"limit"`
+	Used      int       `json:"used"`
+	Remaining int       `json:"remaining"`
+	ResetAt   time.Time `json:"reset_at"`
+}
+
+// Response is the JSON representation of the quotas of an API key
+type Response struct {
+	Quotas []Quota `json:"quotas"`
+}
+
+// NewHandler creates the handler showing the usage of the quotas of the API key in the
+// API_KEY header, in the current calendar periods. The handler does not count a request,
+// so it should be served behind the rate limiter middleware, which rejects the unknown
+// keys and limits the queries of each key and IP.
+func NewHandler(rateLimiter *limiter.RateLimiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(middleware.APIKeyHeader)
+		if token == "" {
+			writeError(w, http.StatusUnauthorized, ErrMissingAPIKey)
+			return
+		}
+
+		usages, err := rateLimiter.Quotas(r.Context(), token)
+		if errors.Is(err, limiter.ErrInvalidToken) {
+			writeError(w, http.StatusUnauthorized, errors.New(middleware.InvalidAPIKeyMessage))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusServiceUnavailable, limiter.ErrStorageUnavailable)
+			return
+		}
+
+		response := Response{Quotas: make([]Quota, 0, len(usages))}
+		for _, usage := range usages {
+			response.Quotas = append(response.Quotas, Quota{
+				Period:    usage.Period,
+				Limit:     usage.Limit,
+				Used:      usage.Used,
+				Remaining: usage.Remaining,
+				ResetAt:   usage.ResetAt,
+			})
+		}
+		writeJSON(w, http.StatusOK, response)
+	})
+}
+
+// writeJSON responds with a JSON body
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeError responds with a JSON error
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
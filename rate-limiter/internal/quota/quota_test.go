@@ -0,0 +1,89 @@
+package quota_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/quota"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+)
+
+func TestHandler(t *testing.T) {
+	registry, err := tokens.NewFileStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatalf("Error opening token registry: %v", err)
+	}
+	_, key, err := registry.Create("acme", "pro", time.Time{})
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+
+	rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 1, RateWindow: time.Second},
+		Plan: map[string]config.LimiterConfig{
+			"pro": {RateLimit: 100, RateWindow: time.Second, Quotas: map[string]int{config.QuotaPeriodMonth: 1000000}},
+		},
+	})
+	defer rl.Close()
+	rl.SetTokenStore(registry)
+	handler := quota.NewHandler(rl)
+
+	// get queries the quotas of an API key
+	get := func(apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/quota", nil)
+		if apiKey != "" {
+			req.Header.Set("API_KEY", apiKey)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Remaining quota", func(t *testing.T) {
+		for i := 0; i < 2; i++ {
+			if _, err := rl.Allow(t.Context(), "192.168.1.1", key); err != nil {
+				t.Fatalf("Error checking rate limit: %v", err)
+			}
+		}
+
+		rr := get(key)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		body := rr.Body.String()
+		var response quota.Response
+		if err := json.Unmarshal([]byte(body), &response); err != nil {
+			t.Fatalf("Error decoding response: %v", err)
+		}
+		if len(response.Quotas) != 1 {
+			t.Fatalf("Expected 1 quota, got %+v", response.Quotas)
+		}
+		month := response.Quotas[0]
+		if month.Period != "month" || month.Limit != 1000000 || month.Used != 2 || month.Remaining != 999998 {
+			t.Errorf("Unexpected month quota %+v", month)
+		}
+		if month.ResetAt.Day() != 1 || !month.ResetAt.After(time.Now()) {
+			t.Errorf("Expected the quota to reset on the first day of the next month, got %v", month.ResetAt)
+		}
+
+		// Querying does not count a request
+		if again := get(key); again.Body.String() != body {
+			t.Errorf("Querying the quota should not change it, got %s", again.Body.String())
+		}
+	})
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		for _, apiKey := range []string{"", "rl_unknown"} {
+			if rr := get(apiKey); rr.Code != http.StatusUnauthorized {
+				t.Errorf("Expected 401 for API key %q, got %d", apiKey, rr.Code)
+			}
+		}
+	})
+}
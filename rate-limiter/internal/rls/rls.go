@@ -0,0 +1,218 @@
+package rls
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	corev3 "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// RemoteAddressKey is the key of the descriptor entry set by the remote_address action of Envoy
+const RemoteAddressKey = "remote_address"
+
+// units are the windows Envoy can describe in a limit
+var units = []struct {
+	window time.Duration
+	unit   rlsv3.RateLimitResponse_RateLimit_Unit
+}{
+	{time.Second, rlsv3.RateLimitResponse_RateLimit_SECOND},
+	{time.Minute, rlsv3.RateLimitResponse_RateLimit_MINUTE},
+	{time.Hour, rlsv3.RateLimitResponse_RateLimit_HOUR},
+	{24 * time.Hour, rlsv3.RateLimitResponse_RateLimit_DAY},
+}
+
+// Server implements the ShouldRateLimit API of Envoy's rate limit service, checking
+// each descriptor with the rate limiter
+//
+// A descriptor is checked when it has a remote_address entry, which is the IP of the
+// request, and may carry the API key, the path and the HTTP method in the entries
+// named by the configuration. The path selects the route policy whose pattern is
+// equal to it. Descriptors without a remote_address entry are not limited, and the
+// domain is ignored, so every service sharing the limiter shares its counters. The
+// hits_addend of a descriptor, or else of the request, is the cost it is counted with.
+// Descriptors counted under the same key, such as a remote_address descriptor and one
+// with the path of a route without a policy, count the request once, with the cost of
+// the first of them.
+type Server struct {
+	rlsv3.UnimplementedRateLimitServiceServer
+
+	rateLimiter *limiter.RateLimiter
+	clientIP    *middleware.ClientIPResolver
+	keys        config.RLSConfig
+}
+
+// NewServer creates the rate limit service over the rate limiter, the client IP
+// resolver normalizes the remote addresses as the HTTP middleware does
+func NewServer(rateLimiter *limiter.RateLimiter, clientIP *middleware.ClientIPResolver, cfg config.RLSConfig) *Server {
+	return &Server{
+		rateLimiter: rateLimiter,
+		clientIP:    clientIP,
+		keys:        cfg,
+	}
+}
+
+// ShouldRateLimit checks the descriptors of a request, which is over the limit when
+// any of them is. The rate limit headers of the most restrictive descriptor are sent
+// to the client. An invalid API key and the IPs and tokens of a deny list are reported
+// as over the limit, and storage failures as gRPC errors, which Envoy handles
+// according to its failure_mode_deny.
+func (s *Server) ShouldRateLimit(ctx context.Context, request *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	response := &rlsv3.RateLimitResponse{OverallCode: rlsv3.RateLimitResponse_OK}
+
+	var (
+		restrictive limiter.Decision
+		found       bool
+		shadow      *limiter.Decision
+		// checked holds the decisions by key, so descriptors sharing a key count the request once
+		checked = make(map[string]limiter.Decision)
+	)
+	for _, descriptor := range request.GetDescriptors() {
+		ip, token, method, path := s.entries(descriptor)
+		if ip == "" {
+			response.Statuses = append(response.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OK})
+			continue
+		}
+
+		key, keyErr := s.rateLimiter.KeyFor(ctx, method, path, ip, token)
+		if decision, found := checked[key]; keyErr == nil && found {
+			response.Statuses = append(response.Statuses, descriptorStatus(decision))
+			continue
+		}
+
+		decision, err := s.rateLimiter.AllowRoute(withHitsAddend(ctx, request, descriptor), method, path, ip, token)
+		if errors.Is(err, limiter.ErrInvalidToken) || errors.Is(err, limiter.ErrDenied) {
+			message := middleware.InvalidAPIKeyMessage
+			if errors.Is(err, limiter.ErrDenied) {
+				message = middleware.AccessDeniedMessage
+			}
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+			response.RawBody = []byte(message)
+			response.Statuses = append(response.Statuses, &rlsv3.RateLimitResponse_DescriptorStatus{Code: rlsv3.RateLimitResponse_OVER_LIMIT})
+			continue
+		}
+		if errors.Is(err, limiter.ErrStorageUnavailable) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+
+		if keyErr == nil {
+			checked[key] = decision
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus(decision))
+		if !decision.Allowed {
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+
+		// Report the shadow decision denying the request, if any
+		if decision.Shadow != nil && (shadow == nil || shadow.Allowed) {
+			shadow = decision.Shadow
+		}
+
+		// Degraded, allow list and dry run decisions were not counted, so there is no limit state to describe
+		if decision.Degraded || decision.Access != "" || decision.DryRun {
+			continue
+		}
+		if !found || (restrictive.Allowed && (!decision.Allowed || decision.Remaining < restrictive.Remaining)) {
+			restrictive, found = decision, true
+		}
+	}
+
+	header := make(http.Header)
+	if found {
+		middleware.SetRateLimitHeaders(header, restrictive)
+		if !restrictive.Allowed {
+			header.Set("Retry-After", middleware.RetryAfter(restrictive))
+		}
+	}
+	if shadow != nil {
+		middleware.SetShadowHeader(header, *shadow)
+	}
+	if len(header) > 0 {
+		response.ResponseHeadersToAdd = headerValues(header)
+	}
+	return response, nil
+}
+
+// withHitsAddend returns a context in which a descriptor costs its hits_addend, or
+// the hits_addend of the request when it has none, instead of the cost of its route
+func withHitsAddend(ctx context.Context, request *rlsv3.RateLimitRequest, descriptor *ratelimitv3.RateLimitDescriptor) context.Context {
+	hits := uint64(request.GetHitsAddend())
+	if addend := descriptor.GetHitsAddend(); addend != nil {
+		hits = addend.GetValue()
+	}
+	if hits == 0 {
+		return ctx
+	}
+	return limiter.WithCost(ctx, int(min(hits, math.MaxInt32)))
+}
+
+// entries returns the IP, API key, HTTP method and path carried by a descriptor
+func (s *Server) entries(descriptor *ratelimitv3.RateLimitDescriptor) (string, string, string, string) {
+	var ip, token, method, path string
+	for _, entry := range descriptor.GetEntries() {
+		switch entry.GetKey() {
+		case RemoteAddressKey:
+			ip = s.clientIP.Normalize(entry.GetValue())
+		case s.keys.TokenKey:
+			token = entry.GetValue()
+		case s.keys.MethodKey:
+			method = entry.GetValue()
+		case s.keys.PathKey:
+			// The :path header carries the query string, which is not part of the route
+			path, _, _ = strings.Cut(entry.GetValue(), "?")
+		}
+	}
+	return ip, token, method, path
+}
+
+// descriptorStatus describes the decision of a descriptor
+func descriptorStatus(decision limiter.Decision) *rlsv3.RateLimitResponse_DescriptorStatus {
+	descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code:           rlsv3.RateLimitResponse_OK,
+		LimitRemaining: uint32(max(decision.Remaining, 0)),
+	}
+	if !decision.Allowed {
+		descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+	if !decision.ResetAt.IsZero() {
+		descriptorStatus.DurationUntilReset = durationpb.New(max(time.Until(decision.ResetAt), 0))
+	}
+
+	// Envoy only describes limits over whole units, other windows are left out
+	for _, u := range units {
+		if decision.Window == u.window {
+			descriptorStatus.CurrentLimit = &rlsv3.RateLimitResponse_RateLimit{
+				Name:            decision.Route,
+				RequestsPerUnit: uint32(max(decision.Limit, 0)),
+				Unit:            u.unit,
+			}
+			break
+		}
+	}
+	return descriptorStatus
+}
+
+// headerValues converts HTTP headers to the headers Envoy adds to the response
+func headerValues(header http.Header) []*corev3.HeaderValue {
+	values := make([]*corev3.HeaderValue, 0, len(header))
+	for _, name := range slices.Sorted(maps.Keys(header)) {
+		values = append(values, &corev3.HeaderValue{Key: name, Value: header.Get(name)})
+	}
+	return values
+}
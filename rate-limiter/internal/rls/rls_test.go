@@ -0,0 +1,262 @@
+package rls_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/rls"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+var rlsConfig = config.RLSConfig{TokenKey: "api_key", PathKey: "path", MethodKey: "method"}
+
+// newClient serves the rate limit service of the limiter in memory and returns a client of it
+func newClient(t *testing.T, rl *limiter.RateLimiter) rlsv3.RateLimitServiceClient {
+	t.Helper()
+
+	clientIP, err := middleware.NewClientIPResolver(config.ClientIPConfig{IPv6Prefix: 64})
+	if err != nil {
+		t.Fatalf("Error creating client IP resolver: %v", err)
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(server, rls.NewServer(rl, clientIP, rlsConfig))
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Error connecting to the rate limit service: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+// descriptor builds a descriptor from key and value pairs
+func descriptor(pairs ...string) *ratelimitv3.RateLimitDescriptor {
+	d := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i < len(pairs); i += 2 {
+		d.Entries = append(d.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: pairs[i], Value: pairs[i+1]})
+	}
+	return d
+}
+
+// shouldRateLimit calls the rate limit service and fails the test on error
+func shouldRateLimit(t *testing.T, client rlsv3.RateLimitServiceClient, descriptors ...*ratelimitv3.RateLimitDescriptor) *rlsv3.RateLimitResponse {
+	t.Helper()
+
+	response, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{Domain: "clima", Descriptors: descriptors})
+	if err != nil {
+		t.Fatalf("Error checking rate limit: %v", err)
+	}
+	return response
+}
+
+// header returns the value of a header Envoy is asked to add to the response
+func header(response *rlsv3.RateLimitResponse, name string) string {
+	for _, h := range response.GetResponseHeadersToAdd() {
+		if h.GetKey() == name {
+			return h.GetValue()
+		}
+	}
+	return ""
+}
+
+func TestServer(t *testing.T) {
+	rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+		IP: config.LimiterConfig{RateLimit: 2, RateWindow: time.Minute, BlockDuration: time.Minute},
+		Token: map[string]config.LimiterConfig{
+			"abc": {RateLimit: 3, RateWindow: time.Second, BlockDuration: time.Minute},
+		},
+		Route: map[string]config.RouteConfig{
+			"login": {Method: "POST", Pattern: "/login", LimiterConfig: config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute}},
+		},
+	})
+	defer rl.Close()
+	client := newClient(t, rl)
+
+	t.Run("Limits the remote address by the IP policy", func(t *testing.T) {
+		for i := range 2 {
+			response := shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "192.168.1.1"))
+			if response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+				t.Fatalf("Request %d should be allowed, got %v", i+1, response.GetOverallCode())
+			}
+			descriptorStatus := response.GetStatuses()[0]
+			if descriptorStatus.GetLimitRemaining() != uint32(1-i) {
+				t.Errorf("Expected %d remaining, got %d", 1-i, descriptorStatus.GetLimitRemaining())
+			}
+			if limit := descriptorStatus.GetCurrentLimit(); limit.GetRequestsPerUnit() != 2 || limit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+				t.Errorf("Expected a limit of 2 per minute, got %v", limit)
+			}
+		}
+
+		response := shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "192.168.1.1"))
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("Request should be over the limit, got %v", response.GetOverallCode())
+		}
+		if header(response, "Retry-After") == "" || header(response, "X-Ratelimit-Limit") != "2" {
+			t.Errorf("Expected rate limit headers, got %v", response.GetResponseHeadersToAdd())
+		}
+	})
+
+	t.Run("Limits the API key by the token policy", func(t *testing.T) {
+		for i := range 3 {
+			response := shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "192.168.1.2", "api_key", "abc"))
+			if response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+				t.Fatalf("Request %d should be allowed, got %v", i+1, response.GetOverallCode())
+			}
+			if unit := response.GetStatuses()[0].GetCurrentLimit().GetUnit(); unit != rlsv3.RateLimitResponse_RateLimit_SECOND {
+				t.Errorf("Expected the token limit per second, got %v", unit)
+			}
+		}
+	})
+
+	t.Run("Applies the route policy of the path and method", func(t *testing.T) {
+		login := descriptor(rls.RemoteAddressKey, "192.168.1.3", "method", "POST", "path", "/login?next=/")
+		if response := shouldRateLimit(t, client, login); response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+			t.Fatalf("First login should be allowed, got %v", response.GetOverallCode())
+		}
+		if response := shouldRateLimit(t, client, login); response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("Second login should be over the limit, got %v", response.GetOverallCode())
+		}
+
+		// Other paths use the IP policy
+		other := descriptor(rls.RemoteAddressKey, "192.168.1.3", "method", "GET", "path", "/weather")
+		if response := shouldRateLimit(t, client, other); response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+			t.Errorf("Other paths should be allowed, got %v", response.GetOverallCode())
+		}
+	})
+
+	t.Run("Is over the limit when any descriptor is", func(t *testing.T) {
+		response := shouldRateLimit(t, client,
+			descriptor(rls.RemoteAddressKey, "192.168.1.4"),
+			descriptor(rls.RemoteAddressKey, "192.168.1.1"),
+			descriptor("generic_key", "weather"),
+		)
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("Request should be over the limit, got %v", response.GetOverallCode())
+		}
+		expected := []rlsv3.RateLimitResponse_Code{rlsv3.RateLimitResponse_OK, rlsv3.RateLimitResponse_OVER_LIMIT, rlsv3.RateLimitResponse_OK}
+		for i, descriptorStatus := range response.GetStatuses() {
+			if descriptorStatus.GetCode() != expected[i] {
+				t.Errorf("Descriptor %d: expected %v, got %v", i, expected[i], descriptorStatus.GetCode())
+			}
+		}
+	})
+
+	t.Run("Counts descriptors sharing a key once", func(t *testing.T) {
+		response := shouldRateLimit(t, client,
+			descriptor(rls.RemoteAddressKey, "192.168.1.7"),
+			descriptor(rls.RemoteAddressKey, "192.168.1.7", "method", "GET", "path", "/weather"),
+		)
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+			t.Fatalf("Request should be allowed, got %v", response.GetOverallCode())
+		}
+		for i, descriptorStatus := range response.GetStatuses() {
+			if descriptorStatus.GetLimitRemaining() != 1 {
+				t.Errorf("Descriptor %d: expected 1 remaining, got %d", i, descriptorStatus.GetLimitRemaining())
+			}
+		}
+	})
+
+	t.Run("Counts the hits addend", func(t *testing.T) {
+		response, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+			Domain:      "clima",
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(rls.RemoteAddressKey, "192.168.1.5")},
+			HitsAddend:  2,
+		})
+		if err != nil {
+			t.Fatalf("Error checking rate limit: %v", err)
+		}
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OK || response.GetStatuses()[0].GetLimitRemaining() != 0 {
+			t.Errorf("Request should use the whole limit, got %v", response)
+		}
+
+		// The hits addend of a descriptor wins over the one of the request
+		heavy := descriptor(rls.RemoteAddressKey, "192.168.1.6")
+		heavy.HitsAddend = wrapperspb.UInt64(3)
+		if response := shouldRateLimit(t, client, heavy); response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("Descriptor costing more than the limit should be over it, got %v", response.GetOverallCode())
+		}
+	})
+
+	t.Run("Aggregates IPv6 addresses like the middleware", func(t *testing.T) {
+		shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "2001:db8::1"))
+		shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "2001:db8::2"))
+		response := shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "2001:db8::3"))
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("Addresses of the same /64 should share the limit, got %v", response.GetOverallCode())
+		}
+	})
+}
+
+// emptyTokenStore is a token registry without API keys
+type emptyTokenStore struct{}
+
+func (emptyTokenStore) Lookup(ctx context.Context, key string) (tokens.Token, error) {
+	return tokens.Token{}, tokens.ErrNotFound
+}
+
+// unavailableStorage is a storage whose Take always fails, as when Redis is down
+type unavailableStorage struct {
+	storage.Storage
+}
+
+func (unavailableStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	return storage.Result{}, errors.New("connection refused")
+}
+
+func TestServerErrors(t *testing.T) {
+	t.Run("Rejects invalid API keys", func(t *testing.T) {
+		rl := limiter.New(storage.NewMemoryStorage(config.StorageConfig{}), limiter.Config{
+			IP: config.LimiterConfig{RateLimit: 2, RateWindow: time.Minute},
+		})
+		defer rl.Close()
+		rl.SetTokenStore(emptyTokenStore{})
+		client := newClient(t, rl)
+
+		response := shouldRateLimit(t, client, descriptor(rls.RemoteAddressKey, "192.168.1.1", "api_key", "rl_unknown"))
+		if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+			t.Errorf("Invalid API key should be over the limit, got %v", response.GetOverallCode())
+		}
+		if string(response.GetRawBody()) != middleware.InvalidAPIKeyMessage {
+			t.Errorf("Expected body %q, got %q", middleware.InvalidAPIKeyMessage, response.GetRawBody())
+		}
+	})
+
+	t.Run("Fails with Unavailable when the storage fails", func(t *testing.T) {
+		rl := limiter.New(unavailableStorage{storage.NewMemoryStorage(config.StorageConfig{})}, limiter.Config{
+			IP: config.LimiterConfig{RateLimit: 2, RateWindow: time.Minute},
+		})
+		defer rl.Close()
+		client := newClient(t, rl)
+
+		_, err := client.ShouldRateLimit(context.Background(), &rlsv3.RateLimitRequest{
+			Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor(rls.RemoteAddressKey, "192.168.1.1")},
+		})
+		if status.Code(err) != codes.Unavailable {
+			t.Errorf("Expected Unavailable, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,292 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+)
+
+const (
+	// DefaultBreakerThreshold is how many consecutive failures open the circuit breaker by default
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerTimeout is how long the circuit breaker stays open by default
+	DefaultBreakerTimeout = 10 * time.Second
+)
+
+var (
+	ErrCircuitOpen = errors.New("storage circuit breaker is open")
+)
+
+// Circuit breaker states
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// BreakerStorage wraps a storage with a circuit breaker. After Threshold consecutive
+// failures the breaker opens and the calls fail with ErrCircuitOpen without reaching
+// the storage. Once Timeout elapses a single call probes the storage, closing the
+// breaker when it succeeds and opening it again when it fails.
+//
+// With a fallback storage, the calls that fail or are rejected by the open breaker
+// are served by the fallback instead, so requests keep being limited locally while
+// the storage is unavailable.
+type BreakerStorage struct {
+	storage   Storage
+	fallback  Storage
+	threshold int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+// NewBreaker wraps a storage with a circuit breaker, fallback may be nil
+func NewBreaker(storage Storage, cfg config.FailureConfig, fallback Storage) *BreakerStorage {
+	threshold := cfg.Threshold
+	if threshold <= 0 {
+		threshold = DefaultBreakerThreshold
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = DefaultBreakerTimeout
+	}
+
+	return &BreakerStorage{
+		storage:   storage,
+		fallback:  fallback,
+		threshold: threshold,
+		timeout:   timeout,
+	}
+}
+
+// Open reports whether the breaker is rejecting the calls to the storage
+func (b *BreakerStorage) Open() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != breakerClosed
+}
+
+// Get returns the current count for a key
+func (b *BreakerStorage) Get(ctx context.Context, key string) (int, error) {
+	return call(b, ctx, func(s Storage) (int, error) {
+		return s.Get(ctx, key)
+	})
+}
+
+// Increment increments the counter for a key and returns the new value
+func (b *BreakerStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+	return call(b, ctx, func(s Storage) (int, error) {
+		return s.Increment(ctx, key, expiration)
+	})
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (b *BreakerStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+	return call(b, ctx, func(s Storage) (int, error) {
+		return s.IncrementBy(ctx, key, n, expiration)
+	})
+}
+
+// Take checks the blocks, registers the request and blocks the keys when the limit is exceeded
+func (b *BreakerStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Result, error) {
+	return call(b, ctx, func(s Storage) (Result, error) {
+		return s.Take(ctx, key, cost, limiterConfig, linked...)
+	})
+}
+
+// Acquire takes a concurrency slot of a key for the lease, or renews the lease
+func (b *BreakerStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	return call(b, ctx, func(s Storage) (bool, error) {
+		return s.Acquire(ctx, key, id, limit, lease)
+	})
+}
+
+// Release frees the concurrency slot held by a lease, in the fallback as well since
+// the slot may have been taken there while the breaker was open. The errors of both
+// storages are returned.
+func (b *BreakerStorage) Release(ctx context.Context, key, id string) error {
+	var fallbackErr error
+	if b.fallback != nil {
+		fallbackErr = b.fallback.Release(ctx, key, id)
+	}
+	_, err := callWith(b, ctx, nil, func(s Storage) (struct{}, error) {
+		return struct{}{}, s.Release(ctx, key, id)
+	})
+	return errors.Join(err, fallbackErr)
+}
+
+// Reset resets the counter for a key, never in the fallback, as the admin API would report
+// a reset the other instances don't see
+func (b *BreakerStorage) Reset(ctx context.Context, key string) error {
+	_, err := callWith(b, ctx, nil, func(s Storage) (struct{}, error) {
+		return struct{}{}, s.Reset(ctx, key)
+	})
+	return err
+}
+
+// IsBlocked checks if a key is in the blocklist
+func (b *BreakerStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return call(b, ctx, func(s Storage) (bool, error) {
+		return s.IsBlocked(ctx, key)
+	})
+}
+
+// Block adds a key to the blocklist with the given expiration, never in the fallback
+func (b *BreakerStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
+	_, err := callWith(b, ctx, nil, func(s Storage) (struct{}, error) {
+		return struct{}{}, s.Block(ctx, key, expiration)
+	})
+	return err
+}
+
+// Unblock removes a key from the blocklist, never from the fallback
+func (b *BreakerStorage) Unblock(ctx context.Context, key string) error {
+	_, err := callWith(b, ctx, nil, func(s Storage) (struct{}, error) {
+		return struct{}{}, s.Unblock(ctx, key)
+	})
+	return err
+}
+
+// State returns the counters and the block of a key. The fallback is never used, as its
+// state is not shared with the other instances.
+func (b *BreakerStorage) State(ctx context.Context, key string) (KeyState, error) {
+	return callWith(b, ctx, nil, func(s Storage) (KeyState, error) {
+		return s.State(ctx, key)
+	})
+}
+
+// List returns the state of every key with counters or blocks, never of the fallback
+func (b *BreakerStorage) List(ctx context.Context) ([]KeyState, error) {
+	return callWith(b, ctx, nil, func(s Storage) ([]KeyState, error) {
+		return s.List(ctx)
+	})
+}
+
+// Blocks returns how long each blocked key stays blocked, never in the fallback
+func (b *BreakerStorage) Blocks(ctx context.Context) (map[string]time.Duration, error) {
+	return callWith(b, ctx, nil, func(s Storage) (map[string]time.Duration, error) {
+		return s.Blocks(ctx)
+	})
+}
+
+// AccessList returns the sorted entries of an access list. The fallback is never used,
+// as its lists are not shared with the other instances.
+func (b *BreakerStorage) AccessList(ctx context.Context, list string) ([]string, error) {
+	return callWith(b, ctx, nil, func(s Storage) ([]string, error) {
+		return s.AccessList(ctx, list)
+	})
+}
+
+// AddAccess adds an entry to an access list, never in the fallback
+func (b *BreakerStorage) AddAccess(ctx context.Context, list, entry string) error {
+	_, err := callWith(b, ctx, nil, func(s Storage) (struct{}, error) {
+		return struct{}{}, s.AddAccess(ctx, list, entry)
+	})
+	return err
+}
+
+// RemoveAccess removes an entry from an access list, never from the fallback
+func (b *BreakerStorage) RemoveAccess(ctx context.Context, list, entry string) error {
+	_, err := callWith(b, ctx, nil, func(s Storage) (struct{}, error) {
+		return struct{}{}, s.RemoveAccess(ctx, list, entry)
+	})
+	return err
+}
+
+// Close closes the storage and the fallback
+func (b *BreakerStorage) Close() error {
+	err := b.storage.Close()
+	if b.fallback != nil {
+		err = errors.Join(err, b.fallback.Close())
+	}
+	return err
+}
+
+// call runs fn on the storage when the breaker lets it through, and on the
+// fallback when the breaker is open or the storage fails
+func call[T any](b *BreakerStorage, ctx context.Context, fn func(Storage) (T, error)) (T, error) {
+	return callWith(b, ctx, b.fallback, fn)
+}
+
+// callWith runs fn on the storage when the breaker lets it through, and on the
+// given fallback, which may be nil, when the breaker is open or the storage fails
+func callWith[T any](b *BreakerStorage, ctx context.Context, fallback Storage, fn func(Storage) (T, error)) (T, error) {
+	if !b.allow() {
+		if fallback != nil {
+			return fn(fallback)
+		}
+		var zero T
+		return zero, ErrCircuitOpen
+	}
+
+	value, err := fn(b.storage)
+	if !b.record(ctx, err) || fallback == nil {
+		return value, err
+	}
+	return fn(fallback)
+}
+
+// allow reports whether a call may reach the storage, letting a single probe
+// through once the open breaker times out
+func (b *BreakerStorage) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.timeout {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// The probe is still running
+		return false
+	default:
+		return true
+	}
+}
+
+// record updates the breaker with the outcome of a call, reporting whether it
+// failed. Invalid configurations and requests abandoned by the client are not
+// storage failures.
+func (b *BreakerStorage) record(ctx context.Context, err error) bool {
+	failed := err != nil && !errors.Is(err, ErrUnknownAlgorithm) && !errors.Is(err, ErrInvalidLimit) && ctx.Err() == nil
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err == nil {
+		if b.state == breakerHalfOpen {
+			log.Printf("Storage circuit breaker closed, the storage is available again")
+		}
+		b.state, b.failures = breakerClosed, 0
+		return false
+	}
+	if !failed {
+		// An inconclusive probe lets the next call probe the storage again
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+		return false
+	}
+
+	b.failures++
+	switch {
+	case b.state == breakerHalfOpen:
+		b.state, b.openedAt = breakerOpen, time.Now()
+		log.Printf("Storage circuit breaker opened again, the storage is still failing: %v", err)
+	case b.state == breakerClosed && b.failures >= b.threshold:
+		b.state, b.openedAt = breakerOpen, time.Now()
+		log.Printf("Storage circuit breaker opened after %d consecutive failures: %v", b.failures, err)
+	}
+	return true
+}
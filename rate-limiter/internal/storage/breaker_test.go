@@ -0,0 +1,169 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+var errUnavailable = errors.New("connection refused")
+
+// flakyStorage is a memory storage whose Take fails while failing is set
+type flakyStorage struct {
+	storage.Storage
+	failing atomic.Bool
+	calls   atomic.Int32
+}
+
+func (s *flakyStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	s.calls.Add(1)
+	if s.failing.Load() {
+		return storage.Result{}, errUnavailable
+	}
+	return s.Storage.Take(ctx, key, cost, limiterConfig, linked...)
+}
+
+// failingRelease is a memory storage whose Release always fails
+type failingRelease struct {
+	storage.Storage
+}
+
+func (failingRelease) Release(ctx context.Context, key, id string) error {
+	return errUnavailable
+}
+
+func TestBreakerStorage(t *testing.T) {
+	limiterConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute}
+	failureConfig := config.FailureConfig{Threshold: 2, Timeout: 100 * time.Millisecond}
+
+	t.Run("Opens after consecutive failures and closes after a successful probe", func(t *testing.T) {
+		flaky := &flakyStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+		breaker := storage.NewBreaker(flaky, failureConfig, nil)
+		defer breaker.Close()
+
+		flaky.failing.Store(true)
+		for i := 0; i < 2; i++ {
+			if _, err := breaker.Take(context.Background(), "ip:1", 1, limiterConfig); !errors.Is(err, errUnavailable) {
+				t.Errorf("Expected the storage error, got %v", err)
+			}
+		}
+		if !breaker.Open() {
+			t.Fatalf("Expected the breaker to open after 2 failures")
+		}
+
+		// The open breaker does not reach the storage
+		if _, err := breaker.Take(context.Background(), "ip:1", 1, limiterConfig); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected ErrCircuitOpen, got %v", err)
+		}
+		if calls := flaky.calls.Load(); calls != 2 {
+			t.Errorf("Expected 2 calls to the storage, got %d", calls)
+		}
+
+		// A failed probe opens the breaker again
+		time.Sleep(150 * time.Millisecond)
+		if _, err := breaker.Take(context.Background(), "ip:1", 1, limiterConfig); !errors.Is(err, errUnavailable) {
+			t.Errorf("Expected the probe to reach the storage, got %v", err)
+		}
+		if _, err := breaker.Take(context.Background(), "ip:1", 1, limiterConfig); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected ErrCircuitOpen after a failed probe, got %v", err)
+		}
+
+		// A successful probe closes it
+		flaky.failing.Store(false)
+		time.Sleep(150 * time.Millisecond)
+		if _, err := breaker.Take(context.Background(), "ip:1", 1, limiterConfig); err != nil {
+			t.Errorf("Expected the probe to succeed, got %v", err)
+		}
+		if breaker.Open() {
+			t.Errorf("Expected the breaker to close after a successful probe")
+		}
+	})
+
+	t.Run("Fallback limits while the storage is unavailable", func(t *testing.T) {
+		flaky := &flakyStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+		breaker := storage.NewBreaker(flaky, failureConfig, storage.NewMemoryStorage(config.StorageConfig{}))
+		defer breaker.Close()
+
+		flaky.failing.Store(true)
+		for i, expected := range []bool{true, false, false} {
+			result, err := breaker.Take(context.Background(), "ip:1", 1, limiterConfig)
+			if err != nil {
+				t.Fatalf("Expected the fallback to serve request %d, got %v", i+1, err)
+			}
+			if result.Allowed != expected {
+				t.Errorf("Expected request %d allowed %v, got %v", i+1, expected, result.Allowed)
+			}
+		}
+		if !breaker.Open() {
+			t.Errorf("Expected the breaker to open even with a fallback")
+		}
+	})
+
+	t.Run("Admin operations never use the fallback", func(t *testing.T) {
+		flaky := &flakyStorage{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+		fallback := storage.NewMemoryStorage(config.StorageConfig{})
+		breaker := storage.NewBreaker(flaky, failureConfig, fallback)
+		defer breaker.Close()
+
+		flaky.failing.Store(true)
+		for i := 0; i < 2; i++ {
+			breaker.Take(context.Background(), "ip:1", 1, limiterConfig)
+		}
+		if !breaker.Open() {
+			t.Fatalf("Expected the breaker to open after 2 failures")
+		}
+
+		ctx := context.Background()
+		if err := breaker.Block(ctx, "ip:2", time.Minute); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected Block to fail with ErrCircuitOpen, got %v", err)
+		}
+		if blocked, _ := fallback.IsBlocked(ctx, "ip:2"); blocked {
+			t.Errorf("Expected the block not to reach the fallback")
+		}
+		if err := breaker.Unblock(ctx, "ip:1"); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected Unblock to fail with ErrCircuitOpen, got %v", err)
+		}
+		if err := breaker.Reset(ctx, "ip:1"); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected Reset to fail with ErrCircuitOpen, got %v", err)
+		}
+		if _, err := breaker.State(ctx, "ip:1"); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected State to fail with ErrCircuitOpen, got %v", err)
+		}
+		if _, err := breaker.List(ctx); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected List to fail with ErrCircuitOpen, got %v", err)
+		}
+		if _, err := breaker.Blocks(ctx); !errors.Is(err, storage.ErrCircuitOpen) {
+			t.Errorf("Expected Blocks to fail with ErrCircuitOpen, got %v", err)
+		}
+	})
+
+	t.Run("Release reports the fallback errors", func(t *testing.T) {
+		fallback := failingRelease{Storage: storage.NewMemoryStorage(config.StorageConfig{})}
+		breaker := storage.NewBreaker(storage.NewMemoryStorage(config.StorageConfig{}), failureConfig, fallback)
+		defer breaker.Close()
+
+		if err := breaker.Release(context.Background(), "ip:1", "lease"); !errors.Is(err, errUnavailable) {
+			t.Errorf("Expected the fallback error, got %v", err)
+		}
+	})
+
+	t.Run("Invalid configurations are not failures", func(t *testing.T) {
+		breaker := storage.NewBreaker(storage.NewMemoryStorage(config.StorageConfig{}), failureConfig, nil)
+		defer breaker.Close()
+
+		for i := 0; i < 3; i++ {
+			_, err := breaker.Take(context.Background(), "ip:1", 1, config.LimiterConfig{Algorithm: "unknown"})
+			if !errors.Is(err, storage.ErrUnknownAlgorithm) {
+				t.Errorf("Expected ErrUnknownAlgorithm, got %v", err)
+			}
+		}
+		if breaker.Open() {
+			t.Errorf("Expected the breaker to stay closed")
+		}
+	})
+}
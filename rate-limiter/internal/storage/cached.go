@@ -0,0 +1,468 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultFlushInterval is how often the cached Redis storage syncs with Redis by default
+const DefaultFlushInterval = 100 * time.Millisecond
+
+// CachedStorage is a two-tier storage that keeps a local cache in front of Redis,
+// so most requests are decided without a round trip:
+//
+//   - The blocks seen by the instance are cached until they expire, rejecting the
+//     blocked keys locally.
+//   - Fixed window requests are counted locally while the window count last read
+//     from Redis plus the local count is under the limit. The local counts are added
+//     to Redis every FlushInterval, which also reads back the counts and blocks of
+//     the other instances. A request that would reach the limit is taken in Redis,
+//     which blocks the keys as usual.
+//   - The other algorithms are taken in Redis, only benefiting from the block cache.
+//
+// Each instance may allow up to the requests the others counted in the last
+// FlushInterval above the limit, and sees the blocks set or removed by the others
+// up to FlushInterval late.
+type CachedStorage struct {
+	redis    *RedisStorage
+	interval time.Duration
+
+	mu sync.Mutex
+	// blocks maps the blocked keys to the block expiry, zero when it never expires
+	blocks   map[string]time.Time
+	counters map[string]*cachedCounter
+
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// cachedCounter is the local state of a fixed window key
+type cachedCounter struct {
+	limit  int
+	window time.Duration
+	// count is the window count last read from Redis
+	count int
+	// pending is how many requests were allowed locally and not yet added to Redis
+	pending    int
+	windowEnds time.Time
+	linked     []string
+}
+
+// NewCached creates a new cached Redis storage on a single server, sentinel master or cluster
+func NewCached(cfg config.StorageConfig) (*CachedStorage, error) {
+	redisStore, err := NewRedis(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// The flushes run the script by its hash
+	if err := incrementByScript.Load(context.Background(), redisStore.client).Err(); err != nil {
+		redisStore.Close()
+		return nil, err
+	}
+
+	interval := cfg.FlushInterval
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+
+	s := &CachedStorage{
+		redis:    redisStore,
+		interval: interval,
+		blocks:   make(map[string]time.Time),
+		counters: make(map[string]*cachedCounter),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+// Get returns the current count for a key, including the requests not yet flushed
+func (s *CachedStorage) Get(ctx context.Context, key string) (int, error) {
+	count, err := s.redis.Get(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counter, found := s.counters[key]; found {
+		count += counter.pending
+	}
+	return count, nil
+}
+
+// Increment increments the counter for a key and returns the new value
+func (s *CachedStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+	return s.redis.Increment(ctx, key, expiration)
+}
+
+// IncrementBy adds n to the counter for a key in Redis and returns the new value
+func (s *CachedStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+	return s.redis.IncrementBy(ctx, key, n, expiration)
+}
+
+// Take checks the cached blocks and counts fixed window requests locally while the
+// limit is not near, taking the request in Redis otherwise
+func (s *CachedStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Result, error) {
+	now := time.Now()
+	fixedWindow := limiterConfig.Algorithm == "" || limiterConfig.Algorithm == config.AlgorithmFixedWindow
+
+	s.mu.Lock()
+	if result, blocked := s.cachedBlock(now, key, linked); blocked {
+		s.mu.Unlock()
+		return result, nil
+	}
+
+	var pending int
+	if fixedWindow {
+		counter, found := s.counters[key]
+		if found && counter.limit == limiterConfig.RateLimit && counter.window == limiterConfig.RateWindow && now.Before(counter.windowEnds) {
+			if counter.count+counter.pending+cost <= counter.limit {
+				counter.pending += cost
+				counter.linked = linked
+				result := Result{
+					Allowed:    true,
+					Remaining:  counter.limit - counter.count - counter.pending,
+					ResetAfter: counter.windowEnds.Sub(now),
+				}
+				s.mu.Unlock()
+				return result, nil
+			}
+			// The local requests are flushed first, so Redis decides on the whole count
+			pending, counter.pending = counter.pending, 0
+		}
+	}
+	s.mu.Unlock()
+
+	if pending > 0 {
+		err := incrementByScript.Run(ctx, s.redis.client, []string{stateKey(key, config.AlgorithmFixedWindow)},
+			pending, max(limiterConfig.RateWindow.Milliseconds(), 1)).Err()
+		if err != nil {
+			s.restorePending(key, pending)
+			return Result{}, err
+		}
+	}
+
+	result, err := s.redis.Take(ctx, key, cost, limiterConfig, linked...)
+	if err != nil {
+		return Result{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if fixedWindow {
+		counter := &cachedCounter{
+			limit:      limiterConfig.RateLimit,
+			window:     limiterConfig.RateWindow,
+			count:      limiterConfig.RateLimit,
+			windowEnds: now.Add(result.ResetAfter),
+			linked:     linked,
+		}
+		if result.Allowed {
+			counter.count = limiterConfig.RateLimit - result.Remaining
+		}
+		if previous, found := s.counters[key]; found {
+			// Requests allowed locally while Redis was deciding are still pending
+			counter.pending = previous.pending
+		}
+		s.counters[key] = counter
+	}
+
+	if result.Blocked {
+		until := now.Add(result.RetryAfter)
+		s.blocks[key] = until
+		for _, k := range linked {
+			s.blocks[k] = until
+		}
+	} else if result.BlockedKey != "" && !result.Allowed {
+		s.blocks[result.BlockedKey] = now.Add(result.RetryAfter)
+	}
+	return result, nil
+}
+
+// cachedBlock returns the result of a request rejected by a cached block of the key or a linked key
+func (s *CachedStorage) cachedBlock(now time.Time, key string, linked []string) (Result, bool) {
+	for _, k := range append([]string{key}, linked...) {
+		until, found := s.blocks[k]
+		if !found {
+			continue
+		}
+		if until.IsZero() {
+			return Result{BlockedKey: k}, true
+		}
+		if now.Before(until) {
+			ttl := until.Sub(now)
+			return Result{ResetAfter: ttl, RetryAfter: ttl, BlockedKey: k}, true
+		}
+	}
+	return Result{}, false
+}
+
+// restorePending gives back requests that could not be added to Redis, so a later flush retries them
+func (s *CachedStorage) restorePending(key string, pending int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if counter, found := s.counters[key]; found {
+		counter.pending += pending
+	}
+}
+
+// Acquire takes a concurrency slot of a key in Redis, as the slots are shared by every
+// instance and can't be counted locally
+func (s *CachedStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	return s.redis.Acquire(ctx, key, id, limit, lease)
+}
+
+// Release frees the concurrency slot held by a lease in Redis
+func (s *CachedStorage) Release(ctx context.Context, key, id string) error {
+	return s.redis.Release(ctx, key, id)
+}
+
+// Reset resets the counter for a key, dropping the requests not yet flushed
+func (s *CachedStorage) Reset(ctx context.Context, key string) error {
+	s.mu.Lock()
+	delete(s.counters, key)
+	s.mu.Unlock()
+	return s.redis.Reset(ctx, key)
+}
+
+// IsBlocked checks if a key is in the blocklist
+func (s *CachedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return s.redis.IsBlocked(ctx, key)
+}
+
+// Block adds a key to the blocklist with the given expiration
+func (s *CachedStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
+	if err := s.redis.Block(ctx, key, expiration); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var until time.Time
+	if expiration > 0 {
+		until = time.Now().Add(expiration)
+	}
+	s.blocks[key] = until
+	return nil
+}
+
+// Unblock removes a key from the blocklist
+func (s *CachedStorage) Unblock(ctx context.Context, key string) error {
+	if err := s.redis.Unblock(ctx, key); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.blocks, key)
+	return nil
+}
+
+// State returns the counters and the block of a key, the requests not yet flushed are left out
+func (s *CachedStorage) State(ctx context.Context, key string) (KeyState, error) {
+	return s.redis.State(ctx, key)
+}
+
+// List returns the state of every key with counters or blocks, the requests not yet flushed are left out
+func (s *CachedStorage) List(ctx context.Context) ([]KeyState, error) {
+	return s.redis.List(ctx)
+}
+
+// Blocks returns how long each blocked key stays blocked in Redis
+func (s *CachedStorage) Blocks(ctx context.Context) (map[string]time.Duration, error) {
+	return s.redis.Blocks(ctx)
+}
+
+// AccessList returns the sorted entries of an access list from Redis
+func (s *CachedStorage) AccessList(ctx context.Context, list string) ([]string, error) {
+	return s.redis.AccessList(ctx, list)
+}
+
+// AddAccess adds an entry to an access list in Redis
+func (s *CachedStorage) AddAccess(ctx context.Context, list, entry string) error {
+	return s.redis.AddAccess(ctx, list, entry)
+}
+
+// RemoveAccess removes an entry from an access list in Redis
+func (s *CachedStorage) RemoveAccess(ctx context.Context, list, entry string) error {
+	return s.redis.RemoveAccess(ctx, list, entry)
+}
+
+// Close flushes the local counts and closes the Redis connection
+func (s *CachedStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+		<-s.done
+	})
+	return s.redis.Close()
+}
+
+// flushLoop flushes the local counts every interval until the storage is closed
+func (s *CachedStorage) flushLoop() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.Flush(context.Background()); err != nil {
+				log.Printf("Error flushing rate limit counters to redis: %v", err)
+			}
+		case <-s.stop:
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			if err := s.Flush(ctx); err != nil {
+				log.Printf("Error flushing rate limit counters to redis: %v", err)
+			}
+			cancel()
+			return
+		}
+	}
+}
+
+// Flush adds the local counts to Redis and refreshes the cached counts and blocks
+// with the ones set by the other instances. It runs every FlushInterval, so it only
+// needs to be called to sync sooner.
+func (s *CachedStorage) Flush(ctx context.Context) error {
+	type flush struct {
+		key     string
+		pending int
+		window  time.Duration
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	flushes := make([]flush, 0, len(s.counters))
+	refresh := make(map[string]struct{}, len(s.blocks))
+	for key, counter := range s.counters {
+		if !now.Before(counter.windowEnds) {
+			// The requests of a window that ended no longer count
+			delete(s.counters, key)
+			continue
+		}
+		flushes = append(flushes, flush{key: key, pending: counter.pending, window: counter.window})
+		counter.pending = 0
+		refresh[key] = struct{}{}
+		for _, k := range counter.linked {
+			refresh[k] = struct{}{}
+		}
+	}
+	for key, until := range s.blocks {
+		if !until.IsZero() && !now.Before(until) {
+			delete(s.blocks, key)
+			continue
+		}
+		refresh[key] = struct{}{}
+	}
+	s.mu.Unlock()
+
+	if len(flushes) == 0 && len(refresh) == 0 {
+		return nil
+	}
+
+	pipe := s.redis.client.Pipeline()
+	counts := make([]*redis.Cmd, len(flushes))
+	reads := make([]*redis.StringCmd, len(flushes))
+	windows := make([]*redis.DurationCmd, len(flushes))
+	for i, f := range flushes {
+		counterKey := stateKey(f.key, config.AlgorithmFixedWindow)
+		if f.pending > 0 {
+			// A pipeline can't retry a missing script, so it is loaded up front and again on NOSCRIPT
+			counts[i] = incrementByScript.EvalSha(ctx, pipe, []string{counterKey}, f.pending, max(f.window.Milliseconds(), 1))
+		} else {
+			reads[i] = pipe.Get(ctx, counterKey)
+			windows[i] = pipe.PTTL(ctx, counterKey)
+		}
+	}
+	ttls := make(map[string]*redis.DurationCmd, len(refresh))
+	for key := range refresh {
+		ttls[key] = pipe.PTTL(ctx, blocklistKey(key))
+	}
+	// Errors are checked per command, so the counts that were added are not restored
+	_, _ = pipe.Exec(ctx)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for i, f := range flushes {
+		counter, found := s.counters[f.key]
+		count, ttl, err := flushResult(counts[i], reads[i], windows[i])
+		if err != nil {
+			if f.pending > 0 && redis.HasErrorPrefix(err, "NOSCRIPT") {
+				err = incrementByScript.Load(ctx, s.redis.client).Err()
+			}
+			if err != nil {
+				errs = append(errs, err)
+			}
+			if found {
+				counter.pending += f.pending
+			}
+			continue
+		}
+		if !found {
+			continue
+		}
+		counter.count = count
+		if ttl > 0 {
+			counter.windowEnds = now.Add(ttl)
+		} else {
+			// The window ended or was reset in Redis, the next request takes it there
+			counter.windowEnds = now
+		}
+	}
+	for key, cmd := range ttls {
+		ttl, err := cmd.Result()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		// -2 means the key is not blocked and -1 that the block never expires
+		switch {
+		case ttl == -2:
+			delete(s.blocks, key)
+		case ttl == -1:
+			s.blocks[key] = time.Time{}
+		case ttl > 0:
+			s.blocks[key] = now.Add(ttl)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// flushResult returns the window count and how long until the window ends from the
+// script that added the local requests or from the commands that read the counter
+func flushResult(count *redis.Cmd, read *redis.StringCmd, window *redis.DurationCmd) (int, time.Duration, error) {
+	if count != nil {
+		values, err := count.Int64Slice()
+		if err != nil {
+			return 0, 0, err
+		}
+		return int(values[0]), time.Duration(values[1]) * time.Millisecond, nil
+	}
+
+	value, err := read.Int()
+	if err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+	ttl, err := window.Result()
+	return value, ttl, err
+}
+
+func init() {
+	Register("redis_cached", func(cfg config.StorageConfig) (Storage, error) {
+		return NewCached(cfg)
+	})
+}
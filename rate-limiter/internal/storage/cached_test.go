@@ -0,0 +1,210 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+// newCached returns a cached storage on the server that only syncs when flushed explicitly
+func newCached(t *testing.T, mr *miniredis.Miniredis) *storage.CachedStorage {
+	t.Helper()
+
+	store, err := storage.NewCached(config.StorageConfig{URL: "redis://" + mr.Addr(), FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Error connecting to redis: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// flush calls Flush and fails the test on error
+func flush(t *testing.T, store *storage.CachedStorage) {
+	t.Helper()
+
+	if err := store.Flush(context.Background()); err != nil {
+		t.Fatalf("Error flushing: %v", err)
+	}
+}
+
+func TestCachedStorage(t *testing.T) {
+	ctx := context.Background()
+	limiterConfig := config.LimiterConfig{RateLimit: 4, RateWindow: time.Minute, BlockDuration: time.Minute}
+
+	t.Run("Counts locally and shares the counts on flush", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		a, b := newCached(t, mr), newCached(t, mr)
+
+		// The first request reads the window from Redis, the second one is counted locally
+		take(t, a, "ip:1", limiterConfig)
+		commands := mr.CommandCount()
+		if result := take(t, a, "ip:1", limiterConfig); !result.Allowed || result.Remaining != 2 {
+			t.Errorf("Expected request allowed locally with 2 remaining, got %+v", result)
+		}
+		if mr.CommandCount() != commands {
+			t.Errorf("Expected no redis commands for a local request, got %d", mr.CommandCount()-commands)
+		}
+		if count, _ := mr.Get("{ip:1}"); count != "1" {
+			t.Errorf("Expected redis count 1 before the flush, got %s", count)
+		}
+
+		flush(t, a)
+		if count, _ := mr.Get("{ip:1}"); count != "2" {
+			t.Errorf("Expected redis count 2 after the flush, got %s", count)
+		}
+
+		// The other instance sees the flushed requests
+		if result := take(t, b, "ip:1", limiterConfig); !result.Allowed || result.Remaining != 1 {
+			t.Errorf("Expected request allowed with 1 remaining, got %+v", result)
+		}
+		flush(t, a)
+		if result := take(t, a, "ip:1", limiterConfig); !result.Allowed || result.Remaining != 0 {
+			t.Errorf("Expected request allowed with 0 remaining, got %+v", result)
+		}
+
+		// The request over the limit is taken in Redis with the pending ones, blocking the key
+		result := take(t, a, "ip:1", limiterConfig)
+		if result.Allowed || !result.Blocked {
+			t.Errorf("Expected request rejected and blocking the key, got %+v", result)
+		}
+		if !mr.Exists("blocklist:{ip:1}") {
+			t.Error("Expected key blocked in redis")
+		}
+
+		// The other instance sees the block once it flushes
+		flush(t, b)
+		if result := take(t, b, "ip:1", limiterConfig); result.Allowed || result.BlockedKey != "ip:1" {
+			t.Errorf("Expected request rejected by the block, got %+v", result)
+		}
+	})
+
+	t.Run("Rejects cached blocks without reaching redis", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		store := newCached(t, mr)
+
+		tokenConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute}
+		take(t, store, "token:abc", tokenConfig, "ip:1")
+		if result := take(t, store, "token:abc", tokenConfig, "ip:1"); !result.Blocked {
+			t.Fatalf("Expected token blocked, got %+v", result)
+		}
+
+		commands := mr.CommandCount()
+		if result := take(t, store, "token:abc", tokenConfig, "ip:1"); result.Allowed || result.BlockedKey != "token:abc" {
+			t.Errorf("Expected request rejected by the token block, got %+v", result)
+		}
+		// The linked key was blocked along with the token
+		if result := take(t, store, "ip:1", limiterConfig); result.Allowed || result.BlockedKey != "ip:1" {
+			t.Errorf("Expected request rejected by the IP block, got %+v", result)
+		}
+		if mr.CommandCount() != commands {
+			t.Errorf("Expected no redis commands for blocked keys, got %d", mr.CommandCount()-commands)
+		}
+	})
+
+	t.Run("Picks up blocks and unblocks of other instances on flush", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		store := newCached(t, mr)
+		other := newCached(t, mr)
+
+		take(t, store, "ip:2", limiterConfig)
+		if err := other.Block(ctx, "ip:2", time.Minute); err != nil {
+			t.Fatalf("Error blocking: %v", err)
+		}
+		flush(t, store)
+		if result := take(t, store, "ip:2", limiterConfig); result.Allowed || result.BlockedKey != "ip:2" {
+			t.Errorf("Expected request rejected by the remote block, got %+v", result)
+		}
+
+		if err := other.Unblock(ctx, "ip:2"); err != nil {
+			t.Fatalf("Error unblocking: %v", err)
+		}
+		flush(t, store)
+		if result := take(t, store, "ip:2", limiterConfig); !result.Allowed {
+			t.Errorf("Expected request allowed after the remote unblock, got %+v", result)
+		}
+	})
+
+	t.Run("Counts the costs locally", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		store := newCached(t, mr)
+
+		take(t, store, "ip:4", limiterConfig)
+		result, err := store.Take(ctx, "ip:4", 2, limiterConfig)
+		if err != nil {
+			t.Fatalf("Error taking: %v", err)
+		}
+		if !result.Allowed || result.Remaining != 1 {
+			t.Errorf("Expected request allowed locally with 1 remaining, got %+v", result)
+		}
+
+		// The request costing more than the remaining is taken in Redis with the pending cost
+		result, err = store.Take(ctx, "ip:4", 2, limiterConfig)
+		if err != nil {
+			t.Fatalf("Error taking: %v", err)
+		}
+		if result.Allowed || !result.Blocked {
+			t.Errorf("Expected request rejected and blocking the key, got %+v", result)
+		}
+		if count, _ := mr.Get("{ip:4}"); count != "5" {
+			t.Errorf("Expected redis count 5 with the costs, got %s", count)
+		}
+	})
+
+	t.Run("Flushes the local counts on close", func(t *testing.T) {
+		mr := miniredis.RunT(t)
+		store := newCached(t, mr)
+
+		for range 3 {
+			take(t, store, "ip:3", limiterConfig)
+		}
+		if count, err := store.Get(ctx, "ip:3"); err != nil || count != 3 {
+			t.Errorf("Expected count 3 with the pending requests, got %d (%v)", count, err)
+		}
+
+		store.Close()
+		if count, _ := mr.Get("{ip:3}"); count != "3" {
+			t.Errorf("Expected redis count 3 after close, got %s", count)
+		}
+	})
+}
+
+// BenchmarkCachedStorageTake compares taking every request in Redis with counting
+// them locally and flushing the counts in the background
+func BenchmarkCachedStorageTake(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip:10.0.%d.%d", i>>8&255, i&255)
+	}
+	limiterConfig := config.LimiterConfig{RateLimit: 1 << 30, RateWindow: time.Minute}
+
+	mr := miniredis.RunT(b)
+	for _, storageType := range []string{"redis", "redis_cached"} {
+		b.Run(storageType, func(b *testing.B) {
+			store, err := storage.New(storageType, config.StorageConfig{URL: "redis://" + mr.Addr()})
+			if err != nil {
+				b.Fatalf("Error connecting to redis: %v", err)
+			}
+			defer store.Close()
+
+			var next atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				i := next.Add(7919)
+				for pb.Next() {
+					i++
+					if _, err := store.Take(ctx, keys[i%uint64(len(keys))], 1, limiterConfig); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
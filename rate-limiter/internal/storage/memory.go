@@ -1,119 +1,746 @@
 package storage
 
 import (
+	"container/list"
 	"context"
+	"hash/maphash"
+	"maps"
+	"math"
+	"slices"
 	"sync"
 	"time"
 
 	"github.com/felipeosantos/goexpert/rate-limiter/config"
 )
 
+const (
+	// DefaultCleanupInterval is how often expired entries are removed when no interval is configured
+	DefaultCleanupInterval = time.Minute
+	// DefaultShards is the number of shards used when none is configured
+	DefaultShards = 32
+)
+
 // Item represents a rate limiter item with expiration
 type Item struct {
 	Count     int
 	ExpiresAt time.Time
 }
 
+// SlidingLog holds the arrival time of the requests inside a sliding window log
+type SlidingLog struct {
+	Requests  []time.Time
+	ExpiresAt time.Time
+}
+
+// WindowCounter holds the counts of the current and previous windows of a sliding window counter
+type WindowCounter struct {
+	Start     time.Time
+	Current   int
+	Previous  int
+	ExpiresAt time.Time
+}
+
+// Bucket holds the state of a token bucket (tokens left) or a leaky bucket (requests queued),
+// it expires when the bucket is back to its initial state
+type Bucket struct {
+	Level     float64
+	UpdatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// MemoryStats reports the size of the memory storage and how entries left it
+type MemoryStats struct {
+	// Entries is the number of keys currently stored
+	Entries int
+	// Evictions counts the keys removed to respect the size limit
+	Evictions uint64
+	// Expirations counts the keys removed by the cleanup because all their state expired
+	Expirations uint64
+}
+
+// entry holds everything the storage keeps for a key
+type entry struct {
+	key          string
+	item         *Item
+	log          *SlidingLog
+	counter      *WindowCounter
+	tokens       *Bucket
+	leaky        *Bucket
+	blockedUntil time.Time
+	// violations counts the blocks of the key until violationsExpireAt
+	violations         int
+	violationsExpireAt time.Time
+	// leases maps the requests holding a concurrency slot of the key to when their lease expires
+	leases  map[string]time.Time
+	element *list.Element
+}
+
+// expire drops the expired state of the entry and reports whether nothing is left
+func (e *entry) expire(now time.Time) bool {
+	if e.item != nil && now.After(e.item.ExpiresAt) {
+		e.item = nil
+	}
+	if e.log != nil && now.After(e.log.ExpiresAt) {
+		e.log = nil
+	}
+	if e.counter != nil && now.After(e.counter.ExpiresAt) {
+		e.counter = nil
+	}
+	if e.tokens != nil && now.After(e.tokens.ExpiresAt) {
+		e.tokens = nil
+	}
+	if e.leaky != nil && now.After(e.leaky.ExpiresAt) {
+		e.leaky = nil
+	}
+	if !e.blockedUntil.IsZero() && now.After(e.blockedUntil) {
+		e.blockedUntil = time.Time{}
+	}
+	if e.violations > 0 && now.After(e.violationsExpireAt) {
+		e.violations, e.violationsExpireAt = 0, time.Time{}
+	}
+	for id, expiresAt := range e.leases {
+		if now.After(expiresAt) {
+			delete(e.leases, id)
+		}
+	}
+	return e.empty()
+}
+
+// state describes the entry, which must have been expired at now
+func (e *entry) state(now time.Time) KeyState {
+	state := KeyState{Key: e.key, Counters: make(map[string]int)}
+	if e.item != nil {
+		state.Counters[config.AlgorithmFixedWindow] = e.item.Count
+	}
+	if e.log != nil {
+		state.Counters[config.AlgorithmSlidingWindowLog] = len(e.log.Requests)
+	}
+	if e.counter != nil {
+		state.Counters[config.AlgorithmSlidingWindowCounter] = e.counter.Current
+	}
+	if e.tokens != nil {
+		state.Counters[config.AlgorithmTokenBucket] = int(e.tokens.Level)
+	}
+	if e.leaky != nil {
+		state.Counters[config.AlgorithmLeakyBucket] = int(e.leaky.Level)
+	}
+	if !e.blockedUntil.IsZero() {
+		state.BlockedFor = e.blockedUntil.Sub(now)
+	}
+	state.Violations = e.violations
+	state.InFlight = len(e.leases)
+	return state
+}
+
+// empty reports whether the entry holds no state
+func (e *entry) empty() bool {
+	return e.item == nil && e.log == nil && e.counter == nil && e.tokens == nil && e.leaky == nil && e.blockedUntil.IsZero() && e.violations == 0 && len(e.leases) == 0
+}
+
 // MemoryStorage implements the Storage interface using in-memory maps
+//
+// Keys are hashed across independently locked shards so requests for different
+// keys rarely contend. Expired entries are removed lazily when their key is used
+// and periodically by a background cleanup that stops on Close. When a size is
+// configured, each shard evicts its least recently used keys to keep its share
+// of the entries under it, the shares adding up to the size.
 type MemoryStorage struct {
-	mu        sync.RWMutex
-	items     map[string]Item
-	blocklist map[string]time.Time
+	shards []*memoryShard
+	seed   maphash.Seed
+
+	accessMu sync.RWMutex
+	access   map[string]map[string]struct{}
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// memoryShard holds the entries of the keys hashed to it
+type memoryShard struct {
+	// mu is a plain mutex because even reads move the key in the LRU list
+	mu      sync.Mutex
+	entries map[string]*entry
+	// lru orders the entries from the most to the least recently used
+	lru   *list.List
+	size  int
+	stats MemoryStats
 }
 
 // NewMemoryStorage creates a new in-memory storage
-func NewMemoryStorage() *MemoryStorage {
-	return &MemoryStorage{
-		items:     make(map[string]Item),
-		blocklist: make(map[string]time.Time),
+func NewMemoryStorage(memoryCfg config.StorageConfig) *MemoryStorage {
+	shards := memoryCfg.Shards
+	if shards <= 0 {
+		shards = DefaultShards
+	}
+	// Each shard must hold at least one entry for the size to be split across them
+	if memoryCfg.Size > 0 {
+		shards = min(shards, memoryCfg.Size)
+	}
+
+	s := &MemoryStorage{
+		shards: make([]*memoryShard, shards),
+		seed:   maphash.MakeSeed(),
+		access: make(map[string]map[string]struct{}),
+		stop:   make(chan struct{}),
+	}
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{
+			entries: make(map[string]*entry),
+			lru:     list.New(),
+		}
+	}
+	// Split the size so the shards together hold exactly the configured size
+	if memoryCfg.Size > 0 {
+		for i, shard := range s.shards {
+			shard.size = memoryCfg.Size / shards
+			if i < memoryCfg.Size%shards {
+				shard.size++
+			}
+		}
 	}
+
+	interval := memoryCfg.CleanupInterval
+	if interval <= 0 {
+		interval = DefaultCleanupInterval
+	}
+	go s.cleanup(interval)
+
+	return s
 }
 
 // Get returns the current count for a key
 func (s *MemoryStorage) Get(ctx context.Context, key string) (int, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	// Clean expired items
-	s.cleanExpired(key)
-
-	if item, found := s.items[key]; found {
-		return item.Count, nil
+	if e := shard.lookup(key, time.Now()); e != nil && e.item != nil {
+		return e.item.Count, nil
 	}
 	return 0, nil
 }
 
 // Increment increments the counter for a key and returns the new value
 func (s *MemoryStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	// Clean expired items
-	s.cleanExpired(key)
+	now := time.Now()
+	return shard.entry(key, now).increment(1, expiration, now), nil
+}
 
-	item, found := s.items[key]
-	if !found {
-		s.items[key] = Item{
-			Count:     1,
-			ExpiresAt: time.Now().Add(expiration),
+// IncrementBy adds n to the counter for a key and returns the new value
+func (s *MemoryStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	return shard.entry(key, now).increment(n, expiration, now), nil
+}
+
+// Take checks the blocks, registers the request and blocks the keys when the limit is exceeded
+func (s *MemoryStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Result, error) {
+	if !positiveLimit(limiterConfig) {
+		return Result{}, ErrInvalidLimit
+	}
+
+	keys := append([]string{key}, linked...)
+	unlock := s.lock(keys)
+	defer unlock()
+
+	now := time.Now()
+
+	for _, k := range keys {
+		if e := s.shard(k).lookup(k, now); e != nil && !e.blockedUntil.IsZero() {
+			return Result{
+				ResetAfter: e.blockedUntil.Sub(now),
+				RetryAfter: e.blockedUntil.Sub(now),
+				BlockedKey: k,
+			}, nil
+		}
+	}
+
+	rate, burst := limiterConfig.Bucket()
+	e := s.shard(key).entry(key, now)
+
+	var result Result
+	switch limiterConfig.Algorithm {
+	case "", config.AlgorithmFixedWindow:
+		result = e.fixedWindow(limiterConfig.RateLimit, limiterConfig.RateWindow, cost, now)
+	case config.AlgorithmSlidingWindowLog:
+		result = e.slidingLog(limiterConfig.RateLimit, limiterConfig.RateWindow, cost, now)
+	case config.AlgorithmSlidingWindowCounter:
+		result = e.slidingCounter(limiterConfig.RateLimit, limiterConfig.RateWindow, cost, now)
+	case config.AlgorithmTokenBucket:
+		result = e.takeToken(rate, burst, cost, now)
+	case config.AlgorithmLeakyBucket:
+		result = e.addToLeakyBucket(rate, burst, cost, now)
+	default:
+		return Result{}, ErrUnknownAlgorithm
+	}
+
+	if !result.Allowed && limiterConfig.BlockDuration > 0 {
+		blockDuration := limiterConfig.BlockDuration
+		if limiterConfig.Progressive() {
+			e.violations++
+			blockDuration = limiterConfig.BlockFor(e.violations)
+			e.violationsExpireAt = now.Add(blockDuration + limiterConfig.Decay())
+		}
+
+		for _, k := range keys {
+			s.shard(k).entry(k, now).blockedUntil = now.Add(blockDuration)
 		}
-		return 1, nil
+		result.RetryAfter = blockDuration
+		result.ResetAfter = max(result.ResetAfter, blockDuration)
+		result.BlockedKey = key
+		result.Blocked = true
 	}
 
-	item.Count++
-	s.items[key] = item
-	return item.Count, nil
+	return result, nil
+}
+
+// Acquire takes a concurrency slot of a key for the lease, or renews the lease
+func (s *MemoryStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	e := shard.entry(key, now)
+	if _, held := e.leases[id]; !held && len(e.leases) >= limit {
+		return false, nil
+	}
+	if e.leases == nil {
+		e.leases = make(map[string]time.Time)
+	}
+	e.leases[id] = now.Add(lease)
+	return true, nil
+}
+
+// Release frees the concurrency slot held by a lease
+func (s *MemoryStorage) Release(ctx context.Context, key, id string) error {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if e, found := shard.entries[key]; found {
+		delete(e.leases, id)
+		if e.empty() {
+			shard.remove(e)
+		}
+	}
+	return nil
 }
 
 // Reset resets the counter for a key
 func (s *MemoryStorage) Reset(ctx context.Context, key string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	delete(s.items, key)
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	e, found := shard.entries[key]
+	if !found {
+		return nil
+	}
+
+	e.item, e.log, e.counter, e.tokens, e.leaky = nil, nil, nil, nil, nil
+	if e.empty() {
+		shard.remove(e)
+	}
 	return nil
 }
 
 // IsBlocked checks if a key is in the blocklist
 func (s *MemoryStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	// Clean expired blocks
-	s.cleanExpiredBlocks(key)
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
 
-	_, blocked := s.blocklist[key]
-	return blocked, nil
+	e := shard.lookup(key, time.Now())
+	return e != nil && !e.blockedUntil.IsZero(), nil
 }
 
 // Block adds a key to the blocklist with the given expiration
 func (s *MemoryStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	s.blocklist[key] = time.Now().Add(expiration)
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	shard.entry(key, now).blockedUntil = now.Add(expiration)
+	return nil
+}
+
+// Unblock removes a key from the blocklist
+func (s *MemoryStorage) Unblock(ctx context.Context, key string) error {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if e, found := shard.entries[key]; found {
+		e.blockedUntil = time.Time{}
+		if e.empty() {
+			shard.remove(e)
+		}
+	}
+	return nil
+}
+
+// State returns the counters and the block of a key
+func (s *MemoryStorage) State(ctx context.Context, key string) (KeyState, error) {
+	shard := s.shard(key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	now := time.Now()
+	if e := shard.lookup(key, now); e != nil {
+		return e.state(now), nil
+	}
+	return KeyState{Key: key}, nil
+}
+
+// List returns the state of every key with counters or blocks
+func (s *MemoryStorage) List(ctx context.Context) ([]KeyState, error) {
+	var states []KeyState
+	now := time.Now()
+
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for _, e := range shard.entries {
+			if e.expire(now) {
+				shard.remove(e)
+				shard.stats.Expirations++
+				continue
+			}
+			states = append(states, e.state(now))
+		}
+		shard.mu.Unlock()
+	}
+
+	return states, nil
+}
+
+// Blocks returns how long each blocked key stays blocked
+func (s *MemoryStorage) Blocks(ctx context.Context) (map[string]time.Duration, error) {
+	blocks := make(map[string]time.Duration)
+	now := time.Now()
+
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		for _, e := range shard.entries {
+			if e.expire(now) {
+				shard.remove(e)
+				shard.stats.Expirations++
+				continue
+			}
+			if !e.blockedUntil.IsZero() {
+				blocks[e.key] = e.blockedUntil.Sub(now)
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	return blocks, nil
+}
+
+// AccessList returns the sorted entries of an access list
+func (s *MemoryStorage) AccessList(ctx context.Context, name string) ([]string, error) {
+	s.accessMu.RLock()
+	defer s.accessMu.RUnlock()
+	return slices.Sorted(maps.Keys(s.access[name])), nil
+}
+
+// AddAccess adds an entry to an access list
+func (s *MemoryStorage) AddAccess(ctx context.Context, name, entry string) error {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	if s.access[name] == nil {
+		s.access[name] = make(map[string]struct{})
+	}
+	s.access[name][entry] = struct{}{}
+	return nil
+}
+
+// RemoveAccess removes an entry from an access list
+func (s *MemoryStorage) RemoveAccess(ctx context.Context, name, entry string) error {
+	s.accessMu.Lock()
+	defer s.accessMu.Unlock()
+	delete(s.access[name], entry)
 	return nil
 }
 
-// Close closes the storage (no-op for memory storage)
+// Stats returns the number of entries and how many entries were evicted or expired
+func (s *MemoryStorage) Stats() MemoryStats {
+	var stats MemoryStats
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		stats.Entries += len(shard.entries)
+		stats.Evictions += shard.stats.Evictions
+		stats.Expirations += shard.stats.Expirations
+		shard.mu.Unlock()
+	}
+	return stats
+}
+
+// Close stops the background cleanup
 func (s *MemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
 	return nil
 }
 
-// cleanExpired removes expired items
-func (s *MemoryStorage) cleanExpired(key string) {
-	if item, found := s.items[key]; found && time.Now().After(item.ExpiresAt) {
-		delete(s.items, key)
+// shard returns the shard a key is hashed to
+func (s *MemoryStorage) shard(key string) *memoryShard {
+	return s.shards[maphash.String(s.seed, key)%uint64(len(s.shards))]
+}
+
+// lock locks the shards of all keys, always in the same order so concurrent calls
+// can't deadlock, and returns the function that unlocks them
+func (s *MemoryStorage) lock(keys []string) func() {
+	shards := make([]int, 0, len(keys))
+	for _, key := range keys {
+		i := int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+		if !slices.Contains(shards, i) {
+			shards = append(shards, i)
+		}
+	}
+	slices.Sort(shards)
+
+	for _, i := range shards {
+		s.shards[i].mu.Lock()
+	}
+	return func() {
+		for _, i := range shards {
+			s.shards[i].mu.Unlock()
+		}
+	}
+}
+
+// cleanup periodically removes the entries whose state expired until the storage is closed
+func (s *MemoryStorage) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			// One shard at a time, so requests to the other shards go on
+			for _, shard := range s.shards {
+				shard.mu.Lock()
+				for _, e := range shard.entries {
+					if e.expire(now) {
+						shard.remove(e)
+						shard.stats.Expirations++
+					}
+				}
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// lookup returns the entry of a key, or nil when the key has no state left
+func (shard *memoryShard) lookup(key string, now time.Time) *entry {
+	e, found := shard.entries[key]
+	if !found {
+		return nil
+	}
+
+	if e.expire(now) {
+		shard.remove(e)
+		shard.stats.Expirations++
+		return nil
+	}
+
+	shard.lru.MoveToFront(e.element)
+	return e
+}
+
+// entry returns the entry of a key, creating it and evicting the least recently used
+// entries when the size limit is reached
+func (shard *memoryShard) entry(key string, now time.Time) *entry {
+	if e := shard.lookup(key, now); e != nil {
+		return e
+	}
+
+	for shard.size > 0 && len(shard.entries) >= shard.size {
+		shard.remove(shard.lru.Back().Value.(*entry))
+		shard.stats.Evictions++
+	}
+
+	e := &entry{key: key}
+	e.element = shard.lru.PushFront(e)
+	shard.entries[key] = e
+	return e
+}
+
+// remove deletes an entry from the shard
+func (shard *memoryShard) remove(e *entry) {
+	shard.lru.Remove(e.element)
+	delete(shard.entries, e.key)
+}
+
+// increment adds n to the fixed window counter of an entry and returns the new value
+func (e *entry) increment(n int, expiration time.Duration, now time.Time) int {
+	if e.item == nil {
+		e.item = &Item{
+			Count:     n,
+			ExpiresAt: now.Add(expiration),
+		}
+		return n
+	}
+
+	e.item.Count += n
+	return e.item.Count
+}
+
+// fixedWindow adds the cost to the fixed window counter of an entry and compares it to limit
+func (e *entry) fixedWindow(limit int, window time.Duration, cost int, now time.Time) Result {
+	count := e.increment(cost, window, now)
+	resetAfter := e.item.ExpiresAt.Sub(now)
+
+	result := Result{
+		Allowed:    count <= limit,
+		Remaining:  max(0, limit-count),
+		ResetAfter: resetAfter,
+	}
+	if !result.Allowed {
+		result.RetryAfter = resetAfter
 	}
+	return result
 }
 
-// cleanExpiredBlocks removes expired blocks
-func (s *MemoryStorage) cleanExpiredBlocks(key string) {
-	if expireTime, found := s.blocklist[key]; found && time.Now().After(expireTime) {
-		delete(s.blocklist, key)
+// slidingLog records a request for an entry, once for every request of its cost, and compares
+// the requests inside the window to limit
+func (e *entry) slidingLog(limit int, window time.Duration, cost int, now time.Time) Result {
+	if e.log == nil {
+		e.log = &SlidingLog{}
+	}
+	windowStart := now.Add(-window)
+
+	// Discard the requests that left the window, the log is kept in arrival order
+	requests := e.log.Requests
+	i := 0
+	for i < len(requests) && !requests[i].After(windowStart) {
+		i++
+	}
+	requests = requests[i:]
+	for range cost {
+		requests = append(requests, now)
+	}
+	e.log.Requests = requests
+	e.log.ExpiresAt = now.Add(window)
+
+	count := len(requests)
+	result := Result{
+		Allowed:    count <= limit,
+		Remaining:  max(0, limit-count),
+		ResetAfter: window,
+	}
+	if !result.Allowed {
+		// A new request fits once the requests up to this one leave the window
+		result.RetryAfter = requests[count-limit].Add(window).Sub(now)
 	}
+	return result
+}
+
+// slidingCounter adds the cost to the current window counter of an entry and compares it, added
+// to the previous window count weighted by its overlap with the sliding window, to limit
+func (e *entry) slidingCounter(limit int, window time.Duration, cost int, now time.Time) Result {
+	start := now.Truncate(window)
+
+	if e.counter == nil {
+		e.counter = &WindowCounter{}
+	}
+	counter := e.counter
+	if !counter.Start.Equal(start) {
+		// Roll the windows, the previous count only matters if it is the window right before this one
+		if counter.Start.Add(window).Equal(start) {
+			counter.Previous = counter.Current
+		} else {
+			counter.Previous = 0
+		}
+		counter.Start = start
+		counter.Current = 0
+		counter.ExpiresAt = start.Add(2 * window)
+	}
+	counter.Current += cost
+
+	count := weightedCount(counter.Previous, counter.Current, now.Sub(start), window)
+	resetAfter := start.Add(window).Sub(now)
+
+	result := Result{
+		Allowed:    count <= limit,
+		Remaining:  max(0, limit-count),
+		ResetAfter: resetAfter,
+	}
+	if !result.Allowed {
+		result.RetryAfter = resetAfter
+	}
+	return result
+}
+
+// takeToken takes cost tokens from the bucket of an entry, refilled at rate tokens per second up
+// to burst tokens, and reports whether enough tokens were available
+func (e *entry) takeToken(rate float64, burst, cost int, now time.Time) Result {
+	if e.tokens == nil {
+		// A new bucket starts full
+		e.tokens = &Bucket{Level: float64(burst), UpdatedAt: now}
+	}
+	bucket := e.tokens
+
+	// Refill the tokens earned since the last request
+	bucket.Level = math.Min(float64(burst), bucket.Level+now.Sub(bucket.UpdatedAt).Seconds()*rate)
+	bucket.UpdatedAt = now
+
+	result := Result{Allowed: bucket.Level >= float64(cost)}
+	if result.Allowed {
+		bucket.Level -= float64(cost)
+	} else {
+		result.RetryAfter = bucketDuration(float64(cost)-bucket.Level, rate)
+	}
+
+	result.Remaining = int(bucket.Level)
+	result.ResetAfter = bucketDuration(float64(burst)-bucket.Level, rate)
+	// Once the bucket is full again its state is no longer needed
+	bucket.ExpiresAt = now.Add(result.ResetAfter)
+	return result
+}
+
+// addToLeakyBucket adds a request costing cost requests to the bucket of an entry, which leaks at
+// rate requests per second and holds up to burst requests, and reports whether it fit
+func (e *entry) addToLeakyBucket(rate float64, burst, cost int, now time.Time) Result {
+	if e.leaky == nil {
+		// A new bucket starts empty
+		e.leaky = &Bucket{UpdatedAt: now}
+	}
+	bucket := e.leaky
+
+	// Leak the requests drained since the last request
+	bucket.Level = math.Max(0, bucket.Level-now.Sub(bucket.UpdatedAt).Seconds()*rate)
+	bucket.UpdatedAt = now
+
+	result := Result{Allowed: bucket.Level+float64(cost) <= float64(burst)}
+	if result.Allowed {
+		bucket.Level += float64(cost)
+	} else {
+		result.RetryAfter = bucketDuration(bucket.Level+float64(cost)-float64(burst), rate)
+	}
+
+	result.Remaining = int(float64(burst) - bucket.Level)
+	result.ResetAfter = bucketDuration(bucket.Level, rate)
+	// Once the bucket is empty again its state is no longer needed
+	bucket.ExpiresAt = now.Add(result.ResetAfter)
+	return result
 }
 
 func init() {
 	Register("memory", func(cfg config.StorageConfig) (Storage, error) {
-		return NewMemoryStorage(), nil
+		return NewMemoryStorage(cfg), nil
 	})
 }
@@ -0,0 +1,164 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+func TestMemoryStorageSize(t *testing.T) {
+	// A single shard makes the least recently used order global
+	store := storage.NewMemoryStorage(config.StorageConfig{Size: 3, Shards: 1})
+	defer store.Close()
+
+	ctx := context.Background()
+	for i := 1; i <= 3; i++ {
+		if _, err := store.Increment(ctx, fmt.Sprintf("ip:10.0.1.%d", i), time.Minute); err != nil {
+			t.Fatalf("Error incrementing: %v", err)
+		}
+	}
+
+	// Using the first key makes the second one the least recently used
+	if _, err := store.Get(ctx, "ip:10.0.1.1"); err != nil {
+		t.Fatalf("Error getting count: %v", err)
+	}
+	if err := store.Block(ctx, "ip:10.0.1.4", time.Minute); err != nil {
+		t.Fatalf("Error blocking: %v", err)
+	}
+
+	stats := store.Stats()
+	if stats.Entries != 3 || stats.Evictions != 1 {
+		t.Errorf("Expected 3 entries and 1 eviction, got %d entries and %d evictions", stats.Entries, stats.Evictions)
+	}
+
+	expected := map[string]int{"ip:10.0.1.1": 1, "ip:10.0.1.2": 0, "ip:10.0.1.3": 1}
+	for key, count := range expected {
+		got, err := store.Get(ctx, key)
+		if err != nil {
+			t.Fatalf("Error getting count: %v", err)
+		}
+		if got != count {
+			t.Errorf("Expected %s count %d, got %d", key, count, got)
+		}
+	}
+}
+
+func TestMemoryStorageSizeAcrossShards(t *testing.T) {
+	for _, size := range []int{1, 10, 100} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			store := storage.NewMemoryStorage(config.StorageConfig{Size: size})
+			defer store.Close()
+
+			ctx := context.Background()
+			for i := range 4 * size {
+				if _, err := store.Increment(ctx, fmt.Sprintf("ip:10.1.%d.%d", i/256, i%256), time.Minute); err != nil {
+					t.Fatalf("Error incrementing: %v", err)
+				}
+			}
+			if entries := store.Stats().Entries; entries > size {
+				t.Errorf("Expected at most %d entries, got %d", size, entries)
+			}
+		})
+	}
+}
+
+func TestMemoryStorageCleanup(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{CleanupInterval: 20 * time.Millisecond})
+	defer store.Close()
+
+	ctx := context.Background()
+	for i := 1; i <= 10; i++ {
+		if _, err := store.Increment(ctx, fmt.Sprintf("ip:10.0.2.%d", i), 50*time.Millisecond); err != nil {
+			t.Fatalf("Error incrementing: %v", err)
+		}
+	}
+	if err := store.Block(ctx, "ip:10.0.2.100", time.Minute); err != nil {
+		t.Fatalf("Error blocking: %v", err)
+	}
+
+	// Keys that are never used again are removed by the background cleanup
+	time.Sleep(150 * time.Millisecond)
+
+	stats := store.Stats()
+	if stats.Entries != 1 || stats.Expirations != 10 {
+		t.Errorf("Expected 1 entry and 10 expirations, got %d entries and %d expirations", stats.Entries, stats.Expirations)
+	}
+
+	blocked, err := store.IsBlocked(ctx, "ip:10.0.2.100")
+	if err != nil {
+		t.Fatalf("Error checking block: %v", err)
+	}
+	if !blocked {
+		t.Errorf("Block should outlive the cleanup")
+	}
+}
+
+func TestMemoryStorageConcurrency(t *testing.T) {
+	store := storage.NewMemoryStorage(config.StorageConfig{Shards: 4})
+	defer store.Close()
+
+	limiterConfig := config.LimiterConfig{RateLimit: 100, RateWindow: time.Minute, BlockDuration: time.Minute}
+
+	// Tokens linked to IPs in other shards must neither deadlock nor lose counts
+	var allowed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				result, err := store.Take(context.Background(), "token:shared", 1, limiterConfig, fmt.Sprintf("ip:10.0.3.%d", i))
+				if err != nil {
+					t.Errorf("Error taking: %v", err)
+					return
+				}
+				if result.Allowed {
+					allowed.Add(1)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if allowed.Load() != 100 {
+		t.Errorf("Expected exactly 100 allowed requests, got %d", allowed.Load())
+	}
+}
+
+// BenchmarkMemoryStorageTake compares a single locked shard, equivalent to a storage
+// guarded by one mutex, with the default sharding. Run it with -cpu 1,2,4,8 to see
+// how the throughput scales with GOMAXPROCS.
+func BenchmarkMemoryStorageTake(b *testing.B) {
+	keys := make([]string, 10000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("ip:10.%d.%d.%d", i>>16&255, i>>8&255, i&255)
+	}
+	limiterConfig := config.LimiterConfig{RateLimit: 1 << 30, RateWindow: time.Minute}
+
+	for _, shards := range []int{1, storage.DefaultShards} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			store := storage.NewMemoryStorage(config.StorageConfig{Shards: shards})
+			defer store.Close()
+
+			var next atomic.Uint64
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				ctx := context.Background()
+				i := next.Add(7919)
+				for pb.Next() {
+					i++
+					if _, err := store.Take(ctx, keys[i%uint64(len(keys))], 1, limiterConfig); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -1,36 +1,132 @@
 package storage
 
 import (
+	"cmp"
 	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/felipeosantos/goexpert/rate-limiter/config"
 	"github.com/redis/go-redis/v9"
 )
 
+const (
+	// blocklistPrefix prefixes the keys that mark a key as blocked
+	blocklistPrefix = "blocklist:"
+	// accessPrefix prefixes the sets holding the access lists
+	accessPrefix = "access:"
+	// blockedKind identifies the block of a key when parsing Redis keys
+	blockedKind = "blocked"
+	// violationsKind identifies the offenses of a key counted by the progressive blocks
+	violationsKind = "violations"
+	// concurrencyKind identifies the leases of the in-flight requests of a key
+	concurrencyKind = "concurrency"
+	// listBatchSize is how many keys are scanned and read per round trip when listing
+	listBatchSize = 1000
+)
+
+var (
+	ErrUnknownRedisMode = errors.New("unknown redis mode")
+	ErrMissingRedisAddr = errors.New("redis sentinel and cluster modes require addrs")
+	ErrMissingMaster    = errors.New("redis sentinel mode requires master_name")
+)
+
 // RedisStorage implements the Storage Strategy interface using Redis
+//
+// Every Redis key of a key has the key as its hash tag, e.g. {ip:192.0.2.1} and
+// blocklist:{ip:192.0.2.1}, so in a cluster they share a slot and a script can
+// touch them together.
 type RedisStorage struct {
-	client *redis.Client
+	client redis.UniversalClient
+	// cluster is set when the keys of a request may be in different slots
+	cluster bool
 }
 
-// NewRedis creates a new Redis storage
+// NewRedis creates a new Redis storage on a single server, sentinel master or cluster
 func NewRedis(redisCfg config.StorageConfig) (*RedisStorage, error) {
-	opts, err := redis.ParseURL(redisCfg.URL)
+	opts, err := redisOptions(redisCfg)
 	if err != nil {
 		return nil, err
 	}
-	client := redis.NewClient(opts)
+	client := redis.NewUniversalClient(opts)
 	// Ping Redis to verify connection
 	_, err = client.Ping(context.Background()).Result()
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
-	return &RedisStorage{client: client}, nil
+	_, cluster := client.(*redis.ClusterClient)
+	return &RedisStorage{client: client, cluster: cluster}, nil
+}
+
+// redisOptions returns the client options of the configured Redis deployment
+func redisOptions(redisCfg config.StorageConfig) (*redis.UniversalOptions, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            redisCfg.Addrs,
+		MasterName:       redisCfg.MasterName,
+		Username:         redisCfg.Username,
+		Password:         redisCfg.Password,
+		SentinelPassword: redisCfg.SentinelPassword,
+		DB:               redisCfg.DB,
+		PoolSize:         redisCfg.PoolSize,
+		MinIdleConns:     redisCfg.MinIdleConns,
+		MaxIdleConns:     redisCfg.MaxIdleConns,
+		ConnMaxIdleTime:  redisCfg.ConnMaxIdleTime,
+		PoolTimeout:      redisCfg.PoolTimeout,
+		DialTimeout:      redisCfg.DialTimeout,
+		ReadTimeout:      redisCfg.ReadTimeout,
+		WriteTimeout:     redisCfg.WriteTimeout,
+	}
+
+	switch redisCfg.Mode {
+	case "", config.RedisModeSingle:
+		// The URL carries the address, credentials and database, and may carry pool
+		// settings as query parameters, which the configured ones override
+		url, err := redis.ParseURL(redisCfg.URL)
+		if err != nil {
+			return nil, err
+		}
+		opts.Addrs = []string{url.Addr}
+		opts.MasterName = ""
+		opts.Username, opts.Password, opts.DB = url.Username, url.Password, url.DB
+		opts.TLSConfig = url.TLSConfig
+		opts.PoolSize = cmp.Or(opts.PoolSize, url.PoolSize)
+		opts.MinIdleConns = cmp.Or(opts.MinIdleConns, url.MinIdleConns)
+		opts.MaxIdleConns = cmp.Or(opts.MaxIdleConns, url.MaxIdleConns)
+		opts.ConnMaxIdleTime = cmp.Or(opts.ConnMaxIdleTime, url.ConnMaxIdleTime)
+		opts.PoolTimeout = cmp.Or(opts.PoolTimeout, url.PoolTimeout)
+		opts.DialTimeout = cmp.Or(opts.DialTimeout, url.DialTimeout)
+		opts.ReadTimeout = cmp.Or(opts.ReadTimeout, url.ReadTimeout)
+		opts.WriteTimeout = cmp.Or(opts.WriteTimeout, url.WriteTimeout)
+	case config.RedisModeSentinel:
+		if len(opts.Addrs) == 0 {
+			return nil, ErrMissingRedisAddr
+		}
+		if opts.MasterName == "" {
+			return nil, ErrMissingMaster
+		}
+	case config.RedisModeCluster:
+		if len(opts.Addrs) == 0 {
+			return nil, ErrMissingRedisAddr
+		}
+		opts.MasterName = ""
+		opts.IsClusterMode = true
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownRedisMode, redisCfg.Mode)
+	}
+
+	return opts, nil
 }
 
 // Get returns the current count for a key
 func (s *RedisStorage) Get(ctx context.Context, key string) (int, error) {
-	val, err := s.client.Get(ctx, key).Int()
+	val, err := s.client.Get(ctx, stateKey(key, config.AlgorithmFixedWindow)).Int()
 	if err == redis.Nil {
 		return 0, nil
 	}
@@ -39,31 +135,151 @@ func (s *RedisStorage) Get(ctx context.Context, key string) (int, error) {
 
 // Increment increments the counter for a key and returns the new value
 func (s *RedisStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
-	val, err := s.client.Incr(ctx, key).Result()
+	return s.IncrementBy(ctx, key, 1, expiration)
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (s *RedisStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+	return incrementScript.Run(ctx, s.client, []string{stateKey(key, config.AlgorithmFixedWindow)}, expiration.Milliseconds(), n).Int()
+}
+
+// Take checks the blocks, registers the request and blocks the keys when the limit is exceeded
+// in a single script execution
+func (s *RedisStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Result, error) {
+	algorithm := limiterConfig.Algorithm
+	if algorithm == "" {
+		algorithm = config.AlgorithmFixedWindow
+	}
+	script, found := takeScripts[algorithm]
+	if !found {
+		return Result{}, ErrUnknownAlgorithm
+	}
+	if !positiveLimit(limiterConfig) {
+		return Result{}, ErrInvalidLimit
+	}
+
+	// In a cluster the keys of a script must share a slot, so the blocks of the
+	// linked keys are checked before and set after the script
+	scriptLinked := linked
+	if s.cluster {
+		scriptLinked = nil
+		if result, blocked, err := s.linkedBlock(ctx, linked); err != nil || blocked {
+			return result, err
+		}
+	}
+
+	keys := []string{stateKey(key, algorithm), blocklistKey(key)}
+	for _, k := range scriptLinked {
+		keys = append(keys, blocklistKey(k))
+	}
+	multiplier := 0.0
+	if limiterConfig.Progressive() {
+		multiplier = limiterConfig.BlockMultiplier
+		keys = append(keys, stateKey(key, violationsKind))
+	}
+
+	now := time.Now().UnixMilli()
+	rate, burst := limiterConfig.Bucket()
+	// Requests arriving in the same millisecond must not overwrite each other in the sliding log
+	member := strconv.FormatInt(now, 10) + "-" + strconv.FormatUint(rand.Uint64(), 36)
+
+	values, err := script.Run(ctx, s.client, keys,
+		now,
+		limiterConfig.BlockDuration.Milliseconds(),
+		limiterConfig.RateLimit,
+		max(limiterConfig.RateWindow.Milliseconds(), 1),
+		rate,
+		burst,
+		member,
+		multiplier,
+		limiterConfig.MaxBlockDuration.Milliseconds(),
+		limiterConfig.Decay().Milliseconds(),
+		cost,
+	).Int64Slice()
 	if err != nil {
-		return 0, err
+		return Result{}, err
 	}
 
-	// Set expiration only on the first increment
-	if val == 1 {
-		_, err = s.client.Expire(ctx, key, expiration).Result()
-		if err != nil {
-			return int(val), err
+	result := Result{
+		Allowed:    values[0] == 1,
+		Remaining:  int(values[1]),
+		ResetAfter: time.Duration(values[2]) * time.Millisecond,
+		RetryAfter: time.Duration(values[3]) * time.Millisecond,
+	}
+	if blocked := values[4]; blocked > 0 {
+		result.BlockedKey = append([]string{key}, scriptLinked...)[blocked-1]
+	}
+	result.Blocked = values[5] == 1
+
+	if result.Blocked && s.cluster && len(linked) > 0 {
+		pipe := s.client.Pipeline()
+		for _, k := range linked {
+			pipe.Set(ctx, blocklistKey(k), 1, result.RetryAfter)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return Result{}, err
+		}
+	}
+	return result, nil
+}
+
+// linkedBlock checks the blocks of the linked keys, returning the result of a
+// request rejected by the first blocked one
+func (s *RedisStorage) linkedBlock(ctx context.Context, linked []string) (Result, bool, error) {
+	if len(linked) == 0 {
+		return Result{}, false, nil
+	}
+
+	pipe := s.client.Pipeline()
+	cmds := make([]*redis.DurationCmd, len(linked))
+	for i, k := range linked {
+		cmds[i] = pipe.PTTL(ctx, blocklistKey(k))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Result{}, false, err
+	}
+
+	for i, cmd := range cmds {
+		// -2 means the key is not blocked and -1 that the block never expires
+		ttl := cmd.Val()
+		if ttl == -2 {
+			continue
 		}
+		ttl = max(ttl, 0)
+		return Result{ResetAfter: ttl, RetryAfter: ttl, BlockedKey: linked[i]}, true, nil
 	}
+	return Result{}, false, nil
+}
 
-	return int(val), nil
+// Acquire takes a concurrency slot of a key for the lease, or renews the lease, in a
+// sorted set of the leases scored by their expiry
+func (s *RedisStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	acquired, err := acquireScript.Run(ctx, s.client, []string{stateKey(key, concurrencyKind)},
+		time.Now().UnixMilli(),
+		id,
+		limit,
+		max(lease.Milliseconds(), 1),
+	).Int()
+	return acquired == 1, err
+}
+
+// Release frees the concurrency slot held by a lease
+func (s *RedisStorage) Release(ctx context.Context, key, id string) error {
+	return s.client.ZRem(ctx, stateKey(key, concurrencyKind), id).Err()
 }
 
 // Reset resets the counter for a key
 func (s *RedisStorage) Reset(ctx context.Context, key string) error {
-	return s.client.Del(ctx, key).Err()
+	var keys []string
+	for algorithm := range takeScripts {
+		keys = append(keys, stateKey(key, algorithm))
+	}
+	return s.client.Del(ctx, keys...).Err()
 }
 
 // IsBlocked checks if a key is in the blocklist
 func (s *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
-	blocklistKey := "blocklist:" + key
-	exists, err := s.client.Exists(ctx, blocklistKey).Result()
+	exists, err := s.client.Exists(ctx, blocklistKey(key)).Result()
 	if err != nil {
 		return false, err
 	}
@@ -72,8 +288,206 @@ func (s *RedisStorage) IsBlocked(ctx context.Context, key string) (bool, error)
 
 // Block adds a key to the blocklist with the given expiration
 func (s *RedisStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
-	blocklistKey := "blocklist:" + key
-	return s.client.Set(ctx, blocklistKey, 1, expiration).Err()
+	return s.client.Set(ctx, blocklistKey(key), 1, expiration).Err()
+}
+
+// Unblock removes a key from the blocklist
+func (s *RedisStorage) Unblock(ctx context.Context, key string) error {
+	return s.client.Del(ctx, blocklistKey(key)).Err()
+}
+
+// State returns the counters and the block of a key
+func (s *RedisStorage) State(ctx context.Context, key string) (KeyState, error) {
+	redisKeys := []string{blocklistKey(key), stateKey(key, violationsKind), stateKey(key, concurrencyKind)}
+	for algorithm := range takeScripts {
+		redisKeys = append(redisKeys, stateKey(key, algorithm))
+	}
+
+	states, err := s.readStates(ctx, redisKeys)
+	if err != nil || len(states) == 0 {
+		return KeyState{Key: key}, err
+	}
+	return states[0], nil
+}
+
+// List returns the state of every key with counters or blocks, scanning the whole
+// database, so the storage should have a database of its own
+func (s *RedisStorage) List(ctx context.Context) ([]KeyState, error) {
+	redisKeys, err := s.scan(ctx, "*")
+	if err != nil {
+		return nil, err
+	}
+	return s.readStates(ctx, redisKeys)
+}
+
+// Blocks returns how long each blocked key stays blocked, scanning only the blocklist keys
+func (s *RedisStorage) Blocks(ctx context.Context) (map[string]time.Duration, error) {
+	redisKeys, err := s.scan(ctx, blocklistPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	states, err := s.readStates(ctx, redisKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	blocks := make(map[string]time.Duration, len(states))
+	for _, state := range states {
+		blocks[state.Key] = state.BlockedFor
+	}
+	return blocks, nil
+}
+
+// scan returns the Redis keys matching a pattern
+func (s *RedisStorage) scan(ctx context.Context, pattern string) ([]string, error) {
+	var (
+		mu        sync.Mutex
+		redisKeys []string
+	)
+	scan := func(ctx context.Context, client redis.Cmdable) error {
+		iter := client.Scan(ctx, 0, pattern, listBatchSize).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			redisKeys = append(redisKeys, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	// A cluster is scanned on every master, as each one holds only its own slots
+	var err error
+	if cluster, ok := s.client.(*redis.ClusterClient); ok {
+		err = cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+			return scan(ctx, client)
+		})
+	} else {
+		err = scan(ctx, s.client)
+	}
+	return redisKeys, err
+}
+
+// AccessList returns the sorted entries of an access list
+func (s *RedisStorage) AccessList(ctx context.Context, list string) ([]string, error) {
+	entries, err := s.client.SMembers(ctx, accessPrefix+list).Result()
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(entries)
+	return entries, nil
+}
+
+// AddAccess adds an entry to an access list
+func (s *RedisStorage) AddAccess(ctx context.Context, list, entry string) error {
+	return s.client.SAdd(ctx, accessPrefix+list, entry).Err()
+}
+
+// RemoveAccess removes an entry from an access list
+func (s *RedisStorage) RemoveAccess(ctx context.Context, list, entry string) error {
+	return s.client.SRem(ctx, accessPrefix+list, entry).Err()
+}
+
+// readStates reads the given Redis keys in pipelined batches and groups them by the key they belong to,
+// keys that do not exist or do not hold a rate limiter state are skipped
+func (s *RedisStorage) readStates(ctx context.Context, redisKeys []string) ([]KeyState, error) {
+	var states []*KeyState
+	byKey := make(map[string]*KeyState)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+
+	for start := 0; start < len(redisKeys); start += listBatchSize {
+		batch := redisKeys[start:min(start+listBatchSize, len(redisKeys))]
+
+		pipe := s.client.Pipeline()
+		cmds := make([]redis.Cmder, len(batch))
+		for i, redisKey := range batch {
+			_, kind, ok := parseRedisKey(redisKey)
+			if !ok {
+				continue
+			}
+			switch kind {
+			case blockedKind:
+				cmds[i] = pipe.PTTL(ctx, redisKey)
+			case config.AlgorithmFixedWindow, violationsKind:
+				cmds[i] = pipe.Get(ctx, redisKey)
+			case config.AlgorithmSlidingWindowLog:
+				cmds[i] = pipe.ZCard(ctx, redisKey)
+			case concurrencyKind:
+				// Only the leases that did not expire hold a slot
+				cmds[i] = pipe.ZCount(ctx, redisKey, now, "+inf")
+			case config.AlgorithmSlidingWindowCounter:
+				cmds[i] = pipe.HGetAll(ctx, redisKey)
+			default:
+				cmds[i] = pipe.HGet(ctx, redisKey, "level")
+			}
+		}
+		// Errors are checked per command, as a missing or foreign key only fails its own command
+		_, _ = pipe.Exec(ctx)
+
+		for i, cmd := range cmds {
+			if cmd == nil {
+				continue
+			}
+			var replyErr redis.Error
+			if err := cmd.Err(); errors.Is(err, redis.Nil) || errors.As(err, &replyErr) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			key, kind, _ := parseRedisKey(batch[i])
+			state, found := byKey[key]
+			if !found {
+				state = &KeyState{Key: key, Counters: make(map[string]int)}
+			}
+
+			switch cmd := cmd.(type) {
+			case *redis.DurationCmd:
+				// -2 means the block expired in the meantime and -1 that it never expires
+				if cmd.Val() == -2 {
+					continue
+				}
+				state.BlockedFor = cmd.Val()
+			case *redis.StringCmd:
+				count, err := cmd.Float64()
+				if err != nil {
+					continue
+				}
+				if kind == violationsKind {
+					state.Violations = int(count)
+				} else {
+					state.Counters[kind] = int(count)
+				}
+			case *redis.IntCmd:
+				if kind == concurrencyKind {
+					if cmd.Val() == 0 {
+						continue
+					}
+					state.InFlight = int(cmd.Val())
+				} else {
+					state.Counters[kind] = int(cmd.Val())
+				}
+			case *redis.MapStringStringCmd:
+				// The current window is the highest window number
+				var current int64
+				for window, count := range cmd.Val() {
+					if w, _ := strconv.ParseInt(window, 10, 64); w >= current {
+						current = w
+						state.Counters[kind], _ = strconv.Atoi(count)
+					}
+				}
+			}
+
+			if !found {
+				byKey[key] = state
+				states = append(states, state)
+			}
+		}
+	}
+
+	result := make([]KeyState, len(states))
+	for i, state := range states {
+		result[i] = *state
+	}
+	return result, nil
 }
 
 // Close closes the Redis connection
@@ -81,6 +495,63 @@ func (s *RedisStorage) Close() error {
 	return s.client.Close()
 }
 
+// hashTag wraps a key in braces, so every Redis key built from it hashes to the same cluster slot
+func hashTag(key string) string {
+	return "{" + key + "}"
+}
+
+// stateKey returns the key holding the state of an algorithm for a key, the fixed window
+// counter is kept in the tagged key itself
+func stateKey(key, algorithm string) string {
+	switch algorithm {
+	case config.AlgorithmFixedWindow:
+		return hashTag(key)
+	case config.AlgorithmSlidingWindowLog:
+		return hashTag(key) + ":log"
+	case config.AlgorithmSlidingWindowCounter:
+		return hashTag(key) + ":counter"
+	case config.AlgorithmTokenBucket:
+		return hashTag(key) + ":tokens"
+	case config.AlgorithmLeakyBucket:
+		return hashTag(key) + ":leaky"
+	default:
+		return hashTag(key) + ":" + algorithm
+	}
+}
+
+// blocklistKey returns the key that marks a key as blocked
+func blocklistKey(key string) string {
+	return blocklistPrefix + hashTag(key)
+}
+
+// parseRedisKey returns the key a Redis key belongs to and whether it holds its block or the
+// state of an algorithm, reporting false for keys that do not belong to the rate limiter
+func parseRedisKey(redisKey string) (string, string, bool) {
+	kind := config.AlgorithmFixedWindow
+	if tagged, found := strings.CutPrefix(redisKey, blocklistPrefix); found {
+		redisKey, kind = tagged, blockedKind
+	} else if tagged, found := strings.CutSuffix(redisKey, strings.TrimPrefix(stateKey("", violationsKind), hashTag(""))); found {
+		redisKey, kind = tagged, violationsKind
+	} else if tagged, found := strings.CutSuffix(redisKey, strings.TrimPrefix(stateKey("", concurrencyKind), hashTag(""))); found {
+		redisKey, kind = tagged, concurrencyKind
+	} else {
+		for algorithm := range takeScripts {
+			if algorithm == config.AlgorithmFixedWindow {
+				continue
+			}
+			if tagged, found := strings.CutSuffix(redisKey, strings.TrimPrefix(stateKey("", algorithm), hashTag(""))); found {
+				redisKey, kind = tagged, algorithm
+				break
+			}
+		}
+	}
+
+	if len(redisKey) < 2 || redisKey[0] != '{' || redisKey[len(redisKey)-1] != '}' {
+		return "", "", false
+	}
+	return redisKey[1 : len(redisKey)-1], kind, true
+}
+
 func init() {
 	Register("redis", func(cfg config.StorageConfig) (Storage, error) {
 		return NewRedis(cfg)
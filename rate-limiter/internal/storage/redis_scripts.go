@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/redis/go-redis/v9"
+)
+
+// incrementScript adds to a counter and sets its expiration when it has none,
+// so a counter can never be left without a TTL.
+//
+// KEYS[1] counter key
+// ARGV[1] expiration in milliseconds
+// ARGV[2] amount to add
+var incrementScript = redis.NewScript(`
+local count = redis.call('INCRBY', KEYS[1], ARGV[2])
+if redis.call('PTTL', KEYS[1]) < 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return count
+`)
+
+// acquireScript takes a concurrency slot for a lease in a sorted set of the leases
+// scored by their expiry, dropping the expired ones first, and reports 1 when the slot
+// was taken or the lease already held one and was renewed. The set expires with the
+// lease, so the slots of a crashed instance are freed.
+//
+// KEYS[1] leases key
+// ARGV[1] now in milliseconds
+// ARGV[2] lease id
+// ARGV[3] limit
+// ARGV[4] lease in milliseconds
+var acquireScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local lease = tonumber(ARGV[4])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now)
+if not redis.call('ZSCORE', KEYS[1], ARGV[2]) and redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now + lease, ARGV[2])
+if redis.call('PTTL', KEYS[1]) < lease then
+	redis.call('PEXPIRE', KEYS[1], lease)
+end
+return 1
+`)
+
+// incrementByScript adds the requests counted locally to a fixed window counter,
+// starting the window when the counter does not exist, and returns the counter and
+// how long until the window ends. Without requests the counter is only read, so a
+// window that already ended is not started again.
+//
+// KEYS[1] counter key
+// ARGV[1] requests to add
+// ARGV[2] window in milliseconds
+var incrementByScript = redis.NewScript(`
+local count
+if tonumber(ARGV[1]) > 0 then
+	count = redis.call('INCRBY', KEYS[1], ARGV[1])
+	if redis.call('PTTL', KEYS[1]) < 0 then
+		redis.call('PEXPIRE', KEYS[1], ARGV[2])
+	end
+else
+	count = tonumber(redis.call('GET', KEYS[1]) or '0')
+end
+return {count, redis.call('PTTL', KEYS[1])}
+`)
+
+// Every take script shares the same keys and arguments:
+//
+// KEYS[1]    algorithm state key
+// KEYS[2]    blocklist key of the limited key
+// KEYS[3..n] blocklist keys of the linked keys, left out in a cluster where they may be in other slots
+// KEYS[n+1]  violations key of the limited key, only with progressive blocks
+// ARGV[1]    current time in milliseconds
+// ARGV[2]    block duration in milliseconds
+// ARGV[3]    rate limit
+// ARGV[4]    rate window in milliseconds
+// ARGV[5]    refill rate in requests per second
+// ARGV[6]    burst size
+// ARGV[7]    unique member for the current request
+// ARGV[8]    block multiplier, the blocks are progressive when greater than 1
+// ARGV[9]    max block duration in milliseconds
+// ARGV[10]   violation decay in milliseconds
+// ARGV[11]   cost of the request, in requests
+//
+// Every take script returns {allowed, remaining, reset, retry, blocked, blockedNow},
+// where reset and retry are in milliseconds, blocked is the position of the blocked
+// key among the blocklist keys, or zero when no key is blocked, and blockedNow is 1
+// when the request exceeded the limit and blocked the keys.
+//
+// The prelude rejects the request when any of the keys is blocked and the
+// epilogue blocks all of them when the algorithm body did not allow it, for
+// longer on every repeat offense of the limited key with progressive blocks.
+// The bodies set allowed, remaining, reset and retry.
+const (
+	takePrelude = `
+local multiplier = tonumber(ARGV[8])
+local blocklists = #KEYS
+if multiplier > 1 then
+	blocklists = #KEYS - 1
+end
+
+for i = 2, blocklists do
+	local ttl = redis.call('PTTL', KEYS[i])
+	if ttl ~= -2 then
+		ttl = math.max(ttl, 0)
+		return {0, 0, ttl, ttl, i - 1, 0}
+	end
+end
+
+local now = tonumber(ARGV[1])
+local blockDuration = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+local window = tonumber(ARGV[4])
+local rate = tonumber(ARGV[5])
+local burst = tonumber(ARGV[6])
+local cost = tonumber(ARGV[11])
+local allowed = 0
+local remaining = 0
+local reset = 0
+local retry = 0
+`
+
+	takeEpilogue = `
+local blocked = 0
+if allowed == 0 and blockDuration > 0 then
+	if multiplier > 1 then
+		local violations = redis.call('INCR', KEYS[#KEYS])
+		blockDuration = math.min(math.floor(blockDuration * multiplier ^ (violations - 1)), tonumber(ARGV[9]))
+		redis.call('PEXPIRE', KEYS[#KEYS], blockDuration + tonumber(ARGV[10]))
+	end
+	for i = 2, blocklists do
+		redis.call('SET', KEYS[i], 1, 'PX', blockDuration)
+	end
+	retry = blockDuration
+	reset = math.max(reset, blockDuration)
+	blocked = 1
+end
+
+return {allowed, remaining, reset, retry, blocked, blocked}
+`
+)
+
+// takeScripts holds the take script of every algorithm
+var takeScripts = map[string]*redis.Script{
+	// The fixed window counts the requests in a counter that expires with the window
+	config.AlgorithmFixedWindow: newTakeScript(`
+local count = redis.call('INCRBY', KEYS[1], cost)
+reset = redis.call('PTTL', KEYS[1])
+if reset < 0 then
+	redis.call('PEXPIRE', KEYS[1], window)
+	reset = window
+end
+
+remaining = math.max(0, limit - count)
+if count <= limit then
+	allowed = 1
+else
+	retry = reset
+end
+`),
+
+	// The sliding log keeps the requests in a sorted set scored by their arrival time,
+	// once for every request of the cost
+	config.AlgorithmSlidingWindowLog: newTakeScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+for i = 1, cost do
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[7] .. '-' .. i)
+end
+redis.call('PEXPIRE', KEYS[1], window)
+
+local count = redis.call('ZCARD', KEYS[1])
+remaining = math.max(0, limit - count)
+reset = window
+if count <= limit then
+	allowed = 1
+else
+	-- A new request fits once the requests up to this one leave the window
+	local oldest = redis.call('ZRANGE', KEYS[1], count - limit, count - limit, 'WITHSCORES')
+	retry = tonumber(oldest[2]) + window - now
+end
+`),
+
+	// The sliding counter keeps the window counters in a hash indexed by window number
+	// and weights the previous window counter by its overlap with the sliding window
+	config.AlgorithmSlidingWindowCounter: newTakeScript(`
+local current = math.floor(now / window)
+local elapsed = now - current * window
+
+local count = redis.call('HINCRBY', KEYS[1], tostring(current), cost)
+local previous = tonumber(redis.call('HGET', KEYS[1], tostring(current - 1)) or '0')
+
+-- Drop the windows that no longer overlap the sliding window
+for _, field in ipairs(redis.call('HKEYS', KEYS[1])) do
+	if tonumber(field) < current - 1 then
+		redis.call('HDEL', KEYS[1], field)
+	end
+end
+redis.call('PEXPIRE', KEYS[1], window * 2)
+
+local estimated = math.floor(previous * (window - elapsed) / window) + count
+remaining = math.max(0, limit - estimated)
+reset = window - elapsed
+if estimated <= limit then
+	allowed = 1
+else
+	retry = reset
+end
+`),
+
+	// The token bucket is refilled with the tokens earned since the last request
+	// and each request takes as many tokens as it costs
+	config.AlgorithmTokenBucket: newTakeScript(`
+local state = redis.call('HMGET', KEYS[1], 'level', 'updated_at')
+local tokens = tonumber(state[1]) or burst
+local updatedAt = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - updatedAt) * rate / 1000)
+if tokens >= cost then
+	tokens = tokens - cost
+	allowed = 1
+else
+	retry = math.ceil((cost - tokens) / rate * 1000)
+end
+remaining = math.floor(tokens)
+reset = math.ceil((burst - tokens) / rate * 1000)
+
+redis.call('HSET', KEYS[1], 'level', tostring(tokens), 'updated_at', ARGV[1])
+-- Once the bucket is full again its state is no longer needed
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+`),
+
+	// The leaky bucket drains the requests leaked since the last request and each
+	// request takes as many places in the bucket as it costs
+	config.AlgorithmLeakyBucket: newTakeScript(`
+local state = redis.call('HMGET', KEYS[1], 'level', 'updated_at')
+local level = tonumber(state[1]) or 0
+local updatedAt = tonumber(state[2]) or now
+
+level = math.max(0, level - math.max(0, now - updatedAt) * rate / 1000)
+if level + cost <= burst then
+	level = level + cost
+	allowed = 1
+else
+	retry = math.ceil((level + cost - burst) / rate * 1000)
+end
+remaining = math.floor(burst - level)
+reset = math.ceil(level / rate * 1000)
+
+redis.call('HSET', KEYS[1], 'level', tostring(level), 'updated_at', ARGV[1])
+-- Once the bucket is empty again its state is no longer needed
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000))
+`),
+}
+
+// newTakeScript wraps an algorithm body with the block check and the blocking of the keys
+func newTakeScript(body string) *redis.Script {
+	return redis.NewScript(takePrelude + body + takeEpilogue)
+}
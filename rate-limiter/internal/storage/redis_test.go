@@ -0,0 +1,64 @@
+package storage_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+func TestRedisStorageHashTags(t *testing.T) {
+	mr := miniredis.RunT(t)
+	store, err := storage.NewRedis(config.StorageConfig{Mode: config.RedisModeCluster, Addrs: []string{mr.Addr()}})
+	if err != nil {
+		t.Fatalf("Error connecting to redis cluster: %v", err)
+	}
+	defer store.Close()
+
+	limiterConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute, Algorithm: config.AlgorithmSlidingWindowLog}
+	take(t, store, "ip:10.0.0.5", limiterConfig)
+	take(t, store, "ip:10.0.0.5", limiterConfig)
+
+	// Every key of ip:10.0.0.5 shares the hash tag, so they are in the same cluster slot
+	keys := mr.Keys()
+	expected := []string{"blocklist:{ip:10.0.0.5}", "{ip:10.0.0.5}:log"}
+	if !slices.Equal(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+}
+
+func TestRedisStorageModes(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.StorageConfig
+		expected error
+	}{
+		{
+			name:     "Unknown mode",
+			cfg:      config.StorageConfig{Mode: "replicated", Addrs: []string{"localhost:6379"}},
+			expected: storage.ErrUnknownRedisMode,
+		},
+		{
+			name:     "Cluster without addrs",
+			cfg:      config.StorageConfig{Mode: config.RedisModeCluster},
+			expected: storage.ErrMissingRedisAddr,
+		},
+		{
+			name:     "Sentinel without master",
+			cfg:      config.StorageConfig{Mode: config.RedisModeSentinel, Addrs: []string{"localhost:26379"}},
+			expected: storage.ErrMissingMaster,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := storage.NewRedis(tt.cfg); !errors.Is(err, tt.expected) {
+				t.Errorf("Expected %v, got %v", tt.expected, err)
+			}
+		})
+	}
+}
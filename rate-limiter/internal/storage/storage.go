@@ -3,6 +3,7 @@ package storage
 import (
 	"context"
 	"errors"
+	"math"
 	"sync"
 	"time"
 
@@ -10,14 +11,62 @@ import (
 )
 
 var (
-	ErrStorageNotFound = errors.New("storage not found")
+	ErrStorageNotFound  = errors.New("storage not found")
+	ErrUnknownAlgorithm = errors.New("unknown rate limit algorithm")
+	ErrInvalidLimit     = errors.New("rate limit policy without a positive limit")
 )
 
+// positiveLimit reports whether the algorithm of a policy has a positive limit and window,
+// or refill rate and burst, as the policies without one can't be applied to a request
+func positiveLimit(limiterConfig config.LimiterConfig) bool {
+	switch limiterConfig.Algorithm {
+	case config.AlgorithmTokenBucket, config.AlgorithmLeakyBucket:
+		rate, burst := limiterConfig.Bucket()
+		return rate > 0 && burst > 0
+	case "", config.AlgorithmFixedWindow, config.AlgorithmSlidingWindowLog, config.AlgorithmSlidingWindowCounter:
+		return limiterConfig.RateLimit > 0 && limiterConfig.RateWindow > 0
+	}
+	// The storages report the unknown algorithms
+	return true
+}
+
 var (
 	registry   = make(map[string]func(config.StorageConfig) (Storage, error))
 	registryMu sync.RWMutex
 )
 
+// Result is the outcome of a Take
+type Result struct {
+	// Allowed reports whether the request was allowed
+	Allowed bool
+	// Remaining is how many requests are still allowed by the algorithm
+	Remaining int
+	// ResetAfter is how long until the algorithm fully restores the limit
+	ResetAfter time.Duration
+	// RetryAfter is how long until a rejected request may be retried
+	RetryAfter time.Duration
+	// BlockedKey is the key whose block rejected the request, it is also set when the request blocked the key
+	BlockedKey string
+	// Blocked reports that the request exceeded the limit and blocked the key and the linked keys
+	Blocked bool
+}
+
+// KeyState describes what a storage holds for a key
+type KeyState struct {
+	Key string
+	// Counters maps each algorithm with state for the key to the requests it counted,
+	// for the bucket algorithms it is the tokens left or the requests queued
+	Counters map[string]int
+	// BlockedFor is how long the key stays blocked, zero when it is not blocked
+	// and negative when the block never expires
+	BlockedFor time.Duration
+	// Violations is how many times the key was blocked by a progressive block policy
+	// since its offenses were last forgotten
+	Violations int
+	// InFlight is how many requests of the key hold a concurrency slot
+	InFlight int
+}
+
 // Storage Strategy defines the interface for rate limiter storage backends
 type Storage interface {
 	// Get returns the current count for a key
@@ -27,6 +76,24 @@ type Storage interface {
 	// If the key doesn't exist, it creates it with the given expiration
 	Increment(ctx context.Context, key string, expiration time.Duration) (int, error)
 
+	// IncrementBy adds n to the counter for a key and returns the new value, creating
+	// it with the given expiration like Increment
+	IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error)
+
+	// Take atomically checks whether the key or any of the linked keys is blocked, registers a
+	// request costing cost requests for the key with the algorithm of limiterConfig and, when
+	// the limit is exceeded, blocks the key and the linked keys for limiterConfig.BlockFor the
+	// offenses of the key
+	Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (Result, error)
+
+	// Acquire takes one of the limit concurrency slots of a key for the lease id until
+	// the lease expires or is released, renewing the lease when it already holds a slot,
+	// and reports false when every slot is taken
+	Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error)
+
+	// Release frees the concurrency slot held by a lease
+	Release(ctx context.Context, key, id string) error
+
 	// Reset resets the counter for a key
 	Reset(ctx context.Context, key string) error
 
@@ -36,6 +103,28 @@ type Storage interface {
 	// Block adds a key to the blocklist with the given expiration
 	Block(ctx context.Context, key string, expiration time.Duration) error
 
+	// Unblock removes a key from the blocklist
+	Unblock(ctx context.Context, key string) error
+
+	// State returns the counters and the block of a key
+	State(ctx context.Context, key string) (KeyState, error)
+
+	// List returns the state of every key with counters or blocks
+	List(ctx context.Context) ([]KeyState, error)
+
+	// Blocks returns how long each blocked key stays blocked, negative when the block never
+	// expires, reading only the blocks
+	Blocks(ctx context.Context) (map[string]time.Duration, error)
+
+	// AccessList returns the sorted entries of an access list, such as config.AccessListAllow
+	AccessList(ctx context.Context, list string) ([]string, error)
+
+	// AddAccess adds an entry to an access list
+	AddAccess(ctx context.Context, list, entry string) error
+
+	// RemoveAccess removes an entry from an access list
+	RemoveAccess(ctx context.Context, list, entry string) error
+
 	// Close closes the storage connection
 	Close() error
 }
@@ -56,3 +145,15 @@ func New(storageName string, storageCfg config.StorageConfig) (Storage, error) {
 	}
 	return factory(storageCfg)
 }
+
+// weightedCount estimates the requests inside a sliding window from the previous and current
+// fixed window counts, assuming the previous window requests were evenly distributed
+func weightedCount(previous, current int, elapsed, window time.Duration) int {
+	weight := float64(window-elapsed) / float64(window)
+	return int(math.Floor(float64(previous)*weight)) + current
+}
+
+// bucketDuration returns how long a bucket takes to refill or leak the given amount of requests at rate requests per second
+func bucketDuration(amount, rate float64) time.Duration {
+	return time.Duration(math.Ceil(amount / rate * float64(time.Second)))
+}
@@ -0,0 +1,547 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+// backend is a storage under test along with a way to let time pass for it
+type backend struct {
+	store storage.Storage
+	wait  func(d time.Duration)
+}
+
+// newBackends returns every storage backend, the Redis one backed by an in-process server
+// whose clock is moved forward along with the wall clock
+func newBackends(t *testing.T) map[string]backend {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	redisStore, err := storage.NewRedis(config.StorageConfig{URL: "redis://" + mr.Addr()})
+	if err != nil {
+		t.Fatalf("Error connecting to redis: %v", err)
+	}
+	t.Cleanup(func() { redisStore.Close() })
+
+	// miniredis answers the cluster commands as a single node owning every slot
+	mrCluster := miniredis.RunT(t)
+	clusterStore, err := storage.NewRedis(config.StorageConfig{Mode: config.RedisModeCluster, Addrs: []string{mrCluster.Addr()}})
+	if err != nil {
+		t.Fatalf("Error connecting to redis cluster: %v", err)
+	}
+	t.Cleanup(func() { clusterStore.Close() })
+
+	memoryStore := storage.NewMemoryStorage(config.StorageConfig{})
+	t.Cleanup(func() { memoryStore.Close() })
+
+	return map[string]backend{
+		"memory": {
+			store: memoryStore,
+			wait:  time.Sleep,
+		},
+		"redis": {
+			store: redisStore,
+			wait: func(d time.Duration) {
+				time.Sleep(d)
+				mr.FastForward(d)
+			},
+		},
+		"redis-cluster": {
+			store: clusterStore,
+			wait: func(d time.Duration) {
+				time.Sleep(d)
+				mrCluster.FastForward(d)
+			},
+		},
+	}
+}
+
+// take calls Take and fails the test on error
+func take(t *testing.T, store storage.Storage, key string, limiterConfig config.LimiterConfig, linked ...string) storage.Result {
+	t.Helper()
+
+	result, err := store.Take(context.Background(), key, 1, limiterConfig, linked...)
+	if err != nil {
+		t.Fatalf("Error taking %s: %v", key, err)
+	}
+	return result
+}
+
+func TestIncrement(t *testing.T) {
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for i := 1; i <= 2; i++ {
+				count, err := b.store.Increment(ctx, "ip:10.0.0.1", 100*time.Millisecond)
+				if err != nil {
+					t.Fatalf("Error incrementing: %v", err)
+				}
+				if count != i {
+					t.Errorf("Increment %d should return %d, got %d", i, i, count)
+				}
+			}
+
+			// The counter expires with the window set on the first increment
+			b.wait(150 * time.Millisecond)
+			count, err := b.store.Get(ctx, "ip:10.0.0.1")
+			if err != nil {
+				t.Fatalf("Error getting count: %v", err)
+			}
+			if count != 0 {
+				t.Errorf("Counter should expire, got %d", count)
+			}
+		})
+	}
+}
+
+func TestIncrementBy(t *testing.T) {
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for i, n := range []int{3, 2} {
+				count, err := b.store.IncrementBy(ctx, "quota:abc", n, time.Minute)
+				if err != nil {
+					t.Fatalf("Error incrementing: %v", err)
+				}
+				if expected := []int{3, 5}[i]; count != expected {
+					t.Errorf("Increment %d should return %d, got %d", i+1, expected, count)
+				}
+			}
+		})
+	}
+}
+
+func TestTakeAlgorithms(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.LimiterConfig
+		// refill is how long it takes for one more request to be allowed
+		refill time.Duration
+	}{
+		{
+			name:   "fixed window",
+			config: config.LimiterConfig{RateLimit: 3, RateWindow: 200 * time.Millisecond},
+			refill: 250 * time.Millisecond,
+		},
+		{
+			name:   "sliding window log",
+			config: config.LimiterConfig{RateLimit: 3, RateWindow: 200 * time.Millisecond, Algorithm: config.AlgorithmSlidingWindowLog},
+			refill: 250 * time.Millisecond,
+		},
+		{
+			name:   "sliding window counter",
+			config: config.LimiterConfig{RateLimit: 3, RateWindow: 200 * time.Millisecond, Algorithm: config.AlgorithmSlidingWindowCounter},
+			refill: 450 * time.Millisecond,
+		},
+		{
+			name:   "token bucket",
+			config: config.LimiterConfig{RefillRate: 10, Burst: 3, Algorithm: config.AlgorithmTokenBucket},
+			refill: 150 * time.Millisecond,
+		},
+		{
+			name:   "leaky bucket",
+			config: config.LimiterConfig{RefillRate: 10, Burst: 3, Algorithm: config.AlgorithmLeakyBucket},
+			refill: 150 * time.Millisecond,
+		},
+	}
+
+	for name, b := range newBackends(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				key := "ip:" + tt.name
+
+				if tt.config.Algorithm == config.AlgorithmSlidingWindowCounter {
+					// Start right after a window boundary so every request lands in the same window
+					time.Sleep(time.Until(time.Now().Truncate(tt.config.RateWindow).Add(tt.config.RateWindow)))
+				}
+
+				for i := 1; i <= 3; i++ {
+					result := take(t, b.store, key, tt.config)
+					if !result.Allowed {
+						t.Errorf("Request %d should be allowed", i)
+					}
+					if result.Remaining != 3-i {
+						t.Errorf("Request %d should leave %d remaining, got %d", i, 3-i, result.Remaining)
+					}
+					if result.ResetAfter <= 0 {
+						t.Errorf("Request %d should report when the limit resets, got %v", i, result.ResetAfter)
+					}
+				}
+
+				result := take(t, b.store, key, tt.config)
+				if result.Allowed {
+					t.Errorf("Request should be rejected after exceeding the limit")
+				}
+				if result.RetryAfter <= 0 || result.RetryAfter > tt.refill {
+					t.Errorf("Rejected request should be retried within %v, got %v", tt.refill, result.RetryAfter)
+				}
+
+				b.wait(tt.refill)
+				if !take(t, b.store, key, tt.config).Allowed {
+					t.Errorf("Request should be allowed once the limit refills")
+				}
+			})
+		}
+	}
+}
+
+func TestTakeCost(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.LimiterConfig
+	}{
+		{"fixed window", config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute}},
+		{"sliding window log", config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute, Algorithm: config.AlgorithmSlidingWindowLog}},
+		{"sliding window counter", config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute, Algorithm: config.AlgorithmSlidingWindowCounter}},
+		{"token bucket", config.LimiterConfig{RefillRate: 0.01, Burst: 5, Algorithm: config.AlgorithmTokenBucket}},
+		{"leaky bucket", config.LimiterConfig{RefillRate: 0.01, Burst: 5, Algorithm: config.AlgorithmLeakyBucket}},
+	}
+
+	for name, b := range newBackends(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ctx := context.Background()
+
+				// A request costing more than the whole limit is never allowed
+				result, err := b.store.Take(ctx, "ip:heavy "+tt.name, 6, tt.config)
+				if err != nil {
+					t.Fatalf("Error taking: %v", err)
+				}
+				if result.Allowed {
+					t.Errorf("Request costing more than the limit should be rejected")
+				}
+
+				key := "ip:" + tt.name
+				for i, cost := range []int{3, 2} {
+					result, err := b.store.Take(ctx, key, cost, tt.config)
+					if err != nil {
+						t.Fatalf("Error taking: %v", err)
+					}
+					if expected := []int{2, 0}[i]; !result.Allowed || result.Remaining != expected {
+						t.Errorf("Request %d costing %d should leave %d remaining, got %+v", i+1, cost, expected, result)
+					}
+				}
+				if take(t, b.store, key, tt.config).Allowed {
+					t.Errorf("Request should be rejected once the costs used the limit")
+				}
+			})
+		}
+	}
+}
+
+func TestTakeInvalidLimit(t *testing.T) {
+	tests := []struct {
+		name   string
+		config config.LimiterConfig
+	}{
+		{"fixed window", config.LimiterConfig{RateWindow: time.Minute}},
+		{"sliding window log", config.LimiterConfig{RateWindow: time.Minute, Algorithm: config.AlgorithmSlidingWindowLog}},
+		{"sliding window counter", config.LimiterConfig{RateLimit: 5, Algorithm: config.AlgorithmSlidingWindowCounter}},
+		{"token bucket", config.LimiterConfig{Burst: 5, Algorithm: config.AlgorithmTokenBucket}},
+	}
+
+	for name, b := range newBackends(t) {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				if _, err := b.store.Take(context.Background(), "ip:"+tt.name, 1, tt.config); !errors.Is(err, storage.ErrInvalidLimit) {
+					t.Errorf("Expected ErrInvalidLimit, got %v", err)
+				}
+			})
+		}
+	}
+}
+
+func TestSlidingWindowCounterWeightsPreviousWindow(t *testing.T) {
+	limiterConfig := config.LimiterConfig{RateLimit: 4, RateWindow: 400 * time.Millisecond, Algorithm: config.AlgorithmSlidingWindowCounter}
+
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			// Use the whole limit at the end of a window
+			time.Sleep(time.Until(time.Now().Truncate(limiterConfig.RateWindow).Add(limiterConfig.RateWindow)))
+			time.Sleep(limiterConfig.RateWindow - 50*time.Millisecond)
+			for i := 1; i <= 4; i++ {
+				if !take(t, b.store, "ip:10.0.0.2", limiterConfig).Allowed {
+					t.Errorf("Request %d should be allowed", i)
+				}
+			}
+
+			// A fixed window would allow a new burst of 4 requests here, while the previous
+			// window still weighs almost fully on the sliding counter
+			time.Sleep(100 * time.Millisecond)
+			if !take(t, b.store, "ip:10.0.0.2", limiterConfig).Allowed {
+				t.Errorf("Request should be allowed while the weighted count is under the limit")
+			}
+			if take(t, b.store, "ip:10.0.0.2", limiterConfig).Allowed {
+				t.Errorf("Request should be rejected while the previous window still weighs")
+			}
+		})
+	}
+}
+
+func TestTakeBlocks(t *testing.T) {
+	limiterConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: 200 * time.Millisecond}
+
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			if !take(t, b.store, "token:abc", limiterConfig, "ip:10.0.0.3").Allowed {
+				t.Errorf("First request should be allowed")
+			}
+			result := take(t, b.store, "token:abc", limiterConfig, "ip:10.0.0.3")
+			if result.Allowed {
+				t.Errorf("Second request should be rejected")
+			}
+			if result.BlockedKey != "token:abc" || !result.Blocked || result.RetryAfter != limiterConfig.BlockDuration {
+				t.Errorf("Exceeding the limit should block token:abc for %v, got %q for %v", limiterConfig.BlockDuration, result.BlockedKey, result.RetryAfter)
+			}
+
+			// Exceeding the limit blocks the key and the linked keys
+			for _, key := range []string{"token:abc", "ip:10.0.0.3"} {
+				blocked, err := b.store.IsBlocked(ctx, key)
+				if err != nil {
+					t.Fatalf("Error checking block: %v", err)
+				}
+				if !blocked {
+					t.Errorf("%s should be blocked", key)
+				}
+			}
+			result = take(t, b.store, "other:key", limiterConfig, "ip:10.0.0.3")
+			if result.Allowed {
+				t.Errorf("Blocked linked key should be rejected")
+			}
+			if result.BlockedKey != "ip:10.0.0.3" || result.Blocked || result.RetryAfter <= 0 {
+				t.Errorf("Request should report the block of ip:10.0.0.3, got %q for %v", result.BlockedKey, result.RetryAfter)
+			}
+
+			// Blocks expire after the block duration
+			b.wait(250 * time.Millisecond)
+			if err := b.store.Reset(ctx, "token:abc"); err != nil {
+				t.Fatalf("Error resetting key: %v", err)
+			}
+			if !take(t, b.store, "token:abc", limiterConfig, "ip:10.0.0.3").Allowed {
+				t.Errorf("Request should be allowed after the block expires")
+			}
+		})
+	}
+}
+
+func TestTakeProgressiveBlocks(t *testing.T) {
+	limiterConfig := config.LimiterConfig{
+		RateLimit:        1,
+		RateWindow:       time.Minute,
+		BlockDuration:    100 * time.Millisecond,
+		BlockMultiplier:  2,
+		MaxBlockDuration: 300 * time.Millisecond,
+		ViolationDecay:   200 * time.Millisecond,
+	}
+
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			take(t, b.store, "ip:10.0.0.5", limiterConfig, "ip:10.0.0.6")
+
+			// Every offense doubles the block, up to the max block duration
+			for i, expected := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond} {
+				result := take(t, b.store, "ip:10.0.0.5", limiterConfig, "ip:10.0.0.6")
+				if !result.Blocked || result.RetryAfter != expected {
+					t.Fatalf("Offense %d should block for %v, got %+v", i+1, expected, result)
+				}
+
+				// The linked keys are blocked as long, without offenses of their own
+				linked, err := b.store.State(ctx, "ip:10.0.0.6")
+				if err != nil {
+					t.Fatalf("Error getting state: %v", err)
+				}
+				if linked.BlockedFor <= expected-50*time.Millisecond || linked.BlockedFor > expected || linked.Violations != 0 {
+					t.Errorf("Offense %d should block the linked key for %v, got %+v", i+1, expected, linked)
+				}
+				b.wait(expected + 20*time.Millisecond)
+			}
+
+			state, err := b.store.State(ctx, "ip:10.0.0.5")
+			if err != nil {
+				t.Fatalf("Error getting state: %v", err)
+			}
+			if state.Violations != 3 {
+				t.Errorf("Expected 3 violations, got %+v", state)
+			}
+
+			// The offenses are forgotten after the quiet period
+			b.wait(250 * time.Millisecond)
+			result := take(t, b.store, "ip:10.0.0.5", limiterConfig, "ip:10.0.0.6")
+			if !result.Blocked || result.RetryAfter != limiterConfig.BlockDuration {
+				t.Errorf("Expected the block duration to start over, got %+v", result)
+			}
+		})
+	}
+}
+
+func TestConcurrencySlots(t *testing.T) {
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			// acquire takes a slot of ip:10.0.0.7 and fails the test on error
+			acquire := func(id string, lease time.Duration) bool {
+				t.Helper()
+				acquired, err := b.store.Acquire(ctx, "ip:10.0.0.7", id, 2, lease)
+				if err != nil {
+					t.Fatalf("Error acquiring %s: %v", id, err)
+				}
+				return acquired
+			}
+
+			if !acquire("a", time.Minute) || !acquire("b", time.Minute) {
+				t.Fatalf("Expected both slots to be taken")
+			}
+			if acquire("c", time.Minute) {
+				t.Errorf("Expected no slot left for c")
+			}
+			// A lease holding a slot is renewed even with no slot left
+			if !acquire("a", time.Minute) {
+				t.Errorf("Expected the lease of a to be renewed")
+			}
+
+			state, err := b.store.State(ctx, "ip:10.0.0.7")
+			if err != nil {
+				t.Fatalf("Error getting state: %v", err)
+			}
+			if state.InFlight != 2 {
+				t.Errorf("Expected 2 requests in flight, got %+v", state)
+			}
+
+			if err := b.store.Release(ctx, "ip:10.0.0.7", "a"); err != nil {
+				t.Fatalf("Error releasing: %v", err)
+			}
+			if !acquire("c", 100*time.Millisecond) {
+				t.Errorf("Expected the slot released by a to be taken by c")
+			}
+
+			// The lease of a crashed request expires and frees its slot
+			b.wait(150 * time.Millisecond)
+			if !acquire("d", time.Minute) {
+				t.Errorf("Expected the slot of the expired lease to be taken by d")
+			}
+		})
+	}
+}
+
+func TestStateAndList(t *testing.T) {
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			take(t, b.store, "ip:10.0.0.4", config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute})
+			take(t, b.store, "ip:10.0.0.4", config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute})
+			take(t, b.store, "ip:10.0.0.4", config.LimiterConfig{RateLimit: 5, RateWindow: time.Minute, Algorithm: config.AlgorithmSlidingWindowLog})
+			take(t, b.store, "token:abc", config.LimiterConfig{RefillRate: 1, Burst: 5, Algorithm: config.AlgorithmTokenBucket})
+			if err := b.store.Block(ctx, "token:blocked", time.Minute); err != nil {
+				t.Fatalf("Error blocking: %v", err)
+			}
+
+			state, err := b.store.State(ctx, "ip:10.0.0.4")
+			if err != nil {
+				t.Fatalf("Error getting state: %v", err)
+			}
+			if state.Counters[config.AlgorithmFixedWindow] != 2 || state.Counters[config.AlgorithmSlidingWindowLog] != 1 {
+				t.Errorf("Expected 2 fixed window and 1 sliding log requests, got %v", state.Counters)
+			}
+			if state.BlockedFor != 0 {
+				t.Errorf("Expected ip:10.0.0.4 not to be blocked, got %v", state.BlockedFor)
+			}
+
+			states, err := b.store.List(ctx)
+			if err != nil {
+				t.Fatalf("Error listing: %v", err)
+			}
+			byKey := make(map[string]storage.KeyState)
+			for _, state := range states {
+				byKey[state.Key] = state
+			}
+			if len(byKey) != 3 {
+				t.Errorf("Expected 3 keys, got %v", states)
+			}
+			if byKey["token:abc"].Counters[config.AlgorithmTokenBucket] != 4 {
+				t.Errorf("Expected 4 tokens left for token:abc, got %v", byKey["token:abc"].Counters)
+			}
+			if blockedFor := byKey["token:blocked"].BlockedFor; blockedFor <= 0 || blockedFor > time.Minute {
+				t.Errorf("Expected token:blocked to be blocked for up to a minute, got %v", blockedFor)
+			}
+
+			// Blocks reads only the blocked keys
+			blocks, err := b.store.Blocks(ctx)
+			if err != nil {
+				t.Fatalf("Error listing blocks: %v", err)
+			}
+			if len(blocks) != 1 || blocks["token:blocked"] <= 0 || blocks["token:blocked"] > time.Minute {
+				t.Errorf("Expected only token:blocked to be blocked for up to a minute, got %v", blocks)
+			}
+
+			// Unblock removes only the block
+			if err := b.store.Unblock(ctx, "token:blocked"); err != nil {
+				t.Fatalf("Error unblocking: %v", err)
+			}
+			blocked, err := b.store.IsBlocked(ctx, "token:blocked")
+			if err != nil {
+				t.Fatalf("Error checking block: %v", err)
+			}
+			if blocked {
+				t.Errorf("Expected token:blocked to be unblocked")
+			}
+		})
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	for name, b := range newBackends(t) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			for _, entry := range []string{"ip:10.0.0.0/8", "token:abc", "token:abc"} {
+				if err := b.store.AddAccess(ctx, config.AccessListDeny, entry); err != nil {
+					t.Fatalf("Error adding %s: %v", entry, err)
+				}
+			}
+			if err := b.store.AddAccess(ctx, config.AccessListAllow, "ip:192.168.1.1"); err != nil {
+				t.Fatalf("Error adding to the allow list: %v", err)
+			}
+
+			deny, err := b.store.AccessList(ctx, config.AccessListDeny)
+			if err != nil {
+				t.Fatalf("Error listing: %v", err)
+			}
+			if len(deny) != 2 || deny[0] != "ip:10.0.0.0/8" || deny[1] != "token:abc" {
+				t.Errorf("Expected the sorted deny list without duplicates, got %v", deny)
+			}
+
+			if err := b.store.RemoveAccess(ctx, config.AccessListDeny, "token:abc"); err != nil {
+				t.Fatalf("Error removing: %v", err)
+			}
+			deny, err = b.store.AccessList(ctx, config.AccessListDeny)
+			if err != nil {
+				t.Fatalf("Error listing: %v", err)
+			}
+			if len(deny) != 1 {
+				t.Errorf("Expected 1 entry left in the deny list, got %v", deny)
+			}
+
+			allow, err := b.store.AccessList(ctx, config.AccessListAllow)
+			if err != nil {
+				t.Fatalf("Error listing: %v", err)
+			}
+			if len(allow) != 1 || allow[0] != "ip:192.168.1.1" {
+				t.Errorf("Expected the allow list to be kept apart, got %v", allow)
+			}
+		})
+	}
+}
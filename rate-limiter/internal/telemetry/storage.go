@@ -0,0 +1,207 @@
+package telemetry
+
+import (
+	"context"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies the storage spans and metrics in OpenTelemetry
+const instrumentationName = "github.com/felipeosantos/goexpert/rate-limiter/internal/telemetry"
+
+// The storage calls are reported through the global OpenTelemetry providers
+var (
+	tracer             = otel.Tracer(instrumentationName)
+	storageDuration, _ = otel.Meter(instrumentationName).Float64Histogram("rate_limiter.storage.duration",
+		metric.WithDescription("Latency of the storage calls by backend and operation"),
+		metric.WithUnit("s"))
+)
+
+// tracedStorage records a span and the latency of every call to a storage
+type tracedStorage struct {
+	storage storage.Storage
+	backend string
+}
+
+// InstrumentStorage wraps a storage, recording a span and the latency of each call
+// under the backend attribute
+func InstrumentStorage(store storage.Storage, backend string) storage.Storage {
+	return &tracedStorage{storage: store, backend: backend}
+}
+
+// traced runs a storage call in a span of its own, key is the key the call is about,
+// empty when it is about every key
+func traced[T any](ctx context.Context, s *tracedStorage, operation, key string, fn func(context.Context) (T, error)) (T, error) {
+	attributes := []attribute.KeyValue{
+		attribute.String("rate_limiter.storage.backend", s.backend),
+		attribute.String("rate_limiter.storage.operation", operation),
+	}
+
+	ctx, span := tracer.Start(ctx, "storage."+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attributes...),
+	)
+	defer span.End()
+	if policy, keyType, ok := limiter.ParseKey(key); ok {
+		span.SetAttributes(
+			attribute.String("rate_limiter.key_type", keyType),
+			attribute.String("rate_limiter.policy", policy),
+		)
+	}
+
+	start := time.Now()
+	value, err := fn(ctx)
+	storageDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(attributes...))
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return value, err
+}
+
+// Get returns the current count for a key
+func (s *tracedStorage) Get(ctx context.Context, key string) (int, error) {
+	return traced(ctx, s, "get", key, func(ctx context.Context) (int, error) {
+		return s.storage.Get(ctx, key)
+	})
+}
+
+// Increment increments the counter for a key and returns the new value
+func (s *tracedStorage) Increment(ctx context.Context, key string, expiration time.Duration) (int, error) {
+	return traced(ctx, s, "increment", key, func(ctx context.Context) (int, error) {
+		return s.storage.Increment(ctx, key, expiration)
+	})
+}
+
+// IncrementBy adds n to the counter for a key and returns the new value
+func (s *tracedStorage) IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error) {
+	return traced(ctx, s, "increment_by", key, func(ctx context.Context) (int, error) {
+		return s.storage.IncrementBy(ctx, key, n, expiration)
+	})
+}
+
+// Take checks the blocks, registers the request and blocks the keys when the limit is exceeded
+func (s *tracedStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	return traced(ctx, s, "take", key, func(ctx context.Context) (storage.Result, error) {
+		result, err := s.storage.Take(ctx, key, cost, limiterConfig, linked...)
+		if err == nil {
+			decision := limiter.OutcomeDenied
+			if result.Allowed {
+				decision = limiter.OutcomeAllowed
+			}
+			trace.SpanFromContext(ctx).SetAttributes(
+				attribute.String("rate_limiter.decision", decision),
+				attribute.Bool("rate_limiter.blocked", result.Blocked),
+				attribute.Int("rate_limiter.cost", cost),
+			)
+		}
+		return result, err
+	})
+}
+
+// Acquire takes a concurrency slot of a key for the lease, or renews the lease
+func (s *tracedStorage) Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error) {
+	return traced(ctx, s, "acquire", key, func(ctx context.Context) (bool, error) {
+		acquired, err := s.storage.Acquire(ctx, key, id, limit, lease)
+		if err == nil {
+			trace.SpanFromContext(ctx).SetAttributes(attribute.Bool("rate_limiter.acquired", acquired))
+		}
+		return acquired, err
+	})
+}
+
+// Release frees the concurrency slot held by a lease
+func (s *tracedStorage) Release(ctx context.Context, key, id string) error {
+	_, err := traced(ctx, s, "release", key, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.storage.Release(ctx, key, id)
+	})
+	return err
+}
+
+// Reset resets the counter for a key
+func (s *tracedStorage) Reset(ctx context.Context, key string) error {
+	_, err := traced(ctx, s, "reset", key, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.storage.Reset(ctx, key)
+	})
+	return err
+}
+
+// IsBlocked checks if a key is in the blocklist
+func (s *tracedStorage) IsBlocked(ctx context.Context, key string) (bool, error) {
+	return traced(ctx, s, "is_blocked", key, func(ctx context.Context) (bool, error) {
+		return s.storage.IsBlocked(ctx, key)
+	})
+}
+
+// Block adds a key to the blocklist with the given expiration
+func (s *tracedStorage) Block(ctx context.Context, key string, expiration time.Duration) error {
+	_, err := traced(ctx, s, "block", key, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.storage.Block(ctx, key, expiration)
+	})
+	return err
+}
+
+// Unblock removes a key from the blocklist
+func (s *tracedStorage) Unblock(ctx context.Context, key string) error {
+	_, err := traced(ctx, s, "unblock", key, func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.storage.Unblock(ctx, key)
+	})
+	return err
+}
+
+// State returns the counters and the block of a key
+func (s *tracedStorage) State(ctx context.Context, key string) (storage.KeyState, error) {
+	return traced(ctx, s, "state", key, func(ctx context.Context) (storage.KeyState, error) {
+		return s.storage.State(ctx, key)
+	})
+}
+
+// List returns the state of every key with counters or blocks
+func (s *tracedStorage) List(ctx context.Context) ([]storage.KeyState, error) {
+	return traced(ctx, s, "list", "", func(ctx context.Context) ([]storage.KeyState, error) {
+		return s.storage.List(ctx)
+	})
+}
+
+// Blocks returns how long each blocked key stays blocked
+func (s *tracedStorage) Blocks(ctx context.Context) (map[string]time.Duration, error) {
+	return traced(ctx, s, "blocks", "", func(ctx context.Context) (map[string]time.Duration, error) {
+		return s.storage.Blocks(ctx)
+	})
+}
+
+// AccessList returns the sorted entries of an access list
+func (s *tracedStorage) AccessList(ctx context.Context, list string) ([]string, error) {
+	return traced(ctx, s, "access_list", "", func(ctx context.Context) ([]string, error) {
+		return s.storage.AccessList(ctx, list)
+	})
+}
+
+// AddAccess adds an entry to an access list
+func (s *tracedStorage) AddAccess(ctx context.Context, list, entry string) error {
+	_, err := traced(ctx, s, "add_access", "", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.storage.AddAccess(ctx, list, entry)
+	})
+	return err
+}
+
+// RemoveAccess removes an entry from an access list
+func (s *tracedStorage) RemoveAccess(ctx context.Context, list, entry string) error {
+	_, err := traced(ctx, s, "remove_access", "", func(ctx context.Context) (struct{}, error) {
+		return struct{}{}, s.storage.RemoveAccess(ctx, list, entry)
+	})
+	return err
+}
+
+// Close closes the storage
+func (s *tracedStorage) Close() error {
+	return s.storage.Close()
+}
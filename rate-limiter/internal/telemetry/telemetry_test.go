@@ -0,0 +1,129 @@
+package telemetry_test
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/telemetry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// attributeValue returns the value of an attribute of a span, empty when it is not set
+func attributeValue(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestTelemetry(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tracerProvider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	reader := sdkmetric.NewManualReader()
+	meterProvider := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	otel.SetTracerProvider(tracerProvider)
+	otel.SetMeterProvider(meterProvider)
+
+	limiterConfig := config.LimiterConfig{RateLimit: 1, RateWindow: time.Minute, BlockDuration: time.Minute}
+	store := telemetry.InstrumentStorage(storage.NewMemoryStorage(config.StorageConfig{}), "memory")
+	rl := limiter.New(store, limiter.Config{
+		IP:    limiterConfig,
+		Route: map[string]config.RouteConfig{"login": {Pattern: "/login", LimiterConfig: limiterConfig}},
+	})
+	defer rl.Close()
+
+	t.Run("Traces the checks and the storage calls", func(t *testing.T) {
+		ctx := context.Background()
+		rl.Allow(ctx, "192.168.1.1", "")
+		rl.Allow(ctx, "192.168.1.1", "")
+		rl.AllowRoute(ctx, http.MethodPost, "/login", "192.168.1.2", "abc")
+
+		spans := recorder.Ended()
+		if len(spans) != 6 {
+			t.Fatalf("Expected 6 spans, got %d", len(spans))
+		}
+
+		tests := []struct {
+			name     string
+			decision string
+			keyType  string
+			policy   string
+		}{
+			{name: "storage.take", decision: limiter.OutcomeAllowed, keyType: "ip", policy: limiter.DefaultPolicy},
+			{name: "limiter.Allow", decision: limiter.OutcomeAllowed, keyType: "ip", policy: limiter.DefaultPolicy},
+			{name: "storage.take", decision: limiter.OutcomeDenied, keyType: "ip", policy: limiter.DefaultPolicy},
+			{name: "limiter.Allow", decision: limiter.OutcomeDenied, keyType: "ip", policy: limiter.DefaultPolicy},
+			{name: "storage.take", decision: limiter.OutcomeAllowed, keyType: "token", policy: "login"},
+			{name: "limiter.Allow", decision: limiter.OutcomeAllowed, keyType: "token", policy: "login"},
+		}
+		for i, tt := range tests {
+			span := spans[i]
+			if span.Name() != tt.name {
+				t.Errorf("Span %d: expected name %s, got %s", i, tt.name, span.Name())
+			}
+			if got := attributeValue(span, "rate_limiter.decision"); got != tt.decision {
+				t.Errorf("Span %d: expected decision %s, got %s", i, tt.decision, got)
+			}
+			if got := attributeValue(span, "rate_limiter.key_type"); got != tt.keyType {
+				t.Errorf("Span %d: expected key type %s, got %s", i, tt.keyType, got)
+			}
+			if got := attributeValue(span, "rate_limiter.policy"); got != tt.policy {
+				t.Errorf("Span %d: expected policy %s, got %s", i, tt.policy, got)
+			}
+		}
+
+		// The storage spans are children of the check spans
+		for i := 0; i < len(spans); i += 2 {
+			if spans[i].Parent().SpanID() != spans[i+1].SpanContext().SpanID() {
+				t.Errorf("Span %d should be a child of span %d", i, i+1)
+			}
+		}
+		if got := attributeValue(spans[0], "rate_limiter.storage.backend"); got != "memory" {
+			t.Errorf("Expected backend memory, got %s", got)
+		}
+		if got := attributeValue(spans[5], "http.route"); got != "/login" {
+			t.Errorf("Expected route /login, got %s", got)
+		}
+	})
+
+	t.Run("Records the decisions and the storage latency", func(t *testing.T) {
+		var data metricdata.ResourceMetrics
+		if err := reader.Collect(context.Background(), &data); err != nil {
+			t.Fatalf("Error collecting metrics: %v", err)
+		}
+
+		var names []string
+		for _, scope := range data.ScopeMetrics {
+			for _, m := range scope.Metrics {
+				names = append(names, m.Name)
+				if sum, ok := m.Data.(metricdata.Sum[int64]); ok && m.Name == "rate_limiter.decisions" {
+					var total int64
+					for _, point := range sum.DataPoints {
+						total += point.Value
+					}
+					if total != 3 {
+						t.Errorf("Expected 3 decisions, got %d", total)
+					}
+				}
+			}
+		}
+		for _, name := range []string{"rate_limiter.decisions", "rate_limiter.storage.duration"} {
+			if !slices.Contains(names, name) {
+				t.Errorf("Expected metric %s, got %v", name, names)
+			}
+		}
+	})
+}
@@ -0,0 +1,257 @@
+package tokens
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshInterval is how often Lookup checks whether the file was changed by another process
+const refreshInterval = time.Second
+
+// FileStore is a token registry kept in a JSON file. The server reads it and
+// notices the changes made by the CLI, so keys are created, rotated and revoked
+// without restarting the server. The changes are detected by the content of the
+// file, and the processes changing it take turns through a lock file beside it.
+type FileStore struct {
+	path string
+
+	mu        sync.RWMutex
+	byHash    map[string]Token
+	sum       [sha256.Size]byte
+	checkedAt time.Time
+}
+
+// fileContent is the layout of the registry file
+type fileContent struct {
+	Tokens []Token `json:"tokens"`
+}
+
+// NewFileStore opens the registry kept in path, a missing file is an empty registry
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{path: path}
+	if err := s.refresh(true); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Lookup returns the token of an API key, failing with ErrNotFound, ErrExpired
+// or ErrRevoked when the key can't be used
+func (s *FileStore) Lookup(ctx context.Context, key string) (Token, error) {
+	if err := s.refresh(false); err != nil {
+		return Token{}, err
+	}
+
+	s.mu.RLock()
+	token, found := s.byHash[HashKey(key)]
+	s.mu.RUnlock()
+
+	if !found {
+		return Token{}, ErrNotFound
+	}
+	if err := token.Check(time.Now()); err != nil {
+		return Token{}, err
+	}
+	return token, nil
+}
+
+// List returns the tokens of the registry ordered by creation
+func (s *FileStore) List() ([]Token, error) {
+	content, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return content.Tokens, nil
+}
+
+// Create adds a token and returns it along with its API key, which is not stored
+// and can't be recovered. A zero expiresAt creates a key that never expires.
+func (s *FileStore) Create(owner, plan string, expiresAt time.Time) (Token, string, error) {
+	key := newKey()
+	token := Token{
+		ID:        newID(),
+		Hash:      HashKey(key),
+		Owner:     owner,
+		Plan:      plan,
+		Enabled:   true,
+		CreatedAt: time.Now().UTC().Truncate(time.Second),
+		ExpiresAt: expiresAt,
+	}
+
+	err := s.update(func(content *fileContent) error {
+		content.Tokens = append(content.Tokens, token)
+		return nil
+	})
+	if err != nil {
+		return Token{}, "", err
+	}
+	return token, key, nil
+}
+
+// Rotate replaces the API key of a token, the previous key stops being accepted
+// while the counters of the token are kept
+func (s *FileStore) Rotate(id string) (Token, string, error) {
+	key := newKey()
+	var token Token
+	err := s.update(func(content *fileContent) error {
+		i := slices.IndexFunc(content.Tokens, func(t Token) bool { return t.ID == id })
+		if i < 0 {
+			return fmt.Errorf("token %s: %w", id, ErrNotFound)
+		}
+		content.Tokens[i].Hash = HashKey(key)
+		token = content.Tokens[i]
+		return nil
+	})
+	if err != nil {
+		return Token{}, "", err
+	}
+	return token, key, nil
+}
+
+// Revoke disables a token, its API key stops being accepted
+func (s *FileStore) Revoke(id string) (Token, error) {
+	var token Token
+	err := s.update(func(content *fileContent) error {
+		i := slices.IndexFunc(content.Tokens, func(t Token) bool { return t.ID == id })
+		if i < 0 {
+			return fmt.Errorf("token %s: %w", id, ErrNotFound)
+		}
+		content.Tokens[i].Enabled = false
+		token = content.Tokens[i]
+		return nil
+	})
+	return token, err
+}
+
+// refresh reloads the tokens when the file changed since it was last read,
+// checking the file at most once per refreshInterval unless forced
+func (s *FileStore) refresh(force bool) error {
+	now := time.Now()
+	s.mu.RLock()
+	due := force || now.Sub(s.checkedAt) >= refreshInterval
+	s.mu.RUnlock()
+	if !due {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !force && now.Sub(s.checkedAt) < refreshInterval {
+		return nil
+	}
+	s.checkedAt = now
+
+	data, err := s.readFile()
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if !force && sum == s.sum {
+		return nil
+	}
+
+	// A file that can't be parsed, such as one edited by hand, keeps the tokens read before
+	content, err := s.parse(data)
+	if err != nil && s.byHash != nil {
+		log.Printf("Keeping the tokens read before: %v", err)
+		s.sum = sum
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	byHash := make(map[string]Token, len(content.Tokens))
+	for _, token := range content.Tokens {
+		byHash[token.Hash] = token
+	}
+	s.byHash, s.sum = byHash, sum
+	return nil
+}
+
+// read reads the registry file, a missing file is an empty registry
+func (s *FileStore) read() (fileContent, error) {
+	data, err := s.readFile()
+	if err != nil {
+		return fileContent{}, err
+	}
+	return s.parse(data)
+}
+
+// readFile returns the content of the registry file, empty when it is missing
+func (s *FileStore) readFile() ([]byte, error) {
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// parse decodes the content of the registry file, empty content is an empty registry
+func (s *FileStore) parse(data []byte) (fileContent, error) {
+	var content fileContent
+	if len(data) == 0 {
+		return content, nil
+	}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return content, fmt.Errorf("reading token registry %s: %w", s.path, err)
+	}
+	return content, nil
+}
+
+// update applies a change to the registry file, replacing it atomically so the
+// server never reads a partially written file. The lock file keeps the processes
+// changing the registry at the same time from losing each other's changes.
+func (s *FileStore) update(change func(content *fileContent) error) error {
+	unlock, err := lockFile(s.path + ".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	content, err := s.read()
+	if err != nil {
+		return err
+	}
+	if err := change(&content); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), "."+strings.TrimPrefix(filepath.Base(s.path), ".")+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return err
+	}
+
+	return s.refresh(true)
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package tokens
+
+// lockFile does not lock on the platforms without flock, where the registry must
+// be changed by one process at a time
+func lockFile(path string) (func(), error) {
+	return func() {}, nil
+}
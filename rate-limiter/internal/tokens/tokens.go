@@ -0,0 +1,72 @@
+package tokens
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// KeyPrefix starts every API key, making leaked keys easy to spot
+const KeyPrefix = "rl_"
+
+var (
+	ErrNotFound = errors.New("API key not found")
+	ErrExpired  = errors.New("API key expired")
+	ErrRevoked  = errors.New("API key revoked")
+)
+
+// Token is an API key of the registry, only the hash of the key is kept
+type Token struct {
+	// ID identifies the token in the counters, the admin API and the CLI, it is kept when the key is rotated
+	ID string `json:"id"`
+	// Hash is the hex encoded SHA-256 of the API key
+	Hash string `json:"hash"`
+	// Owner is who the key was issued to
+	Owner string `json:"owner"`
+	// Plan is the rate limit plan of the key, configured as PLAN.<plan>.*
+	Plan string `json:"plan"`
+	// Enabled is false once the key is revoked
+	Enabled bool `json:"enabled"`
+	// CreatedAt is when the token was created
+	CreatedAt time.Time `json:"created_at"`
+	// ExpiresAt is when the key stops being accepted, zero when it never expires
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+}
+
+// Check returns why the key can't be used at now, or nil when it is valid
+func (t Token) Check(now time.Time) error {
+	if !t.Enabled {
+		return ErrRevoked
+	}
+	if !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt) {
+		return ErrExpired
+	}
+	return nil
+}
+
+// HashKey returns the hash under which an API key is stored
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newKey generates a random API key
+func newKey() string {
+	return KeyPrefix + base64.RawURLEncoding.EncodeToString(randomBytes(24))
+}
+
+// newID generates a random token ID
+func newID() string {
+	return hex.EncodeToString(randomBytes(8))
+}
+
+// randomBytes returns n bytes from the cryptographic random generator
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	// crypto/rand.Read never returns an error, it crashes the program instead
+	rand.Read(b)
+	return b
+}
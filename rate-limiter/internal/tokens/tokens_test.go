@@ -0,0 +1,186 @@
+package tokens_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+)
+
+func TestFileStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	store, err := tokens.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("Error opening token registry: %v", err)
+	}
+
+	token, key, err := store.Create("acme", "pro", time.Time{})
+	if err != nil {
+		t.Fatalf("Error creating token: %v", err)
+	}
+	if !strings.HasPrefix(key, tokens.KeyPrefix) || token.Hash != tokens.HashKey(key) {
+		t.Errorf("Expected a %s key stored by its hash, got key %q and hash %q", tokens.KeyPrefix, key, token.Hash)
+	}
+
+	t.Run("Lookup", func(t *testing.T) {
+		found, err := store.Lookup(context.Background(), key)
+		if err != nil {
+			t.Fatalf("Error looking up key: %v", err)
+		}
+		if found.ID != token.ID || found.Owner != "acme" || found.Plan != "pro" {
+			t.Errorf("Expected token %+v, got %+v", token, found)
+		}
+
+		if _, err := store.Lookup(context.Background(), "rl_unknown"); !errors.Is(err, tokens.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for an unknown key, got %v", err)
+		}
+	})
+
+	t.Run("Key is not stored", func(t *testing.T) {
+		list, err := store.List()
+		if err != nil {
+			t.Fatalf("Error listing tokens: %v", err)
+		}
+		for _, listed := range list {
+			if strings.Contains(listed.Hash, key) || strings.Contains(listed.ID, key) {
+				t.Errorf("Expected the key not to be stored, got %+v", listed)
+			}
+		}
+	})
+
+	t.Run("Rotate", func(t *testing.T) {
+		rotated, newKey, err := store.Rotate(token.ID)
+		if err != nil {
+			t.Fatalf("Error rotating token: %v", err)
+		}
+		if rotated.ID != token.ID || newKey == key {
+			t.Errorf("Expected a new key for token %s, got %+v", token.ID, rotated)
+		}
+
+		if _, err := store.Lookup(context.Background(), key); !errors.Is(err, tokens.ErrNotFound) {
+			t.Errorf("Expected the previous key to be rejected, got %v", err)
+		}
+		if _, err := store.Lookup(context.Background(), newKey); err != nil {
+			t.Errorf("Expected the new key to be accepted, got %v", err)
+		}
+		key = newKey
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		if _, err := store.Revoke(token.ID); err != nil {
+			t.Fatalf("Error revoking token: %v", err)
+		}
+		if _, err := store.Lookup(context.Background(), key); !errors.Is(err, tokens.ErrRevoked) {
+			t.Errorf("Expected ErrRevoked, got %v", err)
+		}
+		if _, err := store.Revoke("unknown"); !errors.Is(err, tokens.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for an unknown token, got %v", err)
+		}
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		_, expiredKey, err := store.Create("acme", "pro", time.Now().Add(-time.Minute))
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+		if _, err := store.Lookup(context.Background(), expiredKey); !errors.Is(err, tokens.ErrExpired) {
+			t.Errorf("Expected ErrExpired, got %v", err)
+		}
+	})
+
+	t.Run("Changes from another process", func(t *testing.T) {
+		// The CLI writes the file through its own store
+		cli, err := tokens.NewFileStore(path)
+		if err != nil {
+			t.Fatalf("Error opening token registry: %v", err)
+		}
+		_, cliKey, err := cli.Create("globex", "basic", time.Time{})
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+
+		// The change is noticed once the refresh interval elapses
+		time.Sleep(1100 * time.Millisecond)
+		if _, err := store.Lookup(context.Background(), cliKey); err != nil {
+			t.Errorf("Expected the key created by another store to be accepted, got %v", err)
+		}
+	})
+
+	t.Run("Rotation from another process", func(t *testing.T) {
+		rotated, rotatedKey, err := store.Create("initech", "basic", time.Time{})
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+
+		// Rotating writes a file of the same size, possibly within the same mtime tick
+		cli, err := tokens.NewFileStore(path)
+		if err != nil {
+			t.Fatalf("Error opening token registry: %v", err)
+		}
+		if _, _, err := cli.Rotate(rotated.ID); err != nil {
+			t.Fatalf("Error rotating token: %v", err)
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		if _, err := store.Lookup(context.Background(), rotatedKey); !errors.Is(err, tokens.ErrNotFound) {
+			t.Errorf("Expected the key rotated by another store to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("Corrupt file keeps the tokens read before", func(t *testing.T) {
+		_, kept, err := store.Create("umbrella", "basic", time.Time{})
+		if err != nil {
+			t.Fatalf("Error creating token: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(`{"tokens": [`), 0o600); err != nil {
+			t.Fatalf("Error writing token registry: %v", err)
+		}
+
+		time.Sleep(1100 * time.Millisecond)
+		if _, err := store.Lookup(context.Background(), kept); err != nil {
+			t.Errorf("Expected the key read before to be accepted, got %v", err)
+		}
+	})
+}
+
+func TestFileStoreConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+
+	// Each store stands for a CLI invocation of its own
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store, err := tokens.NewFileStore(path)
+			if err != nil {
+				t.Errorf("Error opening token registry: %v", err)
+				return
+			}
+			if _, _, err := store.Create(fmt.Sprint("owner", i), "basic", time.Time{}); err != nil {
+				t.Errorf("Error creating token: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	store, err := tokens.NewFileStore(path)
+	if err != nil {
+		t.Fatalf("Error opening token registry: %v", err)
+	}
+	list, err := store.List()
+	if err != nil {
+		t.Fatalf("Error listing tokens: %v", err)
+	}
+	if len(list) != 10 {
+		t.Errorf("Expected every token created concurrently, got %d", len(list))
+	}
+}
@@ -0,0 +1,110 @@
+package ratelimit
+
+// options collects the settings of New
+type options struct {
+	storage       Storage
+	config        Config
+	tokenStore    TokenStore
+	metrics       Metrics
+	keyFunc       KeyFunc
+	deniedHandler DeniedHandler
+	errorHandler  ErrorHandler
+}
+
+// Option configures a Limiter
+type Option func(*options)
+
+// WithStorage keeps the counters, the blocks and the access lists in store, such as
+// a Redis storage shared by every instance of the service
+func WithStorage(store Storage) Option {
+	return func(o *options) {
+		o.storage = store
+	}
+}
+
+// WithPolicy sets the default policy, limiting each IP and the tokens without a policy
+// of their own
+func WithPolicy(policy Policy) Option {
+	return func(o *options) {
+		o.config.IP = policy
+	}
+}
+
+// WithTokenPolicy limits a token by its own policy instead of the default one
+func WithTokenPolicy(token string, policy Policy) Option {
+	return func(o *options) {
+		if o.config.Token == nil {
+			o.config.Token = make(map[string]Policy)
+		}
+		o.config.Token[token] = policy
+	}
+}
+
+// WithRoutePolicy limits the requests to a route by a policy of its own, the name
+// identifying its counters and blocks
+func WithRoutePolicy(name string, policy RoutePolicy) Option {
+	return func(o *options) {
+		if o.config.Route == nil {
+			o.config.Route = make(map[string]RoutePolicy)
+		}
+		o.config.Route[name] = policy
+	}
+}
+
+// WithRouteCost counts the requests to a route as more than one request, the name
+// identifying the cost in the configuration
+func WithRouteCost(name string, cost RouteCost) Option {
+	return func(o *options) {
+		if o.config.RouteCost == nil {
+			o.config.RouteCost = make(map[string]RouteCost)
+		}
+		o.config.RouteCost[name] = cost
+	}
+}
+
+// WithConfig replaces every policy, the access lists and the failure mode, including
+// the ones set by the options before it
+func WithConfig(cfg Config) Option {
+	return func(o *options) {
+		o.config = cfg
+	}
+}
+
+// WithTokenStore resolves the API keys through a token registry, limiting each key by
+// the policy of its plan and rejecting the keys the registry does not accept
+func WithTokenStore(store TokenStore) Option {
+	return func(o *options) {
+		o.tokenStore = store
+	}
+}
+
+// WithMetrics records the decisions of the limiter and the responses of the middleware
+func WithMetrics(metrics Metrics) Option {
+	return func(o *options) {
+		o.metrics = metrics
+	}
+}
+
+// WithKeyFunc sets how the key of a request is extracted, ClientKey without trusted
+// proxies by default
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(o *options) {
+		o.keyFunc = keyFunc
+	}
+}
+
+// WithDeniedHandler sets how the requests rejected by a limit are answered, with
+// 429 Too Many Requests and the Retry-After header by default
+func WithDeniedHandler(handler DeniedHandler) Option {
+	return func(o *options) {
+		o.deniedHandler = handler
+	}
+}
+
+// WithErrorHandler sets how the requests the limiter failed to check are answered,
+// with 401, 403, 503 or 500 by default
+func WithErrorHandler(handler ErrorHandler) Option {
+	return func(o *options) {
+		o.errorHandler = handler
+	}
+}
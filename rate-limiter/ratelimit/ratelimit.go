@@ -0,0 +1,468 @@
+// Package ratelimit limits the requests of HTTP services by client IP and API key,
+// with the storages, algorithms, policies and access lists of the rate limiter server.
+//
+//	rl, err := ratelimit.New(
+//		ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 10, RateWindow: time.Second}),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	r.Use(rl.Middleware)
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/middleware"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+const (
+	// APIKeyHeader is the header the API key is read from by ClientKey
+	APIKeyHeader = middleware.APIKeyHeader
+	// CostHeader is the response header a handler without access to the request context
+	// may report the cost of a request in, removed by the middleware before it is sent
+	CostHeader = middleware.CostHeader
+)
+
+var (
+	// ErrNoPolicy is returned by New when no default policy was given
+	ErrNoPolicy = errors.New("a default policy with a positive limit is required")
+
+	ErrInvalidToken       = limiter.ErrInvalidToken
+	ErrStorageUnavailable = limiter.ErrStorageUnavailable
+	ErrDenied             = limiter.ErrDenied
+	ErrLeaseLost          = limiter.ErrLeaseLost
+	ErrUnknownAlgorithm   = limiter.ErrUnknownAlgorithm
+	ErrStorageNotFound    = storage.ErrStorageNotFound
+)
+
+type (
+	// Policy is the limit, the algorithm, the block duration and the quotas of a key
+	Policy = config.LimiterConfig
+	// RoutePolicy is a policy limiting the requests to a route independently of the other routes
+	RoutePolicy = config.RouteConfig
+	// RouteCost is the number of requests a request to a route is counted as
+	RouteCost = config.RouteCostConfig
+)
+
+// Config holds every policy of the limiter, the access lists and the failure mode
+type Config struct {
+	// IP is the default policy, limiting each IP and the tokens without a policy of their own
+	IP Policy
+	// Token maps the tokens to their policies
+	Token map[string]Policy
+	// Route maps the route policy names to their policies
+	Route map[string]RoutePolicy
+	// RouteCost maps names to the costs of the requests to routes, which otherwise cost 1
+	RouteCost map[string]RouteCost
+	// Plan maps the plans of the token registry to their policies
+	Plan map[string]Policy
+	// FailureMode decides the requests the storage fails to check, config.FailureModeClosed
+	// rejects them with ErrStorageUnavailable and config.FailureModeOpen allows them
+	FailureMode string
+	// Location is the time zone the quota periods start in, UTC when nil
+	Location *time.Location
+	// Access lists the IPs, CIDR ranges and tokens exempted from the limits or always
+	// rejected, besides the access lists of the storage
+	Access config.AccessConfig
+}
+
+// Validate checks that the policies and the access lists can be applied
+func (c Config) Validate() error {
+	return c.limiterConfig().Validate()
+}
+
+// limiterConfig returns the configuration as the limiter reads it
+func (c Config) limiterConfig() limiter.Config {
+	return limiter.Config{
+		IP:          c.IP,
+		Token:       c.Token,
+		Route:       c.Route,
+		RouteCost:   c.RouteCost,
+		Plan:        c.Plan,
+		FailureMode: c.FailureMode,
+		Location:    c.Location,
+		Access:      c.Access,
+	}
+}
+
+// Decision is the outcome of a rate limit check
+type Decision struct {
+	// Allowed reports whether the request may proceed
+	Allowed bool
+	// Policy is the policy applied to the request, "ip" or "token"
+	Policy string
+	// Route is the name of the route policy applied to the request, empty when none matched
+	Route string
+	// Quota is the calendar period of the quota described by the decision, empty for the rate limit
+	Quota string
+	// Access is config.AccessListAllow when the allow list exempted the request from the
+	// limits, leaving the other fields unset
+	Access string
+	// Key is the key that decided the request, the blocked key when a block rejected it
+	Key string
+	// Limit is how many requests the policy allows in Window
+	Limit int
+	// Window is the period of the policy
+	Window time.Duration
+	// Remaining is how many requests are still allowed
+	Remaining int
+	// ResetAt is when the limit is fully restored
+	ResetAt time.Time
+	// BlockedUntil is when a rejected request may be retried, the block expiry when the key is blocked
+	BlockedUntil time.Time
+	// Degraded reports that the storage failed and the request was allowed without being counted
+	Degraded bool
+	// DryRun reports that the policy is in dry run, so the request was allowed and only
+	// Shadow describes the policy
+	DryRun bool
+	// Shadow is the decision of the dry run or shadow policy evaluated for the request,
+	// nil when there is none or the storage failed to check it
+	Shadow *Decision
+	// Concurrency reports that the decision is about the concurrency limit of the policy,
+	// Limit being how many requests may be in flight at once
+	Concurrency bool
+	// Queued reports that the request waited for a concurrency slot until the queue timeout
+	Queued bool
+	// Cost is how many requests the request counted as in the limit and the quotas
+	Cost int
+}
+
+// newDecision returns a decision of the limiter as a Decision
+func newDecision(decision limiter.Decision) Decision {
+	var shadow *Decision
+	if decision.Shadow != nil {
+		converted := newDecision(*decision.Shadow)
+		shadow = &converted
+	}
+	return Decision{
+		Allowed:      decision.Allowed,
+		Policy:       decision.Policy,
+		Route:        decision.Route,
+		Quota:        decision.Quota,
+		Access:       decision.Access,
+		Key:          decision.Key,
+		Limit:        decision.Limit,
+		Window:       decision.Window,
+		Remaining:    decision.Remaining,
+		ResetAt:      decision.ResetAt,
+		BlockedUntil: decision.BlockedUntil,
+		Degraded:     decision.Degraded,
+		DryRun:       decision.DryRun,
+		Shadow:       shadow,
+		Concurrency:  decision.Concurrency,
+		Queued:       decision.Queued,
+		Cost:         decision.Cost,
+	}
+}
+
+// limiterDecision returns the decision as the limiter made it
+func (d Decision) limiterDecision() limiter.Decision {
+	var shadow *limiter.Decision
+	if d.Shadow != nil {
+		converted := d.Shadow.limiterDecision()
+		shadow = &converted
+	}
+	return limiter.Decision{
+		Allowed:      d.Allowed,
+		Policy:       d.Policy,
+		Route:        d.Route,
+		Quota:        d.Quota,
+		Access:       d.Access,
+		Key:          d.Key,
+		Limit:        d.Limit,
+		Window:       d.Window,
+		Remaining:    d.Remaining,
+		ResetAt:      d.ResetAt,
+		BlockedUntil: d.BlockedUntil,
+		Degraded:     d.Degraded,
+		DryRun:       d.DryRun,
+		Shadow:       shadow,
+		Concurrency:  d.Concurrency,
+		Queued:       d.Queued,
+		Cost:         d.Cost,
+	}
+}
+
+// QuotaUsage describes the usage of a quota in the current calendar period
+type QuotaUsage struct {
+	// Period is the calendar period of the quota, one of config.QuotaPeriods
+	Period string
+	// Limit is how many requests the quota allows in the period
+	Limit int
+	// Used is how many requests were counted in the period, up to Limit
+	Used int
+	// Remaining is how many requests are still allowed in the period
+	Remaining int
+	// ResetAt is when the period ends and the quota is restored
+	ResetAt time.Time
+}
+
+// Lease is the concurrency slot held by an in-flight request until released
+type Lease struct {
+	lease *limiter.Lease
+}
+
+// Context returns a copy of ctx canceled with ErrLeaseLost when the slot is lost, because
+// it expired before being renewed and other requests took every slot. The stop function
+// must be called once the request is served.
+func (l *Lease) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if l == nil {
+		return context.WithCancel(ctx)
+	}
+	return l.lease.Context(ctx)
+}
+
+// Release frees the slot, it may be called on a nil lease and more than once
+func (l *Lease) Release() {
+	if l != nil {
+		l.lease.Release()
+	}
+}
+
+// ClientIPResolver extracts the client IP from requests, trusting the forwarding
+// headers only when they were set by one of the trusted proxies. The zero value
+// trusts no proxy.
+type ClientIPResolver struct {
+	resolver middleware.ClientIPResolver
+}
+
+// ClientIP returns the IP of the client that sent the request
+func (c *ClientIPResolver) ClientIP(r *http.Request) string {
+	return c.resolver.ClientIP(r)
+}
+
+// Metrics records the decisions of the limiter and the responses of the middleware
+type Metrics interface {
+	// ObserveDecision records a check of an IP or token, keyType "ip" or "token", under
+	// a route policy or "default", by the "rate" or "concurrency" limit, with the outcome
+	// "allowed", "denied" or "errored"
+	ObserveDecision(keyType, policy, limit, outcome string)
+	// ObserveShadowDecision records the decision of a dry run or shadow policy the same
+	// way, "denied" for the requests it would have rejected
+	ObserveShadowDecision(keyType, policy, outcome string)
+	// ObserveResponse records the status code the middleware answered a request of an IP
+	// or token with, http.StatusOK when it was passed on
+	ObserveResponse(keyType string, code int)
+}
+
+// Key identifies the client a request is limited as
+type Key struct {
+	// IP is the client IP, limited by the default policy and blocked along with the
+	// token when the token exceeds its limit
+	IP string
+	// Token is the API key, or any other identifier such as a user ID, limited by its
+	// token policy instead of the IP when not empty
+	Token string
+}
+
+// KeyFunc returns the key a request is limited as
+type KeyFunc func(r *http.Request) Key
+
+// DeniedHandler answers the requests rejected by a limit, after the rate limit headers are set
+type DeniedHandler func(w http.ResponseWriter, r *http.Request, decision Decision)
+
+// ErrorHandler answers the requests the limiter failed to check, with ErrInvalidToken,
+// ErrDenied, ErrStorageUnavailable or an unexpected error
+type ErrorHandler func(w http.ResponseWriter, r *http.Request, err error)
+
+// Limiter limits the requests of an HTTP service
+type Limiter struct {
+	rl         *limiter.RateLimiter
+	middleware func(next http.Handler) http.Handler
+}
+
+// New creates a limiter with the given options, which must include a default policy.
+// Without WithStorage the counters are kept in memory.
+func New(opts ...Option) (*Limiter, error) {
+	o := &options{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if limit, _ := o.config.IP.Quota(); limit <= 0 {
+		return nil, ErrNoPolicy
+	}
+	if err := o.config.Validate(); err != nil {
+		return nil, err
+	}
+	store := storage.Storage(storage.NewMemoryStorage(config.StorageConfig{}))
+	if o.storage != nil {
+		store = toStorage(o.storage)
+	}
+	if o.keyFunc == nil {
+		o.keyFunc = ClientKey(&ClientIPResolver{})
+	}
+
+	rl := limiter.New(store, o.config.limiterConfig())
+	if o.tokenStore != nil {
+		rl.SetTokenStore(toTokenStore(o.tokenStore))
+	}
+	middlewareOptions := middleware.Options{
+		KeyFunc: func(r *http.Request) (string, string) {
+			key := o.keyFunc(r)
+			return key.IP, key.Token
+		},
+		ErrorHandler: o.errorHandler,
+	}
+	if o.deniedHandler != nil {
+		middlewareOptions.DeniedHandler = func(w http.ResponseWriter, r *http.Request, decision limiter.Decision) {
+			o.deniedHandler(w, r, newDecision(decision))
+		}
+	}
+	if o.metrics != nil {
+		rl.SetMetrics(o.metrics)
+		middlewareOptions.Metrics = o.metrics
+	}
+
+	return &Limiter{
+		rl:         rl,
+		middleware: middleware.New(rl, middlewareOptions),
+	}, nil
+}
+
+// Middleware limits the requests before passing them on to next, applying the route
+// policy matching the chi route pattern of the request when there is one
+func (l *Limiter) Middleware(next http.Handler) http.Handler {
+	return l.middleware(next)
+}
+
+// Allow checks a request of an IP or, when not empty, of a token against the default
+// and token policies, counting it when it is allowed
+func (l *Limiter) Allow(ctx context.Context, ip, token string) (Decision, error) {
+	decision, err := l.rl.Allow(ctx, ip, token)
+	return newDecision(decision), err
+}
+
+// AllowRoute checks a request like Allow, applying the route policy matching the method
+// and the chi route pattern when there is one. The request costs the cost of WithCost,
+// the route cost or 1, in this order.
+func (l *Limiter) AllowRoute(ctx context.Context, method, pattern, ip, token string) (Decision, error) {
+	decision, err := l.rl.AllowRoute(ctx, method, pattern, ip, token)
+	return newDecision(decision), err
+}
+
+// AcquireRoute takes a concurrency slot for a request to a route AllowRoute allowed,
+// waiting up to the QueueTimeout of the policy. The lease must be released once the
+// request is served, a request that gets no slot is rejected with a Concurrency decision.
+func (l *Limiter) AcquireRoute(ctx context.Context, method, pattern, ip, token string) (*Lease, Decision, error) {
+	lease, decision, err := l.rl.AcquireRoute(ctx, method, pattern, ip, token)
+	if lease == nil {
+		return nil, newDecision(decision), err
+	}
+	return &Lease{lease: lease}, newDecision(decision), err
+}
+
+// ChargeRoute counts cost more requests for a request to a route AllowRoute already
+// allowed, when the request turns out to cost more than it was checked for
+func (l *Limiter) ChargeRoute(ctx context.Context, method, pattern, ip, token string, cost int) error {
+	return l.rl.ChargeRoute(ctx, method, pattern, ip, token, cost)
+}
+
+// Quotas returns the usage of the quotas of a token, without counting a request
+func (l *Limiter) Quotas(ctx context.Context, token string) ([]QuotaUsage, error) {
+	quotas, err := l.rl.Quotas(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	usages := make([]QuotaUsage, len(quotas))
+	for i, quota := range quotas {
+		usages[i] = QuotaUsage(quota)
+	}
+	return usages, nil
+}
+
+// Config returns the configuration in effect
+func (l *Limiter) Config() Config {
+	cfg := l.rl.Config()
+	return Config{
+		IP:          cfg.IP,
+		Token:       cfg.Token,
+		Route:       cfg.Route,
+		RouteCost:   cfg.RouteCost,
+		Plan:        cfg.Plan,
+		FailureMode: cfg.FailureMode,
+		Location:    cfg.Location,
+		Access:      cfg.Access,
+	}
+}
+
+// SetConfig validates the configuration and replaces the one in effect atomically,
+// requests being checked keep the configuration they started with
+func (l *Limiter) SetConfig(cfg Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	l.rl.SetConfig(cfg.limiterConfig())
+	return nil
+}
+
+// RefreshAccess reads the access lists of the storage again
+func (l *Limiter) RefreshAccess(ctx context.Context) error {
+	return l.rl.RefreshAccess(ctx)
+}
+
+// WatchAccess reads the access lists of the storage and reads them again every interval
+// until the context is done, so the changes made by any instance reach all of them
+func (l *Limiter) WatchAccess(ctx context.Context, interval time.Duration) error {
+	return l.rl.WatchAccess(ctx, interval)
+}
+
+// Close closes the storage
+func (l *Limiter) Close() error {
+	return l.rl.Close()
+}
+
+// ClientKey returns the KeyFunc limiting the requests by the client IP extracted by
+// clientIP and by the API key in the APIKeyHeader header, the default of New
+func ClientKey(clientIP *ClientIPResolver) KeyFunc {
+	return func(r *http.Request) Key {
+		return Key{IP: clientIP.ClientIP(r), Token: r.Header.Get(APIKeyHeader)}
+	}
+}
+
+// NewClientIPResolver creates a client IP resolver trusting the forwarding headers
+// of the proxies in the configuration
+func NewClientIPResolver(cfg config.ClientIPConfig) (*ClientIPResolver, error) {
+	resolver, err := middleware.NewClientIPResolver(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientIPResolver{resolver: *resolver}, nil
+}
+
+// SetRateLimitHeaders describes the limit applied to a request in the X-RateLimit-*
+// and IETF RateLimit headers, as the middleware does before calling the DeniedHandler
+func SetRateLimitHeaders(header http.Header, decision Decision) {
+	middleware.SetRateLimitHeaders(header, decision.limiterDecision())
+}
+
+// RetryAfter returns the Retry-After header value of a rejected request, in whole seconds
+func RetryAfter(decision Decision) string {
+	return middleware.RetryAfter(decision.limiterDecision())
+}
+
+// DeniedStatus returns the status code the default DeniedHandler answers a rejected
+// request with, 503 when it timed out waiting for a concurrency slot and 429 otherwise
+func DeniedStatus(decision Decision) int {
+	return middleware.DeniedStatus(decision.limiterDecision())
+}
+
+// SetCost reports the cost of the request being served by a handler behind the
+// middleware, which counts it when the handler starts writing the response, so it
+// must be called before
+func SetCost(ctx context.Context, cost int) {
+	middleware.SetCost(ctx, cost)
+}
+
+// WithCost returns a context in which the checks of the Limiter count the request
+// as cost requests, instead of the cost of its route
+func WithCost(ctx context.Context, cost int) context.Context {
+	return limiter.WithCost(ctx, cost)
+}
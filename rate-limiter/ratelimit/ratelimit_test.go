@@ -0,0 +1,250 @@
+package ratelimit_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/ratelimit"
+	"github.com/go-chi/chi/v5"
+)
+
+// okHandler answers every request with 200 OK
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+// serve sends a request from remoteAddr with the optional API key through handler
+func serve(handler http.Handler, method, target, remoteAddr, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	req.RemoteAddr = remoteAddr
+	if apiKey != "" {
+		req.Header.Set(ratelimit.APIKeyHeader, apiKey)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+// countingStorage is a storage of another service, counting the requests it takes
+type countingStorage struct {
+	ratelimit.Storage
+	takes int
+}
+
+func (s *countingStorage) Take(ctx context.Context, key string, cost int, policy ratelimit.Policy, linked ...string) (ratelimit.Result, error) {
+	s.takes++
+	return s.Storage.Take(ctx, key, cost, policy, linked...)
+}
+
+// staticTokens is a token registry of another service
+type staticTokens map[string]ratelimit.Token
+
+func (s staticTokens) Lookup(ctx context.Context, key string) (ratelimit.Token, error) {
+	token, found := s[key]
+	if !found {
+		return ratelimit.Token{}, ratelimit.ErrTokenNotFound
+	}
+	return token, nil
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []ratelimit.Option
+		err  error
+	}{
+		{name: "Without a default policy", err: ratelimit.ErrNoPolicy},
+		{
+			name: "Invalid token policy",
+			opts: []ratelimit.Option{
+				ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 1, RateWindow: time.Second}),
+				ratelimit.WithTokenPolicy("abc", ratelimit.Policy{RateLimit: 1, RateWindow: time.Second, Algorithm: "unknown"}),
+			},
+		},
+		{
+			name: "Invalid route policy",
+			opts: []ratelimit.Option{
+				ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 1, RateWindow: time.Second}),
+				ratelimit.WithRoutePolicy("login", ratelimit.RoutePolicy{Pattern: "login"}),
+			},
+		},
+		{
+			name: "Route policies matching the same route",
+			opts: []ratelimit.Option{
+				ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 1, RateWindow: time.Second}),
+				ratelimit.WithRoutePolicy("login", ratelimit.RoutePolicy{Method: "POST", Pattern: "/login", LimiterConfig: ratelimit.Policy{RateLimit: 1, RateWindow: time.Second}}),
+				ratelimit.WithRoutePolicy("signin", ratelimit.RoutePolicy{Method: "POST", Pattern: "/login", LimiterConfig: ratelimit.Policy{RateLimit: 2, RateWindow: time.Second}}),
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ratelimit.New(tt.opts...)
+			if err == nil {
+				t.Fatalf("Expected error")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Expected %v, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	t.Run("Default options", func(t *testing.T) {
+		rl, err := ratelimit.New(
+			ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 1, RateWindow: time.Minute}),
+			ratelimit.WithTokenPolicy("abc", ratelimit.Policy{RateLimit: 2, RateWindow: time.Minute}),
+		)
+		if err != nil {
+			t.Fatalf("Error creating limiter: %v", err)
+		}
+		defer rl.Close()
+		handler := rl.Middleware(okHandler)
+
+		if rr := serve(handler, "GET", "/", "192.168.1.1:1234", ""); rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		rr := serve(handler, "GET", "/", "192.168.1.1:1234", "")
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("Retry-After") == "" {
+			t.Errorf("Expected 429 with Retry-After, got %d %v", rr.Code, rr.Header())
+		}
+
+		// The token has a policy of its own
+		for i := 0; i < 2; i++ {
+			if rr := serve(handler, "GET", "/", "192.168.1.2:1234", "abc"); rr.Code != http.StatusOK {
+				t.Errorf("Request %d with the token: expected 200, got %d", i+1, rr.Code)
+			}
+		}
+	})
+
+	t.Run("Custom key and handlers", func(t *testing.T) {
+		rl, err := ratelimit.New(
+			ratelimit.WithStorage(ratelimit.NewMemoryStorage(config.StorageConfig{})),
+			ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 1, RateWindow: time.Minute}),
+			ratelimit.WithConfig(ratelimit.Config{
+				IP:     ratelimit.Policy{RateLimit: 1, RateWindow: time.Minute},
+				Access: config.AccessConfig{DenyTokens: []string{"banned"}},
+			}),
+			// Limit by user instead of by IP
+			ratelimit.WithKeyFunc(func(r *http.Request) ratelimit.Key {
+				return ratelimit.Key{Token: r.Header.Get("X-User")}
+			}),
+			ratelimit.WithDeniedHandler(func(w http.ResponseWriter, r *http.Request, decision ratelimit.Decision) {
+				w.Header().Set("Retry-After", ratelimit.RetryAfter(decision))
+				http.Error(w, `{"error":"slow down"}`, http.StatusServiceUnavailable)
+			}),
+			ratelimit.WithErrorHandler(func(w http.ResponseWriter, r *http.Request, err error) {
+				if errors.Is(err, ratelimit.ErrDenied) {
+					http.Error(w, "banned", http.StatusNotFound)
+					return
+				}
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}),
+		)
+		if err != nil {
+			t.Fatalf("Error creating limiter: %v", err)
+		}
+		defer rl.Close()
+		handler := rl.Middleware(okHandler)
+
+		// request sends a request of a user, always from the same IP
+		request := func(user string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = "10.0.0.1:1234"
+			req.Header.Set("X-User", user)
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			return rr
+		}
+
+		if rr := request("alice"); rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		if rr := request("alice"); rr.Code != http.StatusServiceUnavailable || rr.Header().Get("X-RateLimit-Limit") != "1" {
+			t.Errorf("Expected the denied handler with the rate limit headers, got %d %v", rr.Code, rr.Header())
+		}
+
+		// Other users from the same IP are not limited by alice
+		if rr := request("bob"); rr.Code != http.StatusOK {
+			t.Errorf("Expected 200 for another user, got %d", rr.Code)
+		}
+		if rr := request("banned"); rr.Code != http.StatusNotFound {
+			t.Errorf("Expected the error handler for a denied user, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Route policy", func(t *testing.T) {
+		rl, err := ratelimit.New(
+			ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 10, RateWindow: time.Minute}),
+			ratelimit.WithRoutePolicy("login", ratelimit.RoutePolicy{
+				Method:        "POST",
+				Pattern:       "/login",
+				LimiterConfig: ratelimit.Policy{RateLimit: 1, RateWindow: time.Minute},
+			}),
+		)
+		if err != nil {
+			t.Fatalf("Error creating limiter: %v", err)
+		}
+		defer rl.Close()
+
+		r := chi.NewRouter()
+		r.Use(rl.Middleware)
+		r.Post("/login", okHandler)
+		r.Get("/", okHandler)
+
+		serve(r, "POST", "/login", "192.168.2.1:1234", "")
+		rr := serve(r, "POST", "/login", "192.168.2.1:1234", "")
+		if rr.Code != http.StatusTooManyRequests || rr.Header().Get("RateLimit-Policy") != `"login.ip";q=1;w=60` {
+			t.Errorf("Expected the login policy to reject the request, got %d %v", rr.Code, rr.Header())
+		}
+		if rr := serve(r, "GET", "/", "192.168.2.1:1234", ""); rr.Code != http.StatusOK {
+			t.Errorf("Expected the other routes not to be limited by the login policy, got %d", rr.Code)
+		}
+	})
+
+	t.Run("Custom storage and token store", func(t *testing.T) {
+		store := &countingStorage{Storage: ratelimit.NewMemoryStorage(config.StorageConfig{})}
+		rl, err := ratelimit.New(
+			ratelimit.WithStorage(store),
+			ratelimit.WithPolicy(ratelimit.Policy{RateLimit: 10, RateWindow: time.Minute}),
+			ratelimit.WithConfig(ratelimit.Config{
+				IP:   ratelimit.Policy{RateLimit: 10, RateWindow: time.Minute},
+				Plan: map[string]ratelimit.Policy{"basic": {RateLimit: 1, RateWindow: time.Minute}},
+			}),
+			ratelimit.WithTokenStore(staticTokens{"key": {ID: "acme", Plan: "basic", Enabled: true}}),
+		)
+		if err != nil {
+			t.Fatalf("Error creating limiter: %v", err)
+		}
+		defer rl.Close()
+		handler := rl.Middleware(okHandler)
+
+		if rr := serve(handler, "GET", "/", "192.168.3.1:1234", "key"); rr.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", rr.Code)
+		}
+		if rr := serve(handler, "GET", "/", "192.168.3.1:1234", "key"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("Expected the plan of the key to reject the request, got %d", rr.Code)
+		}
+		if rr := serve(handler, "GET", "/", "192.168.3.1:1234", "unknown"); rr.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a key the token store does not accept, got %d", rr.Code)
+		}
+		if store.takes != 2 {
+			t.Errorf("Expected the requests to be taken from the storage, got %d takes", store.takes)
+		}
+
+		state, err := store.State(context.Background(), "token:acme")
+		if err != nil {
+			t.Fatalf("Error reading key state: %v", err)
+		}
+		if len(state.Counters) == 0 {
+			t.Errorf("Expected the counters of the key, got %+v", state)
+		}
+	})
+}
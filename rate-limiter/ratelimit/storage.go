@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/config"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/storage"
+)
+
+// Result is the outcome of a Storage.Take
+type Result struct {
+	// Allowed reports whether the request was allowed
+	Allowed bool
+	// Remaining is how many requests are still allowed by the algorithm
+	Remaining int
+	// ResetAfter is how long until the algorithm fully restores the limit
+	ResetAfter time.Duration
+	// RetryAfter is how long until a rejected request may be retried
+	RetryAfter time.Duration
+	// BlockedKey is the key whose block rejected the request, it is also set when the request blocked the key
+	BlockedKey string
+	// Blocked reports that the request exceeded the limit and blocked the key and the linked keys
+	Blocked bool
+}
+
+// KeyState describes what a storage holds for a key
+type KeyState struct {
+	Key string
+	// Counters maps each algorithm with state for the key to the requests it counted,
+	// for the bucket algorithms it is the tokens left or the requests queued
+	Counters map[string]int
+	// BlockedFor is how long the key stays blocked, zero when it is not blocked
+	// and negative when the block never expires
+	BlockedFor time.Duration
+	// Violations is how many times the key was blocked by a progressive block policy
+	// since its offenses were last forgotten
+	Violations int
+	// InFlight is how many requests of the key hold a concurrency slot
+	InFlight int
+}
+
+// Storage keeps the counters, the blocks and the access lists, the storages of NewStorage
+// implement it and so may the storages of other services
+type Storage interface {
+	// Get returns the current count for a key
+	Get(ctx context.Context, key string) (int, error)
+	// Increment increments the counter for a key and returns the new value, creating it
+	// with the given expiration
+	Increment(ctx context.Context, key string, expiration time.Duration) (int, error)
+	// IncrementBy adds n to the counter for a key and returns the new value, creating
+	// it with the given expiration like Increment
+	IncrementBy(ctx context.Context, key string, n int, expiration time.Duration) (int, error)
+	// Take atomically checks whether the key or any of the linked keys is blocked, registers a
+	// request costing cost requests for the key with the algorithm of policy and, when the
+	// limit is exceeded, blocks the key and the linked keys for policy.BlockFor the offenses
+	// of the key
+	Take(ctx context.Context, key string, cost int, policy Policy, linked ...string) (Result, error)
+	// Acquire takes one of the limit concurrency slots of a key for the lease id until
+	// the lease expires or is released, renewing the lease when it already holds a slot,
+	// and reports false when every slot is taken
+	Acquire(ctx context.Context, key, id string, limit int, lease time.Duration) (bool, error)
+	// Release frees the concurrency slot held by a lease
+	Release(ctx context.Context, key, id string) error
+	// Reset resets the counter for a key
+	Reset(ctx context.Context, key string) error
+	// IsBlocked checks if a key is in the blocklist
+	IsBlocked(ctx context.Context, key string) (bool, error)
+	// Block adds a key to the blocklist with the given expiration
+	Block(ctx context.Context, key string, expiration time.Duration) error
+	// Unblock removes a key from the blocklist
+	Unblock(ctx context.Context, key string) error
+	// State returns the counters and the block of a key
+	State(ctx context.Context, key string) (KeyState, error)
+	// List returns the state of every key with counters or blocks
+	List(ctx context.Context) ([]KeyState, error)
+	// Blocks returns how long each blocked key stays blocked, negative when the block never
+	// expires, reading only the blocks
+	Blocks(ctx context.Context) (map[string]time.Duration, error)
+	// AccessList returns the sorted entries of an access list, such as config.AccessListAllow
+	AccessList(ctx context.Context, list string) ([]string, error)
+	// AddAccess adds an entry to an access list
+	AddAccess(ctx context.Context, list, entry string) error
+	// RemoveAccess removes an entry from an access list
+	RemoveAccess(ctx context.Context, list, entry string) error
+	// Close closes the storage connection
+	Close() error
+}
+
+// NewStorage creates a storage registered under name, "memory", "redis" or "redis_cached"
+func NewStorage(name string, cfg config.StorageConfig) (Storage, error) {
+	store, err := storage.New(name, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return fromStorage(store), nil
+}
+
+// NewMemoryStorage creates a storage keeping the counters in the memory of the process
+func NewMemoryStorage(cfg config.StorageConfig) Storage {
+	return fromStorage(storage.NewMemoryStorage(cfg))
+}
+
+// builtinStorage is a storage of the server given to the limiter as a Storage
+type builtinStorage struct {
+	storage.Storage
+}
+
+func (s builtinStorage) Take(ctx context.Context, key string, cost int, policy Policy, linked ...string) (Result, error) {
+	result, err := s.Storage.Take(ctx, key, cost, policy, linked...)
+	return Result(result), err
+}
+
+func (s builtinStorage) State(ctx context.Context, key string) (KeyState, error) {
+	state, err := s.Storage.State(ctx, key)
+	return KeyState(state), err
+}
+
+func (s builtinStorage) List(ctx context.Context) ([]KeyState, error) {
+	states, err := s.Storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]KeyState, len(states))
+	for i, state := range states {
+		listed[i] = KeyState(state)
+	}
+	return listed, nil
+}
+
+// customStorage is a Storage given to the limiter as a storage of the server
+type customStorage struct {
+	Storage
+}
+
+func (s customStorage) Take(ctx context.Context, key string, cost int, limiterConfig config.LimiterConfig, linked ...string) (storage.Result, error) {
+	result, err := s.Storage.Take(ctx, key, cost, limiterConfig, linked...)
+	return storage.Result(result), err
+}
+
+func (s customStorage) State(ctx context.Context, key string) (storage.KeyState, error) {
+	state, err := s.Storage.State(ctx, key)
+	return storage.KeyState(state), err
+}
+
+func (s customStorage) List(ctx context.Context) ([]storage.KeyState, error) {
+	states, err := s.Storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	listed := make([]storage.KeyState, len(states))
+	for i, state := range states {
+		listed[i] = storage.KeyState(state)
+	}
+	return listed, nil
+}
+
+// fromStorage returns a storage of the server as a Storage
+func fromStorage(store storage.Storage) Storage {
+	if custom, ok := store.(customStorage); ok {
+		return custom.Storage
+	}
+	return builtinStorage{store}
+}
+
+// toStorage returns a Storage as a storage of the server, unwrapping the storages of NewStorage
+func toStorage(store Storage) storage.Storage {
+	if builtin, ok := store.(builtinStorage); ok {
+		return builtin.Storage
+	}
+	return customStorage{store}
+}
@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/limiter"
+	"github.com/felipeosantos/goexpert/rate-limiter/internal/tokens"
+)
+
+var (
+	// ErrTokenNotFound, ErrTokenExpired and ErrTokenRevoked are returned by a TokenStore
+	// for the API keys it does not accept, which the limiter rejects with ErrInvalidToken
+	ErrTokenNotFound = tokens.ErrNotFound
+	ErrTokenExpired  = tokens.ErrExpired
+	ErrTokenRevoked  = tokens.ErrRevoked
+)
+
+// Token is the token of an API key in a token registry
+type Token struct {
+	// ID identifies the token in the counters, it is kept when the key is rotated
+	ID string
+	// Hash is the hex encoded SHA-256 of the API key
+	Hash string
+	// Owner is who the key was issued to
+	Owner string
+	// Plan is the plan whose policy limits the key, the default policy when it has none
+	Plan string
+	// Enabled is false once the key is revoked
+	Enabled bool
+	// CreatedAt is when the token was created
+	CreatedAt time.Time
+	// ExpiresAt is when the key stops being accepted, zero when it never expires
+	ExpiresAt time.Time
+}
+
+// TokenStore looks up the API keys of a token registry
+type TokenStore interface {
+	// Lookup returns the token of an API key, failing with ErrTokenNotFound,
+	// ErrTokenExpired or ErrTokenRevoked when the key can't be used
+	Lookup(ctx context.Context, key string) (Token, error)
+}
+
+// OpenTokenRegistry opens the token registry kept in path, the file managed by the
+// tokens CLI of the server, a missing file being an empty registry
+func OpenTokenRegistry(path string) (TokenStore, error) {
+	store, err := tokens.NewFileStore(path)
+	if err != nil {
+		return nil, err
+	}
+	return registry{store}, nil
+}
+
+// registry is a token registry of the server given to the limiter as a TokenStore
+type registry struct {
+	limiter.TokenStore
+}
+
+func (r registry) Lookup(ctx context.Context, key string) (Token, error) {
+	token, err := r.TokenStore.Lookup(ctx, key)
+	return Token(token), err
+}
+
+// customTokenStore is a TokenStore given to the limiter as a token registry of the server
+type customTokenStore struct {
+	TokenStore
+}
+
+func (s customTokenStore) Lookup(ctx context.Context, key string) (tokens.Token, error) {
+	token, err := s.TokenStore.Lookup(ctx, key)
+	return tokens.Token(token), err
+}
+
+// toTokenStore returns a TokenStore as a token registry of the server, unwrapping the
+// registries of OpenTokenRegistry
+func toTokenStore(store TokenStore) limiter.TokenStore {
+	if registry, ok := store.(registry); ok {
+		return registry.TokenStore
+	}
+	return customTokenStore{store}
+}